@@ -41,6 +41,48 @@ func BenchmarkGoroutinePut(b *testing.B) {
 	wg.Wait()
 }
 
+// SyncData on: concurrent writers share fsync through group commit,
+// without it every write syncs by itself
+func BenchmarkGoroutinePutSync(b *testing.B) {
+	b.Run("GroupCommit", func(b *testing.B) {
+		benchmarkGoroutinePutSync(b, false)
+	})
+	b.Run("NoGroupCommit", func(b *testing.B) {
+		benchmarkGoroutinePutSync(b, true)
+	})
+}
+
+func benchmarkGoroutinePutSync(b *testing.B, disableGroupCommit bool) {
+	options := db.DefaultOptions
+	dir, _ := os.MkdirTemp("/tmp", "bamboo-bench-sync")
+	options.DataDir = dir
+	options.SyncData = true
+	options.DisableGroupCommit = disableGroupCommit
+
+	syncInstance, err := db.CreateDB(options)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		_ = syncInstance.Close()
+		_ = os.RemoveAll(dir)
+	}()
+
+	var wg sync.WaitGroup
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := syncInstance.Put(utils.GetTestKey(i), utils.ConcurrencyRandomValue(1024))
+			assert.Nil(b, err)
+		}(i)
+	}
+	wg.Wait()
+}
+
 func BenchmarkGoroutineGet(b *testing.B) {
 	var wg sync.WaitGroup
 	for i := 0; i < 10000; i++ {
@@ -1,5 +1,7 @@
 #!/bin/bash
 
 go test -v -bench=BenchmarkGoroutinePut -benchtime=30s
+go test -v -bench=BenchmarkGoroutinePutSync -benchtime=30s
 go test -v -bench=BenchmarkGoroutineGet -benchtime=30s
-go test -v -bench=BenchmarkGoroutineDelete -benchtime=30s
\ No newline at end of file
+go test -v -bench=BenchmarkGoroutineDelete -benchtime=30s
+go test -v -bench=BenchmarkOpen -benchtime=10x
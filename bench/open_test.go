@@ -0,0 +1,76 @@
+package bench
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bamboo/content"
+	"bamboo/db"
+	"bamboo/db/utils"
+)
+
+// open a db of n blocks, each block holds about 128 values of 1KB
+func prepareOpenBench(b *testing.B, blocks int) db.Options {
+	options := db.DefaultOptions
+	dir, _ := os.MkdirTemp("/tmp", "bamboo-bench-open")
+	options.DataDir = dir
+	options.DataSize = 128 * 1024
+	// every open reads the blocks
+	options.IndexCheckpoint = false
+
+	instance, err := db.CreateDB(options)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < blocks*128; i++ {
+		if err := instance.Put(utils.GetTestKey(i), utils.RandomValue(1024)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := instance.Close(); err != nil {
+		b.Fatal(err)
+	}
+	return options
+}
+
+// open time against block count, blocks are read from hints or scanned
+func BenchmarkOpen(b *testing.B) {
+	for _, blocks := range []int{16, 64, 256} {
+		options := prepareOpenBench(b, blocks)
+
+		for _, workers := range []int{1, 4} {
+			for _, scan := range []bool{false, true} {
+				name := fmt.Sprintf("blocks=%d/workers=%d/hint", blocks, workers)
+				if scan {
+					name = fmt.Sprintf("blocks=%d/workers=%d/scan", blocks, workers)
+				}
+
+				b.Run(name, func(b *testing.B) {
+					options.OpenWorkers = workers
+					b.ReportAllocs()
+					for i := 0; i < b.N; i++ {
+						if scan {
+							b.StopTimer()
+							hints, _ := filepath.Glob(filepath.Join(options.DataDir, "*"+content.HintSuffix))
+							for _, hint := range hints {
+								_ = os.Remove(hint)
+							}
+							b.StartTimer()
+						}
+
+						instance, err := db.CreateDB(options)
+						if err != nil {
+							b.Fatal(err)
+						}
+						b.StopTimer()
+						_ = instance.Close()
+						b.StartTimer()
+					}
+				})
+			}
+		}
+		_ = os.RemoveAll(options.DataDir)
+	}
+}
@@ -0,0 +1,52 @@
+package content
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+)
+
+// BlobPointer locates a large value stored in a blob file
+type BlobPointer struct {
+	FileIndex uint32
+	Offset    int64
+	// DiskByteUsage is the size of the blob log
+	DiskByteUsage uint32
+}
+
+func GetBlobName(dir string, fileId uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("%09d", fileId)+BlobSuffix)
+}
+
+// blob files share the format of blocks, a blob log holds key and the large value
+func OpenBlobWithOptions(path string, fileIndex uint32, options BlockOptions) (*BlockFile, error) {
+	return NewBlockFile(GetBlobName(path, fileIndex), fileIndex, options)
+}
+
+// EncodeBlobPointer
+// 1. fileIndex
+// 2. offset
+// 3. DiskByteUsage
+func EncodeBlobPointer(pointer *BlobPointer) []byte {
+	buffer := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64)
+	var cnt = 0
+	cnt += binary.PutVarint(buffer[cnt:], int64(pointer.FileIndex))
+	cnt += binary.PutVarint(buffer[cnt:], pointer.Offset)
+	cnt += binary.PutVarint(buffer[cnt:], int64(pointer.DiskByteUsage))
+	return buffer[:cnt]
+}
+
+// DecodeBlobPointer, return the pointer and the bytes it used
+func DecodeBlobPointer(buffer []byte) (*BlobPointer, int) {
+	pointer := &BlobPointer{}
+	fileIndex, fileIndexByteCnt := binary.Varint(buffer)
+	pointer.FileIndex = uint32(fileIndex)
+
+	offset, offsetByteCnt := binary.Varint(buffer[fileIndexByteCnt:])
+	pointer.Offset = offset
+
+	diskByteUsage, diskByteUsageCnt := binary.Varint(buffer[fileIndexByteCnt+offsetByteCnt:])
+	pointer.DiskByteUsage = uint32(diskByteUsage)
+
+	return pointer, fileIndexByteCnt + offsetByteCnt + diskByteUsageCnt
+}
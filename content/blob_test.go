@@ -0,0 +1,25 @@
+package content
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeBlobPointer(t *testing.T) {
+	pointer := &BlobPointer{FileIndex: 7, Offset: 1 << 33, DiskByteUsage: 4096}
+	buf := EncodeBlobPointer(pointer)
+	decoded, n := DecodeBlobPointer(buf)
+	assert.Equal(t, pointer, decoded)
+	assert.Equal(t, len(buf), n)
+}
+
+func TestEncodeIndexWithBlob(t *testing.T) {
+	idx1 := &LogStructIndex{FileIndex: 3, Offset: 1024, DiskByteUsage: 42,
+		Blob: &BlobPointer{FileIndex: 1, Offset: 512, DiskByteUsage: 65536}}
+	assert.Equal(t, idx1, DecodeIndex(EncodeIndex(idx1)))
+
+	idx2 := &LogStructIndex{FileIndex: 3, Offset: 1024, DiskByteUsage: 42, Expire: 1700000000000000000,
+		Blob: &BlobPointer{FileIndex: 1, Offset: 512, DiskByteUsage: 65536}}
+	assert.Equal(t, idx2, DecodeIndex(EncodeIndex(idx2)))
+}
@@ -2,16 +2,36 @@ package content
 
 import (
 	"bamboo/diskIO"
+	"encoding/binary"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"path/filepath"
+	"time"
 )
 
+// WritePos and all offsets of logs are counted after the block header
 type BlockFile struct {
-	FileIndex uint32
-	IOManager diskIO.IOManager
-	WritePos  int64
+	FileIndex  uint32
+	IOManager  diskIO.IOManager
+	WritePos   int64
+	options    BlockOptions
+	cipher     *blockCipher
+	header     *BlockHeader
+	headerSize int64
+}
+
+type BlockOptions struct {
+	IOType diskIO.IOType
+	// KeyProvider: if not nil, new blocks are encrypted with its current key
+	KeyProvider KeyProvider
+	// IOOptions: settings of the io type
+	IOOptions diskIO.IOOptions
+	// LegacyFormat: a new block is written without the versioned header, as older versions did.
+	// its logs are encrypted by the nonce of their offset, which a truncated block reuses
+	LegacyFormat bool
+	// Checksum: the crc algorithm of logs in a new block, a legacy block is always ChecksumIEEE
+	Checksum ChecksumType
 }
 
 func GetBlockName(dir string, fileId uint32) string {
@@ -19,26 +39,196 @@ func GetBlockName(dir string, fileId uint32) string {
 }
 
 func GenerateNewBlock(fileName string, fileIndex uint32, ioType diskIO.IOType) (*BlockFile, error) {
-	fio, err := diskIO.NewIOManager(fileName, ioType)
+	return NewBlockFile(fileName, fileIndex, BlockOptions{IOType: ioType})
+}
+
+func NewBlockFile(fileName string, fileIndex uint32, options BlockOptions) (*BlockFile, error) {
+	fio, err := diskIO.NewIOManagerWithOptions(fileName, options.IOType, options.IOOptions)
 	if err != nil {
 		return nil, err
 	}
 
-	return &BlockFile{
+	block := &BlockFile{
 		FileIndex: fileIndex,
 		IOManager: fio,
 		WritePos:  0,
-	}, nil
+		options:   options,
+	}
+
+	if err := block.loadHeader(); err != nil {
+		_ = fio.Close()
+		return nil, err
+	}
+	return block, nil
 }
 
 func OpenBlock(path string, fileIndex uint32, ioType diskIO.IOType) (*BlockFile, error) {
+	return OpenBlockWithOptions(path, fileIndex, BlockOptions{IOType: ioType})
+}
+
+func OpenBlockWithOptions(path string, fileIndex uint32, options BlockOptions) (*BlockFile, error) {
 	name := GetBlockName(path, fileIndex)
-	return GenerateNewBlock(name, fileIndex, ioType)
+	return NewBlockFile(name, fileIndex, options)
+}
+
+// loadHeader reads the header of a block, a legacy block may have none.
+// a new block gets a header of CurrentFormat, or a legacy one if options.LegacyFormat
+func (d *BlockFile) loadHeader() error {
+	fileSize, err := d.IOManager.Size()
+	if err != nil {
+		return err
+	}
+
+	if fileSize > 0 {
+		headerLen := blockHeaderSize
+		if fileSize < headerLen {
+			headerLen = fileSize
+		}
+		data := make([]byte, headerLen)
+		if _, err := d.IOManager.Read(data, 0); err != nil && err != io.EOF {
+			return err
+		}
+		if !isUnwrittenHeader(data) {
+			return d.decodeHeader(data)
+		}
+
+		// no log is in the block yet, write its header again
+		if err := d.IOManager.Truncate(0); err != nil {
+			return err
+		}
+	}
+
+	// new block, mmap can not write: the header is written when io is restored
+	if d.options.IOType == diskIO.MMapIO {
+		return nil
+	}
+	return d.writeHeader()
+}
+
+func (d *BlockFile) decodeHeader(data []byte) error {
+	header, headerSize, err := parseHeader(data)
+	if err != nil {
+		return err
+	}
+
+	if header.encrypted {
+		blockCipher, err := openBlockCipher(header.keyId, header.nonce, header.recordNonce, d.options.KeyProvider)
+		if err != nil {
+			return err
+		}
+		d.cipher = blockCipher
+	}
+	d.header, d.headerSize = header, headerSize
+	return nil
+}
+
+func (d *BlockFile) writeHeader() error {
+	header := &BlockHeader{
+		Version:   CurrentFormat,
+		Checksum:  d.options.Checksum,
+		CreatedAt: time.Now().UnixNano(),
+	}
+	if d.options.LegacyFormat {
+		header.Version, header.Checksum, header.CreatedAt = FormatLegacy, ChecksumIEEE, 0
+	}
+
+	var blockCipher *blockCipher
+	if d.options.KeyProvider != nil {
+		var err error
+		if blockCipher, err = newBlockCipherFromProvider(d.options.KeyProvider); err != nil {
+			return err
+		}
+		// a legacy block can only be sealed by the offsets of logs
+		blockCipher.recordNonce = header.Version != FormatLegacy
+		header.encrypted, header.recordNonce = true, blockCipher.recordNonce
+		header.keyId, header.nonce = blockCipher.keyId, blockCipher.nonce
+	}
+
+	data, err := header.encodeAs(header.Version)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if n, err := d.IOManager.Write(data); err != nil {
+			// a part of the header is written again on next open
+			if n > 0 {
+				_ = d.IOManager.Truncate(0)
+			}
+			return err
+		}
+	}
+	d.header, d.headerSize, d.cipher = header, int64(len(data)), blockCipher
+	return nil
+}
+
+// HeaderSize: bytes before the first log
+func (d *BlockFile) HeaderSize() int64 {
+	return d.headerSize
+}
+
+// Header: the format of the block
+func (d *BlockFile) Header() BlockHeader {
+	if d.header == nil {
+		return BlockHeader{Version: FormatLegacy}
+	}
+	return *d.header
+}
+
+// Checksum: the crc algorithm of logs in the block
+func (d *BlockFile) Checksum() ChecksumType {
+	// the header of a new mmap block is not written yet
+	if d.header == nil {
+		if d.options.LegacyFormat {
+			return ChecksumIEEE
+		}
+		return d.options.Checksum
+	}
+	return d.header.Checksum
+}
+
+// Encode a log to be written to the block
+func (d *BlockFile) Encode(log *LogStruct) ([]byte, int64) {
+	return EncoderWithChecksum(log, d.Checksum())
+}
+
+// IsEncrypted reports whether the logs of block are sealed
+func (d *BlockFile) IsEncrypted() bool {
+	return d.cipher != nil
+}
+
+// KeyId is the id of the key which seals the block
+func (d *BlockFile) KeyId() uint32 {
+	if d.cipher == nil {
+		return 0
+	}
+	return d.cipher.keyId
+}
+
+// WriteSize: the bytes used on disk to write n bytes
+func (d *BlockFile) WriteSize(n int64) int64 {
+	if d.cipher != nil {
+		return d.cipher.sealedSize(n)
+	}
+	return n
 }
 
 func (d *BlockFile) Write(p []byte) error {
+	if d.cipher != nil {
+		sealed, err := d.cipher.seal(p, d.WritePos)
+		if err != nil {
+			return err
+		}
+		p = sealed
+	}
+
 	n, err := d.IOManager.Write(p)
 	if err != nil {
+		// drop a partial write, so the next log starts at WritePos
+		if n > 0 {
+			if err := d.IOManager.Truncate(d.WritePos + d.headerSize); err != nil {
+				return err
+			}
+		}
 		return err
 	}
 
@@ -51,24 +241,47 @@ func (d *BlockFile) SetIOManager(dir string, ioType diskIO.IOType) error {
 		return err
 	}
 
-	ioManager, err := diskIO.NewIOManager(GetBlockName(dir, d.FileIndex), ioType)
+	ioManager, err := diskIO.NewIOManagerWithOptions(GetBlockName(dir, d.FileIndex), ioType, d.options.IOOptions)
 
 	if err != nil {
 		return err
 	}
 
 	d.IOManager = ioManager
+	d.options.IOType = ioType
+
+	// an empty block opened by mmap has no header yet
+	if d.header == nil {
+		return d.loadHeader()
+	}
 	return nil
 }
 
+// Size of the block, without header
+func (d *BlockFile) Size() (int64, error) {
+	fileSize, err := d.IOManager.Size()
+	if err != nil {
+		return 0, err
+	}
+
+	if fileSize < d.headerSize {
+		return 0, nil
+	}
+	return fileSize - d.headerSize, nil
+}
+
 func (d *BlockFile) ReadBytes(offset int64, readLen int64) ([]byte, error) {
 	toRead := make([]byte, readLen)
-	_, err := d.IOManager.Read(toRead, offset)
+	_, err := d.IOManager.Read(toRead, offset+d.headerSize)
 	return toRead, err
 }
 
 func (d *BlockFile) ReadLog(offset int64) (*LogStruct, int64, error) {
-	fileSize, err := d.IOManager.Size()
+	if d.cipher != nil {
+		return d.readSealedLog(offset)
+	}
+
+	fileSize, err := d.Size()
 	if err != nil {
 		return nil, 0, err
 	}
@@ -87,6 +300,10 @@ func (d *BlockFile) ReadLog(offset int64) (*LogStruct, int64, error) {
 	headInfo, headSize := DecodeHeader(headBuffer)
 	// EOF
 	if headInfo == nil {
+		if offset < fileSize {
+			// some bytes left, but not enough for a header: torn write
+			return nil, 0, io.ErrUnexpectedEOF
+		}
 		return nil, 0, io.EOF
 	}
 	if headInfo.crc == 0 && headInfo.KeySize == 0 && headInfo.ValueSize == 0 {
@@ -96,8 +313,15 @@ func (d *BlockFile) ReadLog(offset int64) (*LogStruct, int64, error) {
 	// key and value
 	keySize, valueSize := int64(headInfo.KeySize), int64(headInfo.ValueSize)
 
+	// the log is cut off by the end of file
+	if offset+headSize+keySize+valueSize > fileSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
 	logData := &LogStruct{
-		Type: headInfo.LogType,
+		Type:   headInfo.LogType,
+		Expire: headInfo.Expire,
+		Blob:   headInfo.Blob,
 	}
 	if keySize > 0 || valueSize > 0 {
 		kvData, err := d.ReadBytes(offset+headSize, keySize+valueSize)
@@ -109,14 +333,114 @@ func (d *BlockFile) ReadLog(offset int64) (*LogStruct, int64, error) {
 	}
 
 	var totalSize = headSize + keySize + valueSize
-	crc := getDataCRC(logData, headBuffer[crc32.Size:headSize])
+	if err := checkLog(logData, headInfo, headBuffer[:headSize], d.Checksum()); err != nil {
+		// return size, so the caller can skip the log
+		return nil, totalSize, err
+	}
+
+	return logData, totalSize, nil
+}
+
+// read a log written by a sealed block
+func (d *BlockFile) readSealedLog(offset int64) (*LogStruct, int64, error) {
+	fileSize, err := d.Size()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if offset >= fileSize {
+		return nil, 0, io.EOF
+	}
+	if offset+sealedLenSize > fileSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	lenBuffer, err := d.ReadBytes(offset, sealedLenSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	sealedLen := int64(binary.LittleEndian.Uint32(lenBuffer))
+	// zero filled tail
+	if sealedLen == 0 {
+		return nil, 0, io.EOF
+	}
+
+	totalSize := sealedLenSize + sealedLen
+	if offset+totalSize > fileSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+
+	sealed, err := d.ReadBytes(offset, totalSize)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	plain, err := d.cipher.open(sealed, offset)
+	if err != nil {
+		return nil, totalSize, err
+	}
+
+	logData, err := decodeLog(plain, d.Checksum())
+	if err != nil {
+		return nil, totalSize, err
+	}
+	return logData, totalSize, nil
+}
+
+// decode a whole encoded log
+func decodeLog(data []byte, checksum ChecksumType) (*LogStruct, error) {
+	headInfo, headSize := DecodeHeader(data)
+	if headInfo == nil {
+		return nil, ErrCRCNotMatch
+	}
+
+	keySize, valueSize := int64(headInfo.KeySize), int64(headInfo.ValueSize)
+	if headSize+keySize+valueSize != int64(len(data)) {
+		return nil, ErrCRCNotMatch
+	}
+
+	logData := &LogStruct{
+		Type:   headInfo.LogType,
+		Expire: headInfo.Expire,
+		Blob:   headInfo.Blob,
+		Key:    data[headSize : headSize+keySize],
+		Value:  data[headSize+keySize:],
+	}
+
+	if err := checkLog(logData, headInfo, data[:headSize], checksum); err != nil {
+		return nil, err
+	}
+	return logData, nil
+}
+
+// check crc, and decompress value
+func checkLog(logData *LogStruct, headInfo *logHeader, head []byte, checksum ChecksumType) error {
+	crc := getDataCRC(logData, head[crc32.Size:], checksum)
 
 	// if crc not match, return error
 	if crc != headInfo.crc {
-		return nil, 0, ErrCRCNotMatch
+		return ErrCRCNotMatch
 	}
 
-	return logData, totalSize, nil
+	// decompress after crc check, crc is computed on the stored bytes
+	if headInfo.Compressed {
+		value, err := DecompressValue(logData.Value)
+		if err != nil {
+			return err
+		}
+		logData.Value = value
+	}
+	return nil
+}
+
+// Truncate drops all bytes after size, used to cut off a torn tail
+func (d *BlockFile) Truncate(size int64) error {
+	if err := d.IOManager.Truncate(size + d.headerSize); err != nil {
+		return err
+	}
+
+	d.WritePos = size
+	return nil
 }
 
 func (d *BlockFile) Sync() error {
@@ -2,6 +2,7 @@ package content
 
 import (
 	"bamboo/diskIO"
+	"io"
 	"os"
 	"testing"
 
@@ -107,3 +108,37 @@ func TestReadLogRecord(t *testing.T) {
 	assert.Equal(t, rec3, readRec3)
 	assert.Equal(t, size3, readSize3)
 }
+
+func TestReadTornLog(t *testing.T) {
+	dataFile, err := OpenBlock(t.TempDir(), 0, diskIO.FileSystemIO)
+	assert.Nil(t, err)
+
+	rec := &LogStruct{
+		Key:   []byte("name"),
+		Value: []byte("bamboo"),
+	}
+	res, size := Encoder(rec)
+	err = dataFile.Write(res)
+	assert.Nil(t, err)
+
+	// half of a log
+	err = dataFile.Write(res[:size/2])
+	assert.Nil(t, err)
+	_, _, err = dataFile.ReadLog(size)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// truncate the torn log
+	err = dataFile.Truncate(size)
+	assert.Nil(t, err)
+	assert.Equal(t, size, dataFile.WritePos)
+	_, _, err = dataFile.ReadLog(size)
+	assert.Equal(t, io.EOF, err)
+
+	// broken log: the size is still known
+	res[len(res)-1] ^= 0xff
+	err = dataFile.Write(res)
+	assert.Nil(t, err)
+	_, brokenSize, err := dataFile.ReadLog(size)
+	assert.Equal(t, ErrCRCNotMatch, err)
+	assert.Equal(t, size, brokenSize)
+}
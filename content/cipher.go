@@ -0,0 +1,220 @@
+package content
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+var (
+	ErrKeyProviderMissing = errors.New("block is encrypted, but no key provider")
+	ErrKeyNotExist        = errors.New("encryption key not exist")
+	ErrDecryptFailed      = errors.New("decrypt log failed")
+	ErrBlockHeader        = errors.New("block header is broken")
+)
+
+// KeyProvider gives AES keys (16, 24 or 32 bytes) to encrypt blocks
+type KeyProvider interface {
+	// CurrentKey: the key to seal new blocks
+	CurrentKey() (keyId uint32, key []byte, err error)
+	// Key: the key to open blocks sealed with keyId
+	Key(keyId uint32) ([]byte, error)
+}
+
+// StaticKeyProvider keeps all keys in memory
+type StaticKeyProvider struct {
+	keys    map[uint32][]byte
+	current uint32
+}
+
+func NewStaticKeyProvider(current uint32, keys map[uint32][]byte) *StaticKeyProvider {
+	return &StaticKeyProvider{keys: keys, current: current}
+}
+
+func (s *StaticKeyProvider) CurrentKey() (uint32, []byte, error) {
+	key, err := s.Key(s.current)
+	return s.current, key, err
+}
+
+func (s *StaticKeyProvider) Key(keyId uint32) ([]byte, error) {
+	key, ok := s.keys[keyId]
+	if !ok {
+		return nil, ErrKeyNotExist
+	}
+	return key, nil
+}
+
+// encrypted block header, written at the beginning of the file
+//
+//	+-----------+---------+------------+-----------+-----------+
+//	|   magic   | version |   key id   |   nonce   |    crc    |
+//	+-----------+---------+------------+-----------+-----------+
+//	   4 byte     4 byte     4 byte       12 byte     4 byte
+//
+// logs are sealed with AES-GCM, nonce of each log = block nonce ^ offset.
+// a truncated block reuses the nonces of its offsets, so new blocks get a random
+// nonce for each log instead, see headerFlagRecordNonce
+var encryptedBlockMagic = []byte("BBEN")
+
+const (
+	encryptedBlockVersion uint32 = 1
+	encryptedHeaderSize   int64  = 28
+	// every sealed log has a 4 byte length prefix
+	sealedLenSize int64 = 4
+	gcmNonceSize  int64 = 12
+)
+
+type blockCipher struct {
+	keyId uint32
+	nonce []byte
+	aead  cipher.AEAD
+	// recordNonce: each log has its own random nonce, else the nonce is derived from the offset
+	recordNonce bool
+}
+
+func newBlockCipher(keyId uint32, key []byte, nonce []byte) (*blockCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &blockCipher{keyId: keyId, nonce: nonce, aead: aead}, nil
+}
+
+// create a cipher with the current key and a random nonce, for a new block
+func newBlockCipherFromProvider(keyProvider KeyProvider) (*blockCipher, error) {
+	keyId, key, err := keyProvider.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcmNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return newBlockCipher(keyId, key, nonce)
+}
+
+// encodeEncryptedHeader: the header of a legacy encrypted block
+func encodeEncryptedHeader(keyId uint32, nonce []byte) []byte {
+	header := make([]byte, encryptedHeaderSize)
+	copy(header[:4], encryptedBlockMagic)
+	binary.LittleEndian.PutUint32(header[4:8], encryptedBlockVersion)
+	binary.LittleEndian.PutUint32(header[8:12], keyId)
+	copy(header[12:24], nonce)
+	binary.LittleEndian.PutUint32(header[24:], crc32.ChecksumIEEE(header[:24]))
+	return header
+}
+
+// check magic of the first bytes of a block
+func isEncryptedHeader(header []byte) bool {
+	return len(header) >= len(encryptedBlockMagic) &&
+		string(header[:len(encryptedBlockMagic)]) == string(encryptedBlockMagic)
+}
+
+// decodeEncryptedHeader: key id and nonce of a legacy encrypted block
+func decodeEncryptedHeader(header []byte) (uint32, []byte, error) {
+	if int64(len(header)) < encryptedHeaderSize ||
+		binary.LittleEndian.Uint32(header[24:]) != crc32.ChecksumIEEE(header[:24]) ||
+		binary.LittleEndian.Uint32(header[4:8]) != encryptedBlockVersion {
+		return 0, nil, ErrBlockHeader
+	}
+
+	nonce := make([]byte, gcmNonceSize)
+	copy(nonce, header[12:24])
+	return binary.LittleEndian.Uint32(header[8:12]), nonce, nil
+}
+
+// get the key of keyId from keyProvider, for a block sealed with it
+func openBlockCipher(keyId uint32, nonce []byte, recordNonce bool, keyProvider KeyProvider) (*blockCipher, error) {
+	if keyProvider == nil {
+		return nil, ErrKeyProviderMissing
+	}
+
+	key, err := keyProvider.Key(keyId)
+	if err != nil {
+		return nil, err
+	}
+	blockCipher, err := newBlockCipher(keyId, key, nonce)
+	if err != nil {
+		return nil, err
+	}
+	blockCipher.recordNonce = recordNonce
+	return blockCipher, nil
+}
+
+// each offset of a block gets a unique nonce
+func (c *blockCipher) nonceAt(offset int64) []byte {
+	nonce := make([]byte, len(c.nonce))
+	copy(nonce, c.nonce)
+
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(offset))
+	for i := 0; i < 8; i++ {
+		nonce[4+i] ^= buf[i]
+	}
+	return nonce
+}
+
+// sealedSize: the size of plain data with n bytes after sealing
+func (c *blockCipher) sealedSize(n int64) int64 {
+	if c.recordNonce {
+		n += gcmNonceSize
+	}
+	return sealedLenSize + n + int64(c.aead.Overhead())
+}
+
+//	+------------+-----------+------------------------+
+//	|   length   |   nonce   |  ciphertext + gcm tag  |
+//	+------------+-----------+------------------------+
+//	   4 byte       12 byte           elastic
+//
+// length counts the bytes after it. nonce exists only with recordNonce,
+// the offset is authenticated with it, so a log can not be moved
+func (c *blockCipher) seal(plain []byte, offset int64) ([]byte, error) {
+	sealed := make([]byte, sealedLenSize, c.sealedSize(int64(len(plain))))
+	binary.LittleEndian.PutUint32(sealed, uint32(c.sealedSize(int64(len(plain)))-sealedLenSize))
+	if !c.recordNonce {
+		return c.aead.Seal(sealed, c.nonceAt(offset), plain, sealed[:sealedLenSize]), nil
+	}
+
+	nonce := make([]byte, gcmNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed = append(sealed, nonce...)
+	return c.aead.Seal(sealed, nonce, plain, sealedData(sealed[:sealedLenSize], offset)), nil
+}
+
+func (c *blockCipher) open(sealed []byte, offset int64) ([]byte, error) {
+	var plain []byte
+	var err error
+	if !c.recordNonce {
+		plain, err = c.aead.Open(nil, c.nonceAt(offset), sealed[sealedLenSize:], sealed[:sealedLenSize])
+	} else if int64(len(sealed)) < sealedLenSize+gcmNonceSize {
+		err = ErrDecryptFailed
+	} else {
+		nonce := sealed[sealedLenSize : sealedLenSize+gcmNonceSize]
+		plain, err = c.aead.Open(nil, nonce, sealed[sealedLenSize+gcmNonceSize:], sealedData(sealed[:sealedLenSize], offset))
+	}
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return plain, nil
+}
+
+// sealedData: the additional data of a log with its own nonce, its length prefix and offset
+func sealedData(length []byte, offset int64) []byte {
+	data := make([]byte, len(length)+8)
+	copy(data, length)
+	binary.LittleEndian.PutUint64(data[len(length):], uint64(offset))
+	return data
+}
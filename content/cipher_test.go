@@ -0,0 +1,151 @@
+package content
+
+import (
+	"bamboo/diskIO"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKeyProvider(current uint32) *StaticKeyProvider {
+	return NewStaticKeyProvider(current, map[uint32][]byte{
+		1: bytes.Repeat([]byte{1}, 32),
+		2: bytes.Repeat([]byte{2}, 32),
+	})
+}
+
+func TestEncryptedBlock(t *testing.T) {
+	dir := t.TempDir()
+	options := BlockOptions{IOType: diskIO.FileSystemIO, KeyProvider: testKeyProvider(1)}
+	dataFile, err := OpenBlockWithOptions(dir, 0, options)
+	assert.Nil(t, err)
+	assert.True(t, dataFile.IsEncrypted())
+	assert.Equal(t, uint32(1), dataFile.KeyId())
+
+	rec1 := &LogStruct{Key: []byte("name"), Value: []byte("bamboo-secret")}
+	res1, size1 := Encoder(rec1)
+	assert.Nil(t, dataFile.Write(res1))
+	assert.Equal(t, dataFile.WriteSize(size1), dataFile.WritePos)
+
+	rec2 := &LogStruct{Key: []byte("name"), Value: []byte(""), Type: LogDeleted}
+	res2, _ := Encoder(rec2)
+	assert.Nil(t, dataFile.Write(res2))
+	assert.Nil(t, dataFile.Close())
+
+	// no plain text on disk
+	raw, err := os.ReadFile(GetBlockName(dir, 0))
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("bamboo-secret")))
+
+	// rotate the current key, old blocks are still readable
+	options.KeyProvider = testKeyProvider(2)
+	dataFile2, err := OpenBlockWithOptions(dir, 0, options)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), dataFile2.KeyId())
+
+	readRec1, readSize1, err := dataFile2.ReadLog(0)
+	assert.Nil(t, err)
+	assert.Equal(t, rec1, readRec1)
+	readRec2, readSize2, err := dataFile2.ReadLog(readSize1)
+	assert.Nil(t, err)
+	assert.Equal(t, rec2, readRec2)
+	_, _, err = dataFile2.ReadLog(readSize1 + readSize2)
+	assert.Equal(t, io.EOF, err)
+
+	// a new block uses the new key
+	dataFile3, err := OpenBlockWithOptions(dir, 1, options)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), dataFile3.KeyId())
+
+	// without key
+	_, err = OpenBlockWithOptions(dir, 0, BlockOptions{IOType: diskIO.FileSystemIO})
+	assert.Equal(t, ErrKeyProviderMissing, err)
+	_, err = OpenBlockWithOptions(dir, 0, BlockOptions{
+		IOType:      diskIO.FileSystemIO,
+		KeyProvider: NewStaticKeyProvider(2, map[uint32][]byte{2: bytes.Repeat([]byte{2}, 32)}),
+	})
+	assert.Equal(t, ErrKeyNotExist, err)
+}
+
+func TestEncryptedBlockTampered(t *testing.T) {
+	dir := t.TempDir()
+	options := BlockOptions{IOType: diskIO.FileSystemIO, KeyProvider: testKeyProvider(1)}
+	dataFile, err := OpenBlockWithOptions(dir, 0, options)
+	assert.Nil(t, err)
+
+	res, _ := Encoder(&LogStruct{Key: []byte("name"), Value: []byte("bamboo")})
+	assert.Nil(t, dataFile.Write(res))
+	assert.Nil(t, dataFile.Close())
+
+	fileName := GetBlockName(dir, 0)
+	raw, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	raw[len(raw)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, raw, 0644))
+
+	dataFile2, err := OpenBlockWithOptions(dir, 0, options)
+	assert.Nil(t, err)
+	_, size, err := dataFile2.ReadLog(0)
+	assert.Equal(t, ErrDecryptFailed, err)
+	assert.Equal(t, dataFile.WritePos, size)
+}
+
+func TestEncryptedHintBlock(t *testing.T) {
+	dir := t.TempDir()
+	hintFile, err := GenerateNewHintBlock(dir, testKeyProvider(1))
+	assert.Nil(t, err)
+	assert.True(t, hintFile.IsEncrypted())
+
+	indexer := &LogStructIndex{FileIndex: 1, Offset: 2, DiskByteUsage: 3}
+	assert.Nil(t, hintFile.WriteToHintBlock([]byte("name"), indexer))
+
+	hintFile2, err := GenerateNewHintBlock(dir, testKeyProvider(2))
+	assert.Nil(t, err)
+	rec, _, err := hintFile2.ReadLog(0)
+	assert.Nil(t, err)
+	assert.Equal(t, indexer, DecodeIndex(rec.Value))
+
+	raw, err := os.ReadFile(filepath.Join(dir, HintFileTag))
+	assert.Nil(t, err)
+	assert.False(t, bytes.Contains(raw, []byte("name")))
+}
+
+// a truncated block writes the same offset again, with another nonce
+func TestEncryptedBlockRecordNonce(t *testing.T) {
+	dir := t.TempDir()
+	options := BlockOptions{IOType: diskIO.FileSystemIO, KeyProvider: testKeyProvider(1)}
+	dataFile, err := OpenBlockWithOptions(dir, 0, options)
+	assert.Nil(t, err)
+	assert.True(t, dataFile.Header().recordNonce)
+
+	res, size := Encoder(&LogStruct{Key: []byte("name"), Value: []byte("bamboo")})
+	assert.Nil(t, dataFile.Write(res))
+	assert.Equal(t, dataFile.WriteSize(size), dataFile.WritePos)
+	first, err := dataFile.ReadBytes(0, dataFile.WritePos)
+	assert.Nil(t, err)
+
+	assert.Nil(t, dataFile.Truncate(0))
+	assert.Nil(t, dataFile.Write(res))
+	second, err := dataFile.ReadBytes(0, dataFile.WritePos)
+	assert.Nil(t, err)
+	assert.Equal(t, first[:sealedLenSize], second[:sealedLenSize])
+	assert.NotEqual(t, first[sealedLenSize:sealedLenSize+gcmNonceSize], second[sealedLenSize:sealedLenSize+gcmNonceSize])
+	assert.NotEqual(t, first[sealedLenSize+gcmNonceSize:], second[sealedLenSize+gcmNonceSize:])
+
+	// the offset is authenticated, a log moved to another offset is not opened
+	assert.Nil(t, dataFile.Write(res))
+	_, _, err = dataFile.ReadLog(int64(len(second)))
+	assert.Nil(t, err)
+	_, err = dataFile.IOManager.Write(second)
+	assert.Nil(t, err)
+	_, _, err = dataFile.ReadLog(2 * int64(len(second)))
+	assert.Equal(t, ErrDecryptFailed, err)
+	assert.Nil(t, dataFile.Close())
+
+	// not to be migrated to the legacy format
+	assert.Equal(t, ErrBlockVersion, CheckBlockMigration(diskIO.OS, GetBlockName(dir, 0), FormatLegacy))
+}
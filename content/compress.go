@@ -0,0 +1,56 @@
+package content
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+type CompressionType = byte
+
+const (
+	NoCompression    CompressionType = 0
+	FlateCompression CompressionType = 1
+)
+
+// flate writers are expensive to create, reuse them
+var flateWriterPool = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.BestSpeed)
+		return w
+	},
+}
+
+// CompressValue compress value with flate,
+// return false if the compressed value is not smaller than the raw one
+func CompressValue(value []byte) ([]byte, bool) {
+	if len(value) == 0 {
+		return nil, false
+	}
+
+	var buffer bytes.Buffer
+	w := flateWriterPool.Get().(*flate.Writer)
+	defer flateWriterPool.Put(w)
+
+	w.Reset(&buffer)
+	if _, err := w.Write(value); err != nil {
+		return nil, false
+	}
+	if err := w.Close(); err != nil {
+		return nil, false
+	}
+
+	if buffer.Len() >= len(value) {
+		return nil, false
+	}
+	return buffer.Bytes(), true
+}
+
+// DecompressValue restore the value written by CompressValue
+func DecompressValue(value []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(value))
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
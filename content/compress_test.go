@@ -0,0 +1,50 @@
+package content
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressValue(t *testing.T) {
+	value := bytes.Repeat([]byte(`{"name":"bamboo","type":"kv"}`), 100)
+	compressed, ok := CompressValue(value)
+	assert.True(t, ok)
+	assert.Less(t, len(compressed), len(value))
+
+	raw, err := DecompressValue(compressed)
+	assert.Nil(t, err)
+	assert.Equal(t, value, raw)
+
+	// too short to shrink
+	_, ok = CompressValue([]byte("a"))
+	assert.False(t, ok)
+	_, ok = CompressValue(nil)
+	assert.False(t, ok)
+}
+
+func TestReadCompressedLog(t *testing.T) {
+	dataFile, err := OpenBlock(t.TempDir(), 0, 0)
+	assert.Nil(t, err)
+
+	value := bytes.Repeat([]byte("bamboo-"), 100)
+	compressed, ok := CompressValue(value)
+	assert.True(t, ok)
+
+	// compressed and raw logs in the same block
+	res1, size1 := Encoder(&LogStruct{Key: []byte("k1"), Value: compressed, Compressed: true})
+	assert.Nil(t, dataFile.Write(res1))
+	res2, _ := Encoder(&LogStruct{Key: []byte("k2"), Value: value})
+	assert.Nil(t, dataFile.Write(res2))
+
+	rec1, readSize1, err := dataFile.ReadLog(0)
+	assert.Nil(t, err)
+	assert.Equal(t, size1, readSize1)
+	assert.Equal(t, value, rec1.Value)
+	assert.False(t, rec1.Compressed)
+
+	rec2, _, err := dataFile.ReadLog(size1)
+	assert.Nil(t, err)
+	assert.Equal(t, value, rec2.Value)
+}
@@ -9,11 +9,20 @@ type LogType = byte
 
 const (
 	Suffix                   = ".btdata"
-	MaxLogHeaderSize int64   = binary.MaxVarintLen32*2 + 5
+	BlobSuffix               = ".btblob"
+	HintSuffix               = ".bthint"
+	hintTempSuffix           = ".tmp"
+	MaxLogHeaderSize int64   = binary.MaxVarintLen32*2 + 5 + binary.MaxVarintLen64
 	LogNormal        LogType = 0
 	LogDeleted       LogType = 1
 	LogAtomicFinish  LogType = 2
 
+	// the low bits of the type byte hold LogType, the high bits are flags
+	logTypeMask       byte = 0x0f
+	logFlagExpire     byte = 0x80
+	logFlagCompressed byte = 0x40
+	logFlagBlob       byte = 0x20
+
 	HintFileTag      = "bamboo-hint"
 	MergeFinishedTag = "MERGE.FINISHED"
 )
@@ -0,0 +1,288 @@
+package content
+
+import (
+	"bamboo/diskIO"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+var ErrBlockVersion = errors.New("block format version is not supported")
+
+// block header, written at the beginning of every new block, blob, hint and checkpoint file
+//
+//	+-------+---------+----------+-------+------------+--------+---------+-------+
+//	| magic | version | checksum | flags | created at | key id |  nonce  |  crc  |
+//	+-------+---------+----------+-------+------------+--------+---------+-------+
+//	 4 byte   2 byte    1 byte    1 byte    8 byte     4 byte   12 byte   4 byte
+//
+// key id and nonce are zero if the block is not encrypted. checksum is the algorithm
+// of the logs, the crc of the header itself is always crc32 IEEE.
+// a legacy block has no header, or only the encryption header of cipher.go
+var blockMagic = []byte("BTBK")
+
+const (
+	blockHeaderSize int64 = 36
+
+	headerFlagEncrypted byte = 0x01
+	// headerFlagRecordNonce: each log of the encrypted block has its own nonce
+	headerFlagRecordNonce byte = 0x02
+)
+
+type FormatVersion = uint16
+
+const (
+	// FormatLegacy: no header, or only the encryption header
+	FormatLegacy FormatVersion = 0
+	// FormatV1: the versioned block header
+	FormatV1 FormatVersion = 1
+	// CurrentFormat: the version of new blocks
+	CurrentFormat = FormatV1
+)
+
+// ChecksumType: the algorithm of the crc of logs
+type ChecksumType = byte
+
+const (
+	ChecksumIEEE ChecksumType = 0
+	// ChecksumCastagnoli: crc32c, stronger, and hardware accelerated on most cpus
+	ChecksumCastagnoli ChecksumType = 1
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumTable: nil if checksum is unknown
+func checksumTable(checksum ChecksumType) *crc32.Table {
+	switch checksum {
+	case ChecksumIEEE:
+		return crc32.IEEETable
+	case ChecksumCastagnoli:
+		return castagnoliTable
+	default:
+		return nil
+	}
+}
+
+func IsChecksumSupported(checksum ChecksumType) bool {
+	return checksumTable(checksum) != nil
+}
+
+// UpdateChecksum returns crc updated with data by the algorithm checksum
+func UpdateChecksum(checksum ChecksumType, crc uint32, data []byte) uint32 {
+	return crc32.Update(crc, checksumTable(checksum), data)
+}
+
+// BlockHeader: the format of a block file
+type BlockHeader struct {
+	Version  FormatVersion
+	Checksum ChecksumType
+	// CreatedAt: unix nano time of creation, 0 if unknown
+	CreatedAt int64
+
+	encrypted   bool
+	recordNonce bool
+	keyId       uint32
+	nonce       []byte
+}
+
+func (h *BlockHeader) encode() []byte {
+	header := make([]byte, blockHeaderSize)
+	copy(header[:4], blockMagic)
+	binary.LittleEndian.PutUint16(header[4:6], h.Version)
+	header[6] = h.Checksum
+	if h.encrypted {
+		header[7] |= headerFlagEncrypted
+	}
+	if h.recordNonce {
+		header[7] |= headerFlagRecordNonce
+	}
+	binary.LittleEndian.PutUint64(header[8:16], uint64(h.CreatedAt))
+	binary.LittleEndian.PutUint32(header[16:20], h.keyId)
+	copy(header[20:32], h.nonce)
+	binary.LittleEndian.PutUint32(header[32:], crc32.ChecksumIEEE(header[:32]))
+	return header
+}
+
+// encodeAs: the header bytes of version, nil for a legacy block without encryption
+func (h *BlockHeader) encodeAs(version FormatVersion) ([]byte, error) {
+	switch version {
+	case FormatLegacy:
+		// legacy logs are always checked by crc32 IEEE, and sealed with the nonce of their offset
+		if h.Checksum != ChecksumIEEE || h.recordNonce {
+			return nil, ErrBlockVersion
+		}
+		if !h.encrypted {
+			return nil, nil
+		}
+		return encodeEncryptedHeader(h.keyId, h.nonce), nil
+	case FormatV1:
+		header := *h
+		header.Version = version
+		return header.encode(), nil
+	default:
+		return nil, ErrBlockVersion
+	}
+}
+
+func isBlockHeader(header []byte) bool {
+	return bytes.HasPrefix(header, blockMagic)
+}
+
+func decodeBlockHeader(data []byte) (*BlockHeader, error) {
+	if int64(len(data)) < blockHeaderSize ||
+		binary.LittleEndian.Uint32(data[32:]) != crc32.ChecksumIEEE(data[:32]) {
+		return nil, ErrBlockHeader
+	}
+
+	header := &BlockHeader{
+		Version:   binary.LittleEndian.Uint16(data[4:6]),
+		Checksum:  data[6],
+		CreatedAt: int64(binary.LittleEndian.Uint64(data[8:16])),
+		encrypted: data[7]&headerFlagEncrypted != 0,
+	}
+	if header.encrypted {
+		header.recordNonce = data[7]&headerFlagRecordNonce != 0
+		header.keyId = binary.LittleEndian.Uint32(data[16:20])
+		header.nonce = append([]byte(nil), data[20:32]...)
+	}
+	if header.Version == FormatLegacy || header.Version > CurrentFormat || !IsChecksumSupported(header.Checksum) {
+		return nil, ErrBlockVersion
+	}
+	return header, nil
+}
+
+// parseHeader reads the header of a block from its first bytes, and returns its size.
+// the key of an encrypted block is not needed
+func parseHeader(data []byte) (*BlockHeader, int64, error) {
+	switch {
+	case isBlockHeader(data):
+		header, err := decodeBlockHeader(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		return header, blockHeaderSize, nil
+	case isEncryptedHeader(data):
+		keyId, nonce, err := decodeEncryptedHeader(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		return &BlockHeader{Version: FormatLegacy, encrypted: true, keyId: keyId, nonce: nonce}, encryptedHeaderSize, nil
+	default:
+		return &BlockHeader{Version: FormatLegacy}, 0, nil
+	}
+}
+
+// isUnwrittenHeader: the header of a new block is cut off by a crash, or never written
+// to a preallocated file. no log is written before the whole header
+func isUnwrittenHeader(data []byte) bool {
+	if int64(len(data)) >= blockHeaderSize {
+		return isZero(data[:blockHeaderSize])
+	}
+	if len(data) < len(blockMagic) {
+		return bytes.HasPrefix(blockMagic, data)
+	}
+	return isBlockHeader(data) || isZero(data)
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// MigrateBlockFile rewrites the header of the block file fileName as version, its logs
+// are copied as they are. the file is replaced by rename, it must not be open.
+// changed is false if the file has no header yet, or is of version already
+func MigrateBlockFile(fs diskIO.FileSystem, fileName string, version FormatVersion) (changed bool, err error) {
+	src, err := fs.Open(fileName)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return false, err
+	}
+	newHeader, headerSize, err := migratedHeader(src, info, version)
+	if err != nil || headerSize < 0 {
+		return false, err
+	}
+
+	tempName := fileName + hintTempSuffix
+	_ = fs.Remove(tempName)
+	dst, err := fs.Create(tempName)
+	if err != nil {
+		return false, err
+	}
+	if _, err = dst.Write(newHeader); err == nil {
+		_, err = io.Copy(dst, io.NewSectionReader(src, headerSize, info.Size()-headerSize))
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = fs.Remove(tempName)
+		return false, err
+	}
+	return true, fs.Rename(tempName, fileName)
+}
+
+// CheckBlockMigration: nil if MigrateBlockFile can rewrite fileName as version,
+// ErrBlockVersion if the block can not be written in version
+func CheckBlockMigration(fs diskIO.FileSystem, fileName string, version FormatVersion) error {
+	src, err := fs.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	_, _, err = migratedHeader(src, info, version)
+	return err
+}
+
+// migratedHeader: the header of the block src as version, and the size of its header now.
+// headerSize is -1 if there is nothing to migrate
+func migratedHeader(src io.Reader, info os.FileInfo, version FormatVersion) ([]byte, int64, error) {
+	headerLen := blockHeaderSize
+	if info.Size() < headerLen {
+		headerLen = info.Size()
+	}
+	data := make([]byte, headerLen)
+	if _, err := io.ReadFull(src, data); err != nil {
+		return nil, 0, err
+	}
+	if len(data) == 0 || isUnwrittenHeader(data) {
+		return nil, -1, nil
+	}
+
+	header, headerSize, err := parseHeader(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if header.Version == version {
+		return nil, -1, nil
+	}
+	if header.Version == FormatLegacy {
+		// the best guess of when a legacy block was created
+		header.CreatedAt = info.ModTime().UnixNano()
+	}
+	newHeader, err := header.encodeAs(version)
+	if err != nil {
+		return nil, 0, err
+	}
+	return newHeader, headerSize, nil
+}
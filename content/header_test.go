@@ -0,0 +1,228 @@
+package content
+
+import (
+	"bamboo/diskIO"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestLogs(t *testing.T, block *BlockFile, logs ...*LogStruct) {
+	for _, log := range logs {
+		res, _ := Encoder(log)
+		assert.Nil(t, block.Write(res))
+	}
+}
+
+func readTestLogs(t *testing.T, block *BlockFile) []*LogStruct {
+	var logs []*LogStruct
+	offset := int64(0)
+	for {
+		log, size, err := block.ReadLog(offset)
+		if err == io.EOF {
+			return logs
+		}
+		if !assert.Nil(t, err) {
+			return logs
+		}
+		logs = append(logs, log)
+		offset += size
+	}
+}
+
+func TestBlockHeader(t *testing.T) {
+	dir := t.TempDir()
+	log := &LogStruct{Key: []byte("name"), Value: []byte("bamboo")}
+
+	block, err := OpenBlock(dir, 0, diskIO.FileSystemIO)
+	assert.Nil(t, err)
+	header := block.Header()
+	assert.Equal(t, CurrentFormat, header.Version)
+	assert.Equal(t, ChecksumIEEE, header.Checksum)
+	assert.Greater(t, header.CreatedAt, int64(0))
+	assert.Equal(t, blockHeaderSize, block.HeaderSize())
+	writeTestLogs(t, block, log)
+	assert.Nil(t, block.Close())
+
+	// offsets are counted after the header
+	block, err = OpenBlock(dir, 0, diskIO.MMapIO)
+	assert.Nil(t, err)
+	assert.Equal(t, header, block.Header())
+	assert.Equal(t, []*LogStruct{log}, readTestLogs(t, block))
+	assert.Nil(t, block.Close())
+
+	// a broken header
+	name := GetBlockName(dir, 0)
+	raw, err := os.ReadFile(name)
+	assert.Nil(t, err)
+	raw[10] ^= 0xff
+	assert.Nil(t, os.WriteFile(name, raw, 0644))
+	_, err = OpenBlock(dir, 0, diskIO.FileSystemIO)
+	assert.Equal(t, ErrBlockHeader, err)
+
+	// a block of a newer version
+	raw[10] ^= 0xff
+	binary.LittleEndian.PutUint16(raw[4:6], CurrentFormat+1)
+	binary.LittleEndian.PutUint32(raw[32:36], crc32.ChecksumIEEE(raw[:32]))
+	assert.Nil(t, os.WriteFile(name, raw, 0644))
+	_, err = OpenBlock(dir, 0, diskIO.FileSystemIO)
+	assert.Equal(t, ErrBlockVersion, err)
+}
+
+func TestLegacyBlock(t *testing.T) {
+	dir := t.TempDir()
+	log := &LogStruct{Key: []byte("name"), Value: []byte("bamboo")}
+
+	for i, keyProvider := range []KeyProvider{nil, testKeyProvider(1)} {
+		options := BlockOptions{IOType: diskIO.FileSystemIO, KeyProvider: keyProvider, LegacyFormat: true}
+		block, err := OpenBlockWithOptions(dir, uint32(i), options)
+		assert.Nil(t, err)
+		writeTestLogs(t, block, log)
+		assert.Nil(t, block.Close())
+
+		raw, err := os.ReadFile(GetBlockName(dir, uint32(i)))
+		assert.Nil(t, err)
+		assert.False(t, isBlockHeader(raw))
+
+		// a legacy block is read without the option
+		options.LegacyFormat = false
+		block, err = OpenBlockWithOptions(dir, uint32(i), options)
+		assert.Nil(t, err)
+		assert.Equal(t, FormatLegacy, block.Header().Version)
+		assert.Equal(t, keyProvider != nil, block.IsEncrypted())
+		assert.Equal(t, []*LogStruct{log}, readTestLogs(t, block))
+
+		// and appended as it is
+		block.WritePos, err = block.Size()
+		assert.Nil(t, err)
+		writeTestLogs(t, block, log)
+		assert.Equal(t, []*LogStruct{log, log}, readTestLogs(t, block))
+		assert.Nil(t, block.Close())
+	}
+}
+
+func TestTornBlockHeader(t *testing.T) {
+	dir := t.TempDir()
+	block, err := OpenBlock(dir, 0, diskIO.FileSystemIO)
+	assert.Nil(t, err)
+	assert.Nil(t, block.Close())
+
+	// a crash in the middle of the header, or a preallocated block
+	name := GetBlockName(dir, 0)
+	raw, err := os.ReadFile(name)
+	assert.Nil(t, err)
+	for _, torn := range [][]byte{raw[:2], raw[:20], make([]byte, 64)} {
+		assert.Nil(t, os.WriteFile(name, torn, 0644))
+		block, err := OpenBlock(dir, 0, diskIO.FileSystemIO)
+		assert.Nil(t, err)
+		assert.Equal(t, CurrentFormat, block.Header().Version)
+		size, err := block.IOManager.Size()
+		assert.Nil(t, err)
+		assert.Equal(t, blockHeaderSize, size)
+		assert.Nil(t, block.Close())
+	}
+}
+
+func TestMigrateBlockFile(t *testing.T) {
+	dir := t.TempDir()
+	log := &LogStruct{Key: []byte("name"), Value: []byte("bamboo")}
+	options := BlockOptions{IOType: diskIO.FileSystemIO, KeyProvider: testKeyProvider(1), LegacyFormat: true}
+	block, err := OpenBlockWithOptions(dir, 0, options)
+	assert.Nil(t, err)
+	writeTestLogs(t, block, log, log)
+	assert.Nil(t, block.Close())
+
+	name := GetBlockName(dir, 0)
+	for _, version := range []FormatVersion{FormatV1, FormatV1, FormatLegacy, FormatV1} {
+		before, err := os.ReadFile(name)
+		assert.Nil(t, err)
+		changed, err := MigrateBlockFile(diskIO.OS, name, version)
+		assert.Nil(t, err)
+		after, err := os.ReadFile(name)
+		assert.Nil(t, err)
+		assert.Equal(t, changed, len(before) != len(after) || string(before) != string(after))
+
+		block, err := OpenBlockWithOptions(dir, 0, options)
+		assert.Nil(t, err)
+		assert.Equal(t, version, block.Header().Version)
+		assert.Equal(t, uint32(1), block.KeyId())
+		assert.Equal(t, []*LogStruct{log, log}, readTestLogs(t, block))
+		assert.Nil(t, block.Close())
+	}
+
+	_, err = os.Stat(name + hintTempSuffix)
+	assert.True(t, os.IsNotExist(err))
+
+	// an empty block has nothing to migrate
+	empty := filepath.Join(dir, "empty")
+	assert.Nil(t, os.WriteFile(empty, nil, 0644))
+	changed, err := MigrateBlockFile(diskIO.OS, empty, FormatV1)
+	assert.Nil(t, err)
+	assert.False(t, changed)
+}
+
+func TestCastagnoliBlock(t *testing.T) {
+	dir := t.TempDir()
+	log := &LogStruct{Key: []byte("name"), Value: []byte("bamboo")}
+
+	for i, keyProvider := range []KeyProvider{nil, testKeyProvider(1)} {
+		options := BlockOptions{IOType: diskIO.FileSystemIO, KeyProvider: keyProvider, Checksum: ChecksumCastagnoli}
+		block, err := OpenBlockWithOptions(dir, uint32(i), options)
+		assert.Nil(t, err)
+		assert.Equal(t, ChecksumCastagnoli, block.Header().Checksum)
+		res, _ := block.Encode(log)
+		assert.Nil(t, block.Write(res))
+		assert.Nil(t, block.Close())
+
+		// the checksum of the header is used, not of the options
+		block, err = OpenBlockWithOptions(dir, uint32(i), BlockOptions{IOType: diskIO.MMapIO, KeyProvider: keyProvider})
+		assert.Nil(t, err)
+		assert.Equal(t, ChecksumCastagnoli, block.Checksum())
+		assert.Equal(t, []*LogStruct{log}, readTestLogs(t, block))
+		assert.Nil(t, block.Close())
+	}
+
+	// a log of another checksum does not match
+	block, err := OpenBlockWithOptions(dir, 2, BlockOptions{IOType: diskIO.FileSystemIO, Checksum: ChecksumCastagnoli})
+	assert.Nil(t, err)
+	res, _ := Encoder(log)
+	assert.Nil(t, block.Write(res))
+	_, _, err = block.ReadLog(0)
+	assert.Equal(t, ErrCRCNotMatch, err)
+	assert.Nil(t, block.Close())
+
+	// a legacy block is always crc32 IEEE, so it can not be migrated to
+	_, err = MigrateBlockFile(diskIO.OS, GetBlockName(dir, 0), FormatLegacy)
+	assert.Equal(t, ErrBlockVersion, err)
+
+	// a hint file has the checksum of its options
+	logs := []*TransActionLog{{
+		Log:      &LogStruct{Key: []byte("key-1"), Type: LogNormal},
+		Position: &LogStructIndex{FileIndex: 3, Offset: 0, DiskByteUsage: 20},
+	}}
+	assert.Nil(t, WriteBlockHint(dir, 3, 20, logs, BlockOptions{Checksum: ChecksumCastagnoli}))
+	read, err := ReadBlockHint(dir, 3, 20, BlockOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, logs[0].Position, read[0].Position)
+}
+
+func TestUnknownChecksum(t *testing.T) {
+	dir := t.TempDir()
+	block, err := OpenBlock(dir, 0, diskIO.FileSystemIO)
+	assert.Nil(t, err)
+	assert.Nil(t, block.Close())
+
+	name := GetBlockName(dir, 0)
+	raw, err := os.ReadFile(name)
+	assert.Nil(t, err)
+	raw[6] = 0xff
+	binary.LittleEndian.PutUint32(raw[32:36], crc32.ChecksumIEEE(raw[:32]))
+	assert.Nil(t, os.WriteFile(name, raw, 0644))
+	_, err = OpenBlock(dir, 0, diskIO.FileSystemIO)
+	assert.Equal(t, ErrBlockVersion, err)
+}
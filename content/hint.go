@@ -2,17 +2,31 @@ package content
 
 import (
 	"bamboo/diskIO"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"path/filepath"
 )
 
-func GenerateNewHintBlock(fileName string) (*BlockFile, error) {
+var ErrHintNotMatch = errors.New("block hint is corrupt or does not match the block")
+
+func GenerateNewHintBlock(fileName string, keyProvider KeyProvider) (*BlockFile, error) {
+	return GenerateNewHintBlockWithOptions(fileName, BlockOptions{IOType: diskIO.FileSystemIO, KeyProvider: keyProvider})
+}
+
+func GenerateNewHintBlockWithOptions(fileName string, options BlockOptions) (*BlockFile, error) {
 	name := filepath.Join(fileName, HintFileTag)
-	return GenerateNewBlock(name, 0, diskIO.FileSystemIO)
+	return NewBlockFile(name, 0, options)
 }
 
-func GenerateMergeFinishedBlock(fileName string) (*BlockFile, error) {
+func GenerateMergeFinishedBlock(fileName string, keyProvider KeyProvider) (*BlockFile, error) {
+	return GenerateMergeFinishedBlockWithOptions(fileName, BlockOptions{IOType: diskIO.FileSystemIO, KeyProvider: keyProvider})
+}
+
+func GenerateMergeFinishedBlockWithOptions(fileName string, options BlockOptions) (*BlockFile, error) {
 	name := filepath.Join(fileName, MergeFinishedTag)
-	return GenerateNewBlock(name, 0, diskIO.FileSystemIO)
+	return NewBlockFile(name, 0, options)
 }
 
 func (d *BlockFile) WriteToHintBlock(key []byte, indexer *LogStructIndex) error {
@@ -21,6 +35,143 @@ func (d *BlockFile) WriteToHintBlock(key []byte, indexer *LogStructIndex) error
 		Value: EncodeIndex(indexer),
 	}
 
-	encodedLog, _ := Encoder(log)
+	encodedLog, _ := d.Encode(log)
 	return d.Write(encodedLog)
 }
+
+// GetBlockHintName: the hint file of a sealed block
+func GetBlockHintName(dir string, fileId uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("%09d", fileId)+HintSuffix)
+}
+
+// block hint file:
+// 1. a log for each log of the block: raw key, type, and encoded position as value
+// 2. a footer log with empty key: crc of all entries, count of entries, size of the block
+// it is written to a temp file, and renamed when complete
+
+// WriteBlockHint writes the hint of a sealed block, logs hold the key and type of each log.
+// the hint is written with options, in the file system of options.IOType and options.IOOptions
+func WriteBlockHint(dir string, fileId uint32, blockSize int64, logs []*TransActionLog, options BlockOptions) error {
+	fs := diskIO.FileSystemWithOptions(options.IOType, options.IOOptions)
+	name := GetBlockHintName(dir, fileId)
+	tempName := name + hintTempSuffix
+	_ = fs.Remove(tempName)
+
+	hintFile, err := NewBlockFile(tempName, fileId, options)
+	if err != nil {
+		return err
+	}
+
+	crc := uint32(0)
+	for _, log := range logs {
+		entry := &LogStruct{
+			Key:   log.Log.Key,
+			Type:  log.Log.Type,
+			Value: EncodeIndex(log.Position),
+		}
+		crc = hintEntryCRC(hintFile.Checksum(), crc, entry)
+
+		encodedLog, _ := hintFile.Encode(entry)
+		if err := hintFile.Write(encodedLog); err != nil {
+			_ = hintFile.Close()
+			return err
+		}
+	}
+
+	encodedLog, _ := hintFile.Encode(&LogStruct{Value: encodeHintFooter(crc, len(logs), blockSize)})
+	if err := hintFile.Write(encodedLog); err != nil {
+		_ = hintFile.Close()
+		return err
+	}
+	if err := hintFile.Sync(); err != nil {
+		_ = hintFile.Close()
+		return err
+	}
+	if err := hintFile.Close(); err != nil {
+		return err
+	}
+	return fs.Rename(tempName, name)
+}
+
+// ReadBlockHint reads the hint of a sealed block of blockSize,
+// the log of each entry has the raw key and type, but no value.
+// ErrHintNotMatch if the hint is broken, or it is not written for this block
+func ReadBlockHint(dir string, fileId uint32, blockSize int64, options BlockOptions) ([]*TransActionLog, error) {
+	name := GetBlockHintName(dir, fileId)
+	// opening a missing file would create it
+	if _, err := diskIO.FileSystemOf(options.IOType).Stat(name); err != nil {
+		return nil, err
+	}
+
+	hintFile, err := NewBlockFile(name, fileId, options)
+	if err == ErrBlockHeader || err == ErrBlockVersion {
+		return nil, ErrHintNotMatch
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer hintFile.Close()
+
+	var logs []*TransActionLog
+	crc := uint32(0)
+	offset := int64(0)
+	for {
+		entry, size, err := hintFile.ReadLog(offset)
+		if err != nil {
+			// the footer is missing, or a log is broken
+			return nil, ErrHintNotMatch
+		}
+		offset += size
+
+		// footer
+		if len(entry.Key) == 0 {
+			if !matchHintFooter(entry.Value, crc, len(logs), blockSize) {
+				return nil, ErrHintNotMatch
+			}
+			break
+		}
+
+		crc = hintEntryCRC(hintFile.Checksum(), crc, entry)
+		logs = append(logs, &TransActionLog{
+			Log:      &LogStruct{Key: entry.Key, Type: entry.Type},
+			Position: DecodeIndex(entry.Value),
+		})
+	}
+
+	// nothing is after the footer
+	if _, _, err := hintFile.ReadLog(offset); err != io.EOF {
+		return nil, ErrHintNotMatch
+	}
+	return logs, nil
+}
+
+// hintEntryCRC: by the checksum of the hint file
+func hintEntryCRC(checksum ChecksumType, crc uint32, entry *LogStruct) uint32 {
+	crc = UpdateChecksum(checksum, crc, entry.Key)
+	crc = UpdateChecksum(checksum, crc, []byte{entry.Type})
+	return UpdateChecksum(checksum, crc, entry.Value)
+}
+
+// 4 bytes crc + count + block size
+func encodeHintFooter(crc uint32, count int, blockSize int64) []byte {
+	buffer := make([]byte, 4+binary.MaxVarintLen64*2)
+	binary.LittleEndian.PutUint32(buffer, crc)
+	index := 4
+	index += binary.PutVarint(buffer[index:], int64(count))
+	index += binary.PutVarint(buffer[index:], blockSize)
+	return buffer[:index]
+}
+
+func matchHintFooter(footer []byte, crc uint32, count int, blockSize int64) bool {
+	if len(footer) < 4 || binary.LittleEndian.Uint32(footer) != crc {
+		return false
+	}
+
+	footerCount, n := binary.Varint(footer[4:])
+	if n <= 0 || footerCount != int64(count) {
+		return false
+	}
+
+	footerSize, m := binary.Varint(footer[4+n:])
+	return m > 0 && 4+n+m == len(footer) && footerSize == blockSize
+}
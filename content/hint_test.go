@@ -0,0 +1,61 @@
+package content
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockHint(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bamboo-hint")
+	defer os.RemoveAll(dir)
+
+	logs := []*TransActionLog{
+		{
+			Log:      &LogStruct{Key: []byte("key-1"), Type: LogNormal},
+			Position: &LogStructIndex{FileIndex: 3, Offset: 0, DiskByteUsage: 20},
+		},
+		{
+			Log:      &LogStruct{Key: []byte("key-2"), Type: LogDeleted},
+			Position: &LogStructIndex{FileIndex: 3, Offset: 20, DiskByteUsage: 12},
+		},
+		{
+			Log:      &LogStruct{Key: []byte("key-3"), Type: LogNormal},
+			Position: &LogStructIndex{FileIndex: 3, Offset: 32, DiskByteUsage: 18, Expire: 100},
+		},
+	}
+	err := WriteBlockHint(dir, 3, 50, logs, BlockOptions{})
+	assert.Nil(t, err)
+
+	read, err := ReadBlockHint(dir, 3, 50, BlockOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, len(logs), len(read))
+	for i := range logs {
+		assert.Equal(t, logs[i].Log.Key, read[i].Log.Key)
+		assert.Equal(t, logs[i].Log.Type, read[i].Log.Type)
+		assert.Equal(t, logs[i].Position, read[i].Position)
+	}
+
+	// written for a block of another size
+	_, err = ReadBlockHint(dir, 3, 60, BlockOptions{})
+	assert.Equal(t, ErrHintNotMatch, err)
+
+	// missing
+	_, err = ReadBlockHint(dir, 4, 50, BlockOptions{})
+	assert.True(t, os.IsNotExist(err))
+
+	// corrupt
+	name := GetBlockHintName(dir, 3)
+	data, err := os.ReadFile(name)
+	assert.Nil(t, err)
+	data[10] ^= 0xff
+	assert.Nil(t, os.WriteFile(name, data, 0644))
+	_, err = ReadBlockHint(dir, 3, 50, BlockOptions{})
+	assert.Equal(t, ErrHintNotMatch, err)
+
+	// truncated
+	assert.Nil(t, os.WriteFile(name, data[:len(data)-3], 0644))
+	_, err = ReadBlockHint(dir, 3, 50, BlockOptions{})
+	assert.Equal(t, ErrHintNotMatch, err)
+}
@@ -2,7 +2,6 @@ package content
 
 import (
 	"encoding/binary"
-	"hash/crc32"
 )
 
 // Log-Like Append-Only File
@@ -10,6 +9,12 @@ type LogStruct struct {
 	Key   []byte
 	Value []byte
 	Type  LogType
+	// Expire is the unix nano deadline of the log, 0 means never expire
+	Expire int64
+	// Compressed means Value holds the flate compressed bytes
+	Compressed bool
+	// Blob means Value holds an encoded BlobPointer, the real value is in a blob file
+	Blob bool
 }
 
 // LogStructIndex is a struct that holds the index of the log file on disk
@@ -18,30 +23,62 @@ type LogStructIndex struct {
 	Offset    int64
 	// DiskByteUsage is the size of Total-Log-Block which matches the indexer
 	DiskByteUsage uint32
+	// Expire is copied from the log, so expired keys can be hidden without disk IO
+	Expire int64
+	// Blob is the position of the value, if it is stored in a blob file
+	Blob *BlobPointer
+}
+
+// IsExpired reports whether the indexed log is expired at now (unix nano)
+func (l *LogStructIndex) IsExpired(now int64) bool {
+	return l.Expire > 0 && l.Expire <= now
 }
 
 // Header
 type logHeader struct {
-	KeySize   uint32
-	ValueSize uint32
-	LogType   LogType
-	crc       uint32
+	KeySize    uint32
+	ValueSize  uint32
+	LogType    LogType
+	Expire     int64
+	Compressed bool
+	Blob       bool
+	crc        uint32
 }
 
-//	+--------+-------+-----------+------------+-----------+------------+
-//	| crc    |  type |  key size | value size |    key    |    value   |
-//	+--------+-------+-----------+------------+-----------+------------+
-//	 4 byte    1 byte  maxLen:5    maxLen:5     elastic     elastic
+//	+--------+-------+-----------+------------+-----------+-----------+------------+
+//	| crc    |  type |  key size | value size |  expire   |    key    |    value   |
+//	+--------+-------+-----------+------------+-----------+-----------+------------+
+//	 4 byte    1 byte  maxLen:5    maxLen:5     maxLen:10   elastic     elastic
 //
+// expire only exists when the expire flag of type is set,
+// value is compressed when the compressed flag of type is set,
+// value is a blob pointer when the blob flag of type is set
 // return byte slice and length
 func Encoder(log *LogStruct) (encodeData []byte, encodeLen int64) {
+	return EncoderWithChecksum(log, ChecksumIEEE)
+}
+
+// EncoderWithChecksum: Encoder with the crc computed by checksum
+func EncoderWithChecksum(log *LogStruct, checksum ChecksumType) (encodeData []byte, encodeLen int64) {
 	headBuffer := make([]byte, MaxLogHeaderSize)
 
 	headBuffer[4] = log.Type
+	if log.Expire > 0 {
+		headBuffer[4] |= logFlagExpire
+	}
+	if log.Compressed {
+		headBuffer[4] |= logFlagCompressed
+	}
+	if log.Blob {
+		headBuffer[4] |= logFlagBlob
+	}
 	var index = 5
 
 	index += binary.PutVarint(headBuffer[index:], int64(len(log.Key)))
 	index += binary.PutVarint(headBuffer[index:], int64(len(log.Value)))
+	if log.Expire > 0 {
+		index += binary.PutVarint(headBuffer[index:], log.Expire)
+	}
 
 	var dataLen = index + len(log.Key) + len(log.Value)
 	encodeBytes := make([]byte, dataLen)
@@ -50,7 +87,7 @@ func Encoder(log *LogStruct) (encodeData []byte, encodeLen int64) {
 	copy(encodeBytes[index:], log.Key)
 	copy(encodeBytes[index+len(log.Key):], log.Value)
 
-	crc := crc32.ChecksumIEEE(encodeBytes[4:])
+	crc := UpdateChecksum(checksum, 0, encodeBytes[4:])
 	binary.LittleEndian.PutUint32(encodeBytes[:4], crc)
 
 	return encodeBytes, int64(dataLen)
@@ -63,31 +100,49 @@ func DecodeHeader(data []byte) (*logHeader, int64) {
 	}
 
 	header := &logHeader{
-		crc:     binary.LittleEndian.Uint32(data[:4]),
-		LogType: data[4],
+		crc:        binary.LittleEndian.Uint32(data[:4]),
+		LogType:    data[4] & logTypeMask,
+		Compressed: data[4]&logFlagCompressed != 0,
+		Blob:       data[4]&logFlagBlob != 0,
 	}
 
+	// n <= 0 means the varint is incomplete or broken
 	var index = 5
 	keySize, n := binary.Varint(data[index:])
+	if n <= 0 || keySize < 0 {
+		return nil, 0
+	}
 	header.KeySize = uint32(keySize)
 	index += n
 
 	valueSize, n := binary.Varint(data[index:])
+	if n <= 0 || valueSize < 0 {
+		return nil, 0
+	}
 	header.ValueSize = uint32(valueSize)
 	index += n
 
+	if data[4]&logFlagExpire != 0 {
+		expire, n := binary.Varint(data[index:])
+		if n <= 0 {
+			return nil, 0
+		}
+		header.Expire = expire
+		index += n
+	}
+
 	return header, int64(index)
 }
 
 // crc
-func getDataCRC(l *LogStruct, head []byte) uint32 {
+func getDataCRC(l *LogStruct, head []byte, checksum ChecksumType) uint32 {
 	if l == nil {
 		return 0
 	}
 
-	crc := crc32.ChecksumIEEE(head)
-	crc = crc32.Update(crc, crc32.IEEETable, l.Key)
-	crc = crc32.Update(crc, crc32.IEEETable, l.Value)
+	crc := UpdateChecksum(checksum, 0, head)
+	crc = UpdateChecksum(checksum, crc, l.Key)
+	crc = UpdateChecksum(checksum, crc, l.Value)
 
 	return crc
 }
@@ -98,11 +153,19 @@ func EncodeIndex(indexer *LogStructIndex) []byte {
 	// 1. fileIndex
 	// 2. offset
 	// 3. DiskByteUsage
-	buffer := make([]byte, binary.MaxVarintLen32*2+binary.MaxVarintLen64)
+	// 4. Expire, only if the key has a deadline or a blob
+	// 5. Blob, only if the value is in a blob file
+	buffer := make([]byte, binary.MaxVarintLen32*4+binary.MaxVarintLen64*3)
 	var cnt = 0
 	cnt += binary.PutVarint(buffer[cnt:], int64(indexer.FileIndex))
 	cnt += binary.PutVarint(buffer[cnt:], indexer.Offset)
 	cnt += binary.PutVarint(buffer[cnt:], int64(indexer.DiskByteUsage))
+	if indexer.Expire > 0 || indexer.Blob != nil {
+		cnt += binary.PutVarint(buffer[cnt:], indexer.Expire)
+	}
+	if indexer.Blob != nil {
+		cnt += copy(buffer[cnt:], EncodeBlobPointer(indexer.Blob))
+	}
 	return buffer[:cnt]
 }
 
@@ -118,8 +181,21 @@ func DecodeIndex(buffer []byte) *LogStructIndex {
 	indexer.Offset = offset
 
 	// get DiskByteUsage
-	diskByteUsage, _ := binary.Varint(buffer[(fileIndexByteCnt + offsetByteCnt):])
+	diskByteUsage, diskByteUsageCnt := binary.Varint(buffer[(fileIndexByteCnt + offsetByteCnt):])
 	indexer.DiskByteUsage = uint32(diskByteUsage)
 
+	// get Expire, if exists
+	index := fileIndexByteCnt + offsetByteCnt + diskByteUsageCnt
+	if index < len(buffer) {
+		expire, expireCnt := binary.Varint(buffer[index:])
+		indexer.Expire = expire
+		index += expireCnt
+	}
+
+	// get Blob, if exists
+	if index < len(buffer) {
+		indexer.Blob, _ = DecodeBlobPointer(buffer[index:])
+	}
+
 	return indexer
 }
@@ -72,6 +72,46 @@ func TestGetCRC(t *testing.T) {
 		Type: LogNormal,
 	}
 	headerBuf := []byte{9, 252, 88, 14, 0, 8, 0}
-	crc := getDataCRC(rec, headerBuf[crc32.Size:])
+	crc := getDataCRC(rec, headerBuf[crc32.Size:], ChecksumIEEE)
 	assert.Equal(t, uint32(240712713), crc)
 }
+
+func TestEncodeWithExpire(t *testing.T) {
+	rec := &LogStruct{
+		Key:    []byte("name"),
+		Value:  []byte("bamboo-go"),
+		Type:   LogNormal,
+		Expire: 1700000000000000000,
+	}
+	res, n := Encoder(rec)
+	assert.NotNil(t, res)
+
+	h, size := DecodeHeader(res)
+	assert.Equal(t, LogNormal, h.LogType)
+	assert.Equal(t, rec.Expire, h.Expire)
+	assert.Equal(t, n, size+int64(len(rec.Key)+len(rec.Value)))
+	assert.Equal(t, h.crc, getDataCRC(rec, res[crc32.Size:size], ChecksumIEEE))
+}
+
+func TestEncodeIndexWithExpire(t *testing.T) {
+	idx1 := &LogStructIndex{FileIndex: 3, Offset: 1024, DiskByteUsage: 42}
+	assert.Equal(t, idx1, DecodeIndex(EncodeIndex(idx1)))
+
+	idx2 := &LogStructIndex{FileIndex: 3, Offset: 1024, DiskByteUsage: 42, Expire: 1700000000000000000}
+	assert.Equal(t, idx2, DecodeIndex(EncodeIndex(idx2)))
+	assert.True(t, idx2.IsExpired(idx2.Expire))
+	assert.False(t, idx2.IsExpired(idx2.Expire-1))
+	assert.False(t, idx1.IsExpired(idx2.Expire))
+}
+
+func TestEncodeWithChecksum(t *testing.T) {
+	rec := &LogStruct{Key: []byte("name"), Value: []byte("bamboo-go")}
+	ieee, _ := Encoder(rec)
+	castagnoli, _ := EncoderWithChecksum(rec, ChecksumCastagnoli)
+	assert.Equal(t, ieee[4:], castagnoli[4:])
+
+	h, size := DecodeHeader(castagnoli)
+	assert.Equal(t, crc32.Checksum(castagnoli[4:], crc32.MakeTable(crc32.Castagnoli)), h.crc)
+	assert.Equal(t, h.crc, getDataCRC(rec, castagnoli[crc32.Size:size], ChecksumCastagnoli))
+	assert.NotEqual(t, h.crc, getDataCRC(rec, castagnoli[crc32.Size:size], ChecksumIEEE))
+}
@@ -80,19 +80,33 @@ func (aw *atomicWrite) Commit() error {
 	aw.db.muLock.Lock()
 	defer aw.db.muLock.Unlock()
 
+	if err := aw.db.commitAtomic(aw.dataToWrite, aw.options.SyncCommit); err != nil {
+		return err
+	}
+
+	// clear data to write
+	aw.dataToWrite = make(map[string]*content.LogStruct)
+	return nil
+}
+
+// commitAtomic: write logs with one seqNo and a finished record, then update memory index.
+// logs without the finished record are dropped when db restarts.
+// the caller holds db.muLock
+func (db *DB) commitAtomic(logs map[string]*content.LogStruct, sync bool) error {
 	// get the last seqNo
-	lastSeqNo := atomic.AddUint64(&aw.db.atomicSeq, 1)
+	lastSeqNo := atomic.AddUint64(&db.atomicSeq, 1)
 
 	// put data to disk
 	indexers := make(map[string]*content.LogStructIndex)
-	for _, rec := range aw.dataToWrite {
+	for _, rec := range logs {
 		currentData := &content.LogStruct{
-			Key:   encodeLogKeyWithSeqNo(rec.Key, lastSeqNo),
-			Value: rec.Value,
-			Type:  rec.Type,
+			Key:    encodeLogKeyWithSeqNo(rec.Key, lastSeqNo),
+			Value:  rec.Value,
+			Type:   rec.Type,
+			Expire: rec.Expire,
 		}
 
-		logIndexer, err := aw.db.appendLog(currentData)
+		logIndexer, err := db.appendLog(currentData)
 		if err != nil {
 			return err
 		}
@@ -107,36 +121,23 @@ func (aw *atomicWrite) Commit() error {
 		Type: content.LogAtomicFinish,
 	}
 
-	_, err := aw.db.appendLog(finishedRecord)
+	finishedPos, err := db.appendLog(finishedRecord)
 	if err != nil {
 		return err
 	}
+	db.addGarbage(finishedPos)
 
 	// if Sync
-	if aw.options.SyncCommit && aw.db.activeBlock != nil {
-		if err := aw.db.activeBlock.Sync(); err != nil {
+	if sync && db.activeBlock != nil {
+		if err := db.syncActive(); err != nil {
 			return err
 		}
 	}
 
 	// update memory index
-	for _, rec := range aw.dataToWrite {
-		indexer := indexers[string(rec.Key)]
-		var oldIndexer *content.LogStructIndex
-		if rec.Type == content.LogDeleted {
-			oldIndexer, _ = aw.db.index.Delete(rec.Key)
-		} else {
-			oldIndexer = aw.db.index.Put(rec.Key, indexer)
-		}
-
-		// add size to db.sizeToCollect
-		if oldIndexer != nil {
-			aw.db.spaceToCollect += int64(oldIndexer.DiskByteUsage)
-		}
+	for _, rec := range logs {
+		db.updateIndex(rec.Key, rec.Type, indexers[string(rec.Key)])
 	}
-
-	// clear data to write
-	aw.dataToWrite = make(map[string]*content.LogStruct)
 	return nil
 }
 
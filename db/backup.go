@@ -0,0 +1,452 @@
+package db
+
+import (
+	"archive/tar"
+	"bamboo/content"
+	"bamboo/diskIO"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// BackupManifest lists all files of the db at the time of a backup.
+// a file unchanged since the parent backup is not copied again,
+// its entry names the backup which stores it
+type BackupManifest struct {
+	Id       string
+	ParentId string
+	Files    []BackupFile
+}
+
+type BackupFile struct {
+	Name    string
+	Size    int64
+	ModTime int64
+	// CRC: with Name and Size, to find out if a sealed file is unchanged
+	CRC uint32
+	// Backup: id of the backup which stores the file
+	Backup string
+}
+
+// backupSource: a file of the db opened for backup, read up to Size
+type backupSource struct {
+	file diskIO.File
+	info BackupFile
+	// sealed: a sealed block or blob, which is only replaced as a whole
+	sealed bool
+}
+
+// IncrementalBackup backs up the db into dir. if parent is not empty, it is the dir of
+// the last backup, and a sealed block or blob with the same name, size and crc as in it
+// is not copied again. the active files, hints and merge files are always copied.
+// writers are blocked only while files are opened
+func (db *DB) IncrementalBackup(dir string, parent string) error {
+	manifest := &BackupManifest{Id: strconv.FormatInt(time.Now().UnixNano(), 10)}
+
+	parentFiles := make(map[string]BackupFile)
+	if parent != "" {
+		parentManifest, err := ReadBackupManifest(parent)
+		if err != nil {
+			return err
+		}
+		manifest.ParentId = parentManifest.Id
+		for _, file := range parentManifest.Files {
+			parentFiles[file.Name] = file
+		}
+	}
+
+	if err := prepareEmptyDir(diskIO.OS, dir); err != nil {
+		return err
+	}
+
+	sources, err := db.openBackupSources()
+	defer func() {
+		for _, source := range sources {
+			_ = source.file.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	for _, source := range sources {
+		info := source.info
+		// merge reuses the ids of blocks, so a sealed file is checked by its crc
+		if old, ok := parentFiles[info.Name]; ok && source.sealed && old.Size == info.Size {
+			hash := crc32.NewIEEE()
+			if _, err := io.Copy(hash, io.NewSectionReader(source.file, 0, info.Size)); err != nil {
+				return err
+			}
+			if hash.Sum32() == old.CRC {
+				info.CRC, info.Backup = old.CRC, old.Backup
+				manifest.Files = append(manifest.Files, info)
+				continue
+			}
+		}
+
+		reader := io.NewSectionReader(source.file, 0, info.Size)
+		crc, err := copyFileWithCRC(reader, filepath.Join(dir, info.Name), info.Size)
+		if err != nil {
+			return err
+		}
+		info.CRC, info.Backup = crc, manifest.Id
+		manifest.Files = append(manifest.Files, info)
+	}
+
+	// the manifest is the last, a backup without it is incomplete
+	if err := writeBackupManifest(dir, manifest); err != nil {
+		return err
+	}
+	return diskIO.OS.SyncDir(dir)
+}
+
+// openBackupSources opens every file of the db, and records its size under the lock,
+// so the active files are read up to the last complete log
+func (db *DB) openBackupSources() ([]*backupSource, error) {
+	db.muLock.Lock()
+	defer db.muLock.Unlock()
+
+	if db.activeBlock == nil {
+		return nil, nil
+	}
+	if err := db.syncActive(); err != nil {
+		return nil, err
+	}
+
+	names := []string{content.HintFileTag, content.MergeFinishedTag}
+	sealed := make(map[string]bool)
+	for fileIndex := range db.inactiveBlock {
+		name := filepath.Base(content.GetBlockName(db.options.DataDir, fileIndex))
+		names = append(names, name, filepath.Base(content.GetBlockHintName(db.options.DataDir, fileIndex)))
+		sealed[name] = true
+	}
+	activeName := filepath.Base(content.GetBlockName(db.options.DataDir, db.activeBlock.FileIndex))
+	names = append(names, activeName)
+	for _, blob := range db.allBlobs() {
+		name := filepath.Base(content.GetBlobName(db.options.DataDir, blob.FileIndex))
+		names = append(names, name)
+		sealed[name] = blob != db.activeBlob
+	}
+
+	var sources []*backupSource
+	for _, name := range names {
+		file, err := db.fs.Open(filepath.Join(db.options.DataDir, name))
+		if os.IsNotExist(err) {
+			// a block without hint, or no merge
+			continue
+		}
+		if err != nil {
+			return sources, err
+		}
+
+		stat, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+			return sources, err
+		}
+		size := stat.Size()
+		// the active block may be preallocated, only the written part is copied
+		if name == activeName {
+			if size, err = db.activeBlock.IOManager.Size(); err != nil {
+				_ = file.Close()
+				return sources, err
+			}
+		}
+		sources = append(sources, &backupSource{
+			file:   file,
+			info:   BackupFile{Name: name, Size: size, ModTime: stat.ModTime().UnixNano()},
+			sealed: sealed[name],
+		})
+	}
+	return sources, nil
+}
+
+// Restore rebuilds a data dir from a backup chain: a full backup, then its increments in order.
+// the files of the last backup are copied to a temp dir beside target, and every checksum is checked,
+// then the temp dir is renamed to target, which must not exist or be empty
+func Restore(backupChain []string, target string) error {
+	if len(backupChain) == 0 {
+		return ErrBackupChain
+	}
+
+	// id of backup -> its dir
+	backupDirs := make(map[string]string)
+	var manifest *BackupManifest
+	for i, dir := range backupChain {
+		next, err := ReadBackupManifest(dir)
+		if err != nil {
+			return err
+		}
+		if (i == 0 && next.ParentId != "") || (i > 0 && next.ParentId != manifest.Id) {
+			return ErrBackupChain
+		}
+		backupDirs[next.Id] = dir
+		manifest = next
+	}
+
+	return restoreInto(target, func(tempDir string) error {
+		for _, file := range manifest.Files {
+			dir, ok := backupDirs[file.Backup]
+			if !ok {
+				return ErrBackupChain
+			}
+
+			src, err := os.Open(filepath.Join(dir, file.Name))
+			if err != nil {
+				return err
+			}
+			crc, err := copyFileWithCRC(src, filepath.Join(tempDir, file.Name), file.Size)
+			_ = src.Close()
+			if err == io.EOF || (err == nil && crc != file.CRC) {
+				return ErrBackupCorrupted
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func ReadBackupManifest(dir string) (*BackupManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, backupManifestName))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &BackupManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func writeBackupManifest(dir string, manifest *BackupManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Join(dir, backupManifestName)
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// copyFileWithCRC copies size bytes of src to a new file dst, and returns their crc.
+// io.EOF if src has less bytes
+func copyFileWithCRC(src io.Reader, dst string, size int64) (uint32, error) {
+	file, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	hash := crc32.NewIEEE()
+	_, err = io.CopyN(io.MultiWriter(file, hash), src, size)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return hash.Sum32(), err
+}
+
+// BackupTo writes a tar archive of the db to w, gzip compressed if compress.
+// the archive has the same files as a full IncrementalBackup, and its manifest as the last entry
+func (db *DB) BackupTo(w io.Writer, compress bool) error {
+	sources, err := db.openBackupSources()
+	defer func() {
+		for _, source := range sources {
+			_ = source.file.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	var gzipWriter *gzip.Writer
+	if compress {
+		gzipWriter = gzip.NewWriter(w)
+		w = gzipWriter
+	}
+	tarWriter := tar.NewWriter(w)
+
+	manifest := &BackupManifest{Id: strconv.FormatInt(time.Now().UnixNano(), 10)}
+	for _, source := range sources {
+		info := source.info
+		err := tarWriter.WriteHeader(&tar.Header{
+			Name:    info.Name,
+			Mode:    0644,
+			Size:    info.Size,
+			ModTime: time.Unix(0, info.ModTime),
+		})
+		if err != nil {
+			return err
+		}
+
+		hash := crc32.NewIEEE()
+		if _, err := io.CopyN(io.MultiWriter(tarWriter, hash), source.file, info.Size); err != nil {
+			return err
+		}
+		info.CRC, info.Backup = hash.Sum32(), manifest.Id
+		manifest.Files = append(manifest.Files, info)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = tarWriter.WriteHeader(&tar.Header{
+		Name:    backupManifestName,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := tarWriter.Write(data); err != nil {
+		return err
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	if gzipWriter != nil {
+		return gzipWriter.Close()
+	}
+	return nil
+}
+
+// RestoreFrom reads an archive written by BackupTo, gzip compressed or not.
+// files are extracted to a temp dir beside dir, and checked against the manifest,
+// then the temp dir is renamed to dir, which must not exist or be empty
+func RestoreFrom(r io.Reader, dir string) error {
+	return restoreInto(dir, func(tempDir string) error {
+		return extractBackup(r, tempDir)
+	})
+}
+
+// restoreInto: extract writes the files into a temp dir beside dir,
+// which is renamed to dir when all files are synced, or removed on failure
+func restoreInto(dir string, extract func(tempDir string) error) error {
+	if err := prepareEmptyDir(diskIO.OS, dir); err != nil {
+		return err
+	}
+
+	tempDir := filepath.Clean(dir) + restoreTempSuffix
+	if err := os.RemoveAll(tempDir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(tempDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	installed := false
+	defer func() {
+		if !installed {
+			_ = os.RemoveAll(tempDir)
+		}
+	}()
+
+	if err := extract(tempDir); err != nil {
+		return err
+	}
+	if err := diskIO.OS.SyncDir(tempDir); err != nil {
+		return err
+	}
+
+	// dir is empty
+	if err := os.Remove(dir); err != nil {
+		return err
+	}
+	if err := os.Rename(tempDir, dir); err != nil {
+		return err
+	}
+	installed = true
+	return nil
+}
+
+func extractBackup(r io.Reader, dir string) error {
+	reader := bufio.NewReader(r)
+	magic, err := reader.Peek(2)
+	if err != nil {
+		return ErrBackupCorrupted
+	}
+
+	var archive io.Reader = reader
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		defer gzipReader.Close()
+		archive = gzipReader
+	}
+
+	// name -> size and crc of the extracted file
+	extracted := make(map[string]BackupFile)
+	var manifest *BackupManifest
+	tarReader := tar.NewReader(archive)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// only plain files in the top dir, the manifest is the last one
+		name := header.Name
+		if manifest != nil || header.Typeflag != tar.TypeReg ||
+			name != filepath.Base(name) || name == "." || name == ".." || name == FileLockName {
+			return ErrBackupCorrupted
+		}
+
+		if name == backupManifestName {
+			data, err := io.ReadAll(tarReader)
+			if err != nil {
+				return err
+			}
+			manifest = &BackupManifest{}
+			if err := json.Unmarshal(data, manifest); err != nil {
+				return ErrBackupCorrupted
+			}
+			continue
+		}
+
+		crc, err := copyFileWithCRC(tarReader, filepath.Join(dir, name), header.Size)
+		if err != nil {
+			return err
+		}
+		extracted[name] = BackupFile{Name: name, Size: header.Size, CRC: crc}
+	}
+
+	// every file is in the manifest, with the same size and crc
+	if manifest == nil || len(manifest.Files) != len(extracted) {
+		return ErrBackupCorrupted
+	}
+	for _, file := range manifest.Files {
+		got, ok := extracted[file.Name]
+		if !ok || got.Size != file.Size || got.CRC != file.CRC {
+			return ErrBackupCorrupted
+		}
+	}
+	return nil
+}
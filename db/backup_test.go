@@ -0,0 +1,161 @@
+package db
+
+import (
+	"bamboo/content"
+	"bamboo/db/utils"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIncrementalBackup(t *testing.T) {
+	db, values := prepareCheckpointDB(t, "bamboo-backup-1")
+	defer destroyDB(db)
+	full := make(map[int][]byte)
+	for key, value := range values {
+		full[key] = value
+	}
+
+	root, _ := os.MkdirTemp("", "bamboo-backup-2")
+	defer os.RemoveAll(root)
+	backup0, backup1 := filepath.Join(root, "0"), filepath.Join(root, "1")
+
+	err := db.IncrementalBackup(backup0, "")
+	assert.Nil(t, err)
+	manifest0, err := ReadBackupManifest(backup0)
+	assert.Nil(t, err)
+	assert.Equal(t, "", manifest0.ParentId)
+	for _, file := range manifest0.Files {
+		assert.Equal(t, manifest0.Id, file.Backup)
+	}
+
+	sealed := len(db.inactiveBlock)
+	for i := 1000; i < 1500; i++ {
+		values[i] = utils.RandomValue(128)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+	assert.Greater(t, len(db.inactiveBlock), sealed)
+
+	err = db.IncrementalBackup(backup1, backup0)
+	assert.Nil(t, err)
+	manifest1, err := ReadBackupManifest(backup1)
+	assert.Nil(t, err)
+	assert.Equal(t, manifest0.Id, manifest1.ParentId)
+	assert.Greater(t, len(manifest1.Files), len(manifest0.Files))
+
+	// old sealed blocks are not copied again
+	_, err = os.Stat(content.GetBlockName(backup1, 0))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(content.GetBlockName(backup1, db.activeBlock.FileIndex))
+	assert.Nil(t, err)
+
+	restore := func(chain []string, values map[int][]byte) {
+		target := filepath.Join(root, "restore")
+		defer os.RemoveAll(target)
+		err := Restore(chain, target)
+		assert.Nil(t, err)
+
+		opts := DefaultOptions
+		opts.DataDir = target
+		restored, err := CreateDB(opts)
+		assert.Nil(t, err)
+		checkValues(t, restored, values)
+		assert.Nil(t, restored.Close())
+	}
+	restore([]string{backup0}, full)
+	restore([]string{backup0, backup1}, values)
+
+	// broken chain
+	err = Restore([]string{backup1}, filepath.Join(root, "restore"))
+	assert.Equal(t, ErrBackupChain, err)
+	err = Restore([]string{backup1, backup0}, filepath.Join(root, "restore"))
+	assert.Equal(t, ErrBackupChain, err)
+
+	// a file does not match its checksum
+	fileName := content.GetBlockName(backup0, 0)
+	data, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	data[len(data)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, data, 0644))
+	broken := filepath.Join(root, "restore-2")
+	err = Restore([]string{backup0, backup1}, broken)
+	assert.Equal(t, ErrBackupCorrupted, err)
+	// nothing is left in target
+	entries, _ := os.ReadDir(broken)
+	assert.Equal(t, 0, len(entries))
+	_, err = os.Stat(broken + restoreTempSuffix)
+	assert.True(t, os.IsNotExist(err))
+
+	// a sealed block replaced with the same size, like a merged block, is copied again
+	fileName = content.GetBlockName(db.options.DataDir, 0)
+	data, err = os.ReadFile(fileName)
+	assert.Nil(t, err)
+	data[len(data)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, data, 0644))
+	backup2 := filepath.Join(root, "2")
+	err = db.IncrementalBackup(backup2, backup1)
+	assert.Nil(t, err)
+	copied, err := os.ReadFile(content.GetBlockName(backup2, 0))
+	assert.Nil(t, err)
+	assert.Equal(t, data, copied)
+	// hints are always copied
+	_, err = os.Stat(content.GetBlockHintName(backup2, 0))
+	assert.Nil(t, err)
+}
+
+func TestBackupTo(t *testing.T) {
+	db, values := prepareCheckpointDB(t, "bamboo-backup-3")
+	defer destroyDB(db)
+
+	root, _ := os.MkdirTemp("", "bamboo-backup-4")
+	defer os.RemoveAll(root)
+
+	for _, compress := range []bool{false, true} {
+		buffer := new(bytes.Buffer)
+		err := db.BackupTo(buffer, compress)
+		assert.Nil(t, err)
+		archive := buffer.Bytes()
+
+		target := filepath.Join(root, fmt.Sprintf("restore-%v", compress))
+		err = RestoreFrom(bytes.NewReader(archive), target)
+		assert.Nil(t, err)
+		_, err = os.Stat(filepath.Join(target, FileLockName))
+		assert.True(t, os.IsNotExist(err))
+		_, err = os.Stat(target + restoreTempSuffix)
+		assert.True(t, os.IsNotExist(err))
+
+		opts := DefaultOptions
+		opts.DataDir = target
+		restored, err := CreateDB(opts)
+		assert.Nil(t, err)
+		checkValues(t, restored, values)
+		assert.Nil(t, restored.Close())
+
+		// target is not empty
+		err = RestoreFrom(bytes.NewReader(archive), target)
+		assert.Equal(t, ErrDirNotEmpty, err)
+
+		// truncated
+		broken := filepath.Join(root, fmt.Sprintf("broken-%v", compress))
+		err = RestoreFrom(bytes.NewReader(archive[:len(archive)/2]), broken)
+		assert.NotNil(t, err)
+		entries, _ := os.ReadDir(broken)
+		assert.Equal(t, 0, len(entries))
+		_, err = os.Stat(broken + restoreTempSuffix)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	// a file does not match the manifest
+	buffer := new(bytes.Buffer)
+	err := db.BackupTo(buffer, false)
+	assert.Nil(t, err)
+	archive := buffer.Bytes()
+	archive[1024] ^= 0xff
+	err = RestoreFrom(bytes.NewReader(archive), filepath.Join(root, "broken"))
+	assert.Equal(t, ErrBackupCorrupted, err)
+}
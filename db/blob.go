@@ -0,0 +1,383 @@
+package db
+
+import (
+	"bamboo/content"
+	"io"
+	"log"
+	"sort"
+	"time"
+)
+
+// value not smaller than BlobThreshold is stored in a blob file,
+// and the block only keeps a pointer to it
+func (db *DB) isBlobValue(log *content.LogStruct) bool {
+	return db.options.BlobThreshold > 0 &&
+		log.Type == content.LogNormal &&
+		uint32(len(log.Value)) >= db.options.BlobThreshold
+}
+
+func (db *DB) setActiveBlob() error {
+	var initialFileIndex uint32 = 0
+	if db.activeBlob != nil {
+		initialFileIndex = db.activeBlob.FileIndex + 1
+	}
+
+	newFile, err := content.OpenBlobWithOptions(db.options.DataDir, initialFileIndex, db.blockOptions(db.fileIOType()))
+	if err != nil {
+		return err
+	}
+
+	db.activeBlob = newFile
+	return nil
+}
+
+// sealActiveBlob: the synced active blob file becomes inactive, and a new one is created
+func (db *DB) sealActiveBlob() error {
+	sealed := db.activeBlob
+	if err := db.setActiveBlob(); err != nil {
+		return err
+	}
+	db.inactiveBlob[sealed.FileIndex] = sealed
+	return nil
+}
+
+// writeBlob: write key and value to the active blob file, without sync
+func (db *DB) writeBlob(log *content.LogStruct) (*content.BlobPointer, error) {
+	dataKey, _ := parseLogKey(log.Key)
+	blobLog := db.compressLog(&content.LogStruct{
+		Key:   dataKey,
+		Value: log.Value,
+		Type:  content.LogNormal,
+	})
+
+	if db.activeBlob == nil {
+		if err := db.setActiveBlob(); err != nil {
+			return nil, err
+		}
+	}
+
+	encodeLog, size := db.activeBlob.Encode(blobLog)
+	db.bytesCount += uint(size)
+
+	// if reach the max size, a blob file holds one value at least
+	if db.activeBlob.WritePos > 0 &&
+		db.activeBlob.WritePos+db.activeBlob.WriteSize(size) > int64(db.options.DataSize) {
+		if err := db.activeBlob.Sync(); err != nil {
+			return nil, err
+		}
+		if err := db.sealActiveBlob(); err != nil {
+			return nil, err
+		}
+		encodeLog, _ = db.activeBlob.Encode(blobLog)
+	}
+
+	writePos := db.activeBlob.WritePos
+	if err := db.activeBlob.Write(encodeLog); err != nil {
+		return nil, err
+	}
+
+	return &content.BlobPointer{
+		FileIndex:     db.activeBlob.FileIndex,
+		Offset:        writePos,
+		DiskByteUsage: uint32(db.activeBlob.WritePos - writePos),
+	}, nil
+}
+
+func readBlob(blob *content.BlockFile, pointer *content.BlobPointer) ([]byte, error) {
+	if blob == nil {
+		return nil, ErrBlockFileNotFound
+	}
+
+	log, _, err := blob.ReadLog(pointer.Offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return log.Value, nil
+}
+
+// syncActive: sync the active blob file, then the active block which points to it,
+// so a synced pointer never points to lost bytes
+func (db *DB) syncActive() error {
+	if db.activeBlob != nil {
+		if err := db.activeBlob.Sync(); err != nil {
+			return err
+		}
+	}
+	return db.activeBlock.Sync()
+}
+
+// open blob files, the last one is the active blob file
+func (db *DB) loadBlobs(blobList []int) error {
+	sort.Ints(blobList)
+
+	for i, blobIndex := range blobList {
+		blobFile, err := content.OpenBlobWithOptions(db.options.DataDir, uint32(blobIndex), db.blockOptions(db.fileIOType()))
+		if err != nil {
+			return err
+		}
+
+		if i == len(blobList)-1 {
+			if err := db.recoverActiveBlob(blobFile); err != nil {
+				return err
+			}
+			db.activeBlob = blobFile
+		} else {
+			db.inactiveBlob[uint32(blobIndex)] = blobFile
+		}
+	}
+	return nil
+}
+
+// recoverActiveBlob: a torn tail of the active blob file is truncated as the one of
+// the active block, so its values can be read in order when it is compacted
+func (db *DB) recoverActiveBlob(blob *content.BlockFile) error {
+	fileSize, err := blob.Size()
+	if err != nil {
+		return err
+	}
+
+	offset := int64(0)
+	for {
+		_, size, err := blob.ReadLog(offset)
+		if err == nil {
+			offset += size
+			continue
+		}
+		if err == io.EOF && offset >= fileSize {
+			break
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		if !db.options.RecoverActiveBlock {
+			return err
+		}
+		log.Printf("bamboo: blob %d: %v at offset %d, truncate %d bytes\n",
+			blob.FileIndex, err, offset, fileSize-offset)
+		if err := blob.Truncate(offset); err != nil {
+			return err
+		}
+		break
+	}
+
+	blob.WritePos = offset
+	return nil
+}
+
+func (db *DB) closeBlobs() error {
+	if db.activeBlob != nil {
+		if err := db.activeBlob.Close(); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range db.inactiveBlob {
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recountBlobGarbage: bytes of a blob file which no index points to are garbage
+func (db *DB) recountBlobGarbage() error {
+	liveBytes := make(map[uint32]int64)
+
+	iterator := db.index.Iterator(false)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if pointer := iterator.Value().Blob; pointer != nil {
+			liveBytes[pointer.FileIndex] += int64(pointer.DiskByteUsage)
+		}
+	}
+
+	db.blobGarbage = make(map[uint32]int64)
+	for _, blob := range db.allBlobs() {
+		size, err := blob.Size()
+		if err != nil {
+			return err
+		}
+		if garbage := size - liveBytes[blob.FileIndex]; garbage > 0 {
+			db.blobGarbage[blob.FileIndex] = garbage
+		}
+	}
+	return nil
+}
+
+func (db *DB) allBlobs() []*content.BlockFile {
+	blobs := make([]*content.BlockFile, 0, len(db.inactiveBlob)+1)
+	if db.activeBlob != nil {
+		blobs = append(blobs, db.activeBlob)
+	}
+	for _, blob := range db.inactiveBlob {
+		blobs = append(blobs, blob)
+	}
+	return blobs
+}
+
+// blobSize: total size of blob files
+func (db *DB) blobSize() (int64, error) {
+	var totalSize int64
+	for _, blob := range db.allBlobs() {
+		size, err := blob.Size()
+		if err != nil {
+			return 0, err
+		}
+		totalSize += size
+	}
+	return totalSize, nil
+}
+
+func (db *DB) blobBytesToCollect() int64 {
+	var garbage int64
+	for _, size := range db.blobGarbage {
+		garbage += size
+	}
+	return garbage
+}
+
+// CompactBlobs rewrites live values of sealed blob files whose unused ratio
+// reaches BlobGCRatio, or which are sealed with a retired key, then removes these files
+func (db *DB) CompactBlobs() error {
+	return db.compactBlobs(false)
+}
+
+// compactBlobs: if retiredOnly, only the blob files sealed with a retired key are rewritten
+func (db *DB) compactBlobs(retiredOnly bool) error {
+	db.muLock.Lock()
+	if db.activeBlock == nil {
+		db.muLock.Unlock()
+		return nil
+	}
+
+	// moved values are written to the active blob file, it must have the current key
+	if db.activeBlob != nil {
+		retired, err := db.isRetiredKey(db.activeBlob)
+		if err == nil && retired {
+			if err = db.activeBlob.Sync(); err == nil {
+				err = db.sealActiveBlob()
+			}
+		}
+		if err != nil {
+			db.muLock.Unlock()
+			return err
+		}
+	}
+
+	var blobsToCompact []*content.BlockFile
+	for fileIndex, blob := range db.inactiveBlob {
+		retired, err := db.isRetiredKey(blob)
+		if err != nil {
+			db.muLock.Unlock()
+			return err
+		}
+		if retiredOnly {
+			if retired {
+				blobsToCompact = append(blobsToCompact, blob)
+			}
+			continue
+		}
+
+		size, err := blob.Size()
+		if err != nil {
+			db.muLock.Unlock()
+			return err
+		}
+		if retired || size == 0 || float32(db.blobGarbage[fileIndex])/float32(size) >= db.options.BlobGCRatio {
+			blobsToCompact = append(blobsToCompact, blob)
+		}
+	}
+	db.muLock.Unlock()
+
+	sort.Slice(blobsToCompact, func(i, j int) bool {
+		return blobsToCompact[i].FileIndex < blobsToCompact[j].FileIndex
+	})
+
+	for _, blob := range blobsToCompact {
+		offset := int64(0)
+		for {
+			log, size, err := blob.ReadLog(offset)
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return err
+			}
+
+			if err := db.moveBlobValue(log, blob.FileIndex, offset); err != nil {
+				return err
+			}
+			offset += size
+		}
+
+		if err := db.removeBlob(blob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isRetiredKey: the file is encrypted with a key which is not the current key
+func (db *DB) isRetiredKey(file *content.BlockFile) (bool, error) {
+	if db.options.KeyProvider == nil || !file.IsEncrypted() {
+		return false, nil
+	}
+
+	keyId, _, err := db.options.KeyProvider.CurrentKey()
+	if err != nil {
+		return false, err
+	}
+	return file.KeyId() != keyId, nil
+}
+
+// moveBlobValue: rewrite the value, if the index still points to it.
+// an expired key is dropped from the index instead, its value goes away with the file
+func (db *DB) moveBlobValue(log *content.LogStruct, fileIndex uint32, offset int64) error {
+	db.muLock.Lock()
+	defer db.muLock.Unlock()
+
+	pos := db.index.Get(log.Key)
+	if pos == nil || pos.Blob == nil ||
+		pos.Blob.FileIndex != fileIndex || pos.Blob.Offset != offset {
+		return nil
+	}
+	if pos.IsExpired(time.Now().UnixNano()) {
+		db.index.Delete(log.Key)
+		db.addGarbage(pos)
+		return nil
+	}
+
+	newPos, err := db.writeLog(&content.LogStruct{
+		Key:    encodeLogKeyWithSeqNo(log.Key, initialTransactionSeq),
+		Value:  log.Value,
+		Type:   content.LogNormal,
+		Expire: pos.Expire,
+	})
+	if err != nil {
+		return err
+	}
+
+	// the value is moved, not written, so txns which read the key do not conflict
+	if oldPos := db.index.Put(log.Key, newPos); oldPos != nil {
+		db.addGarbage(oldPos)
+	}
+	return nil
+}
+
+// removeBlob: values moved out of blob are synced first, then the file is removed
+func (db *DB) removeBlob(blob *content.BlockFile) error {
+	db.muLock.Lock()
+	defer db.muLock.Unlock()
+
+	if err := db.syncActive(); err != nil {
+		return err
+	}
+	db.bytesCount = 0
+
+	delete(db.inactiveBlob, blob.FileIndex)
+	delete(db.blobGarbage, blob.FileIndex)
+
+	return db.removeFile(blob, content.GetBlobName(db.options.DataDir, blob.FileIndex))
+}
@@ -0,0 +1,225 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bamboo/content"
+	"bamboo/db/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func blobFiles(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+content.BlobSuffix))
+	return files
+}
+
+func TestBlobValue(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-blob-1")
+	opts.DataDir = dir
+	opts.MergeThreshold = 0
+	opts.BlobThreshold = 1024
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 200; i++ {
+		values[i] = utils.RandomValue(4096)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+	// small value stays in block
+	err = db.Put(utils.GetTestKey(200), []byte("small"))
+	assert.Nil(t, err)
+
+	assert.Equal(t, 1, len(blobFiles(dir)))
+	// blocks only hold pointers
+	blockSize, err := db.activeBlock.Size()
+	assert.Nil(t, err)
+	assert.Less(t, blockSize, int64(200*1024))
+
+	for i := 0; i < 200; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], val)
+	}
+
+	// restart, then merge: blob files are untouched
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(blobFiles(dir)))
+	assert.Equal(t, 101, len(db.ListKeys()))
+	for i := 100; i < 200; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], val)
+	}
+	val, err := db.Get(utils.GetTestKey(200))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("small"), val)
+	// deleted values are recounted at startup
+	assert.Greater(t, db.GetDBStatus().BlobBytesToCollect, int64(100*4096))
+}
+
+func TestCompactBlobs(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-blob-2")
+	opts.DataDir = dir
+	opts.DataSize = 1024 * 1024
+	opts.BlobThreshold = 1024
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 1000; i++ {
+		values[i] = utils.RandomValue(4096)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+	// overwrite most of the values
+	for i := 0; i < 1000; i++ {
+		if i%10 == 0 {
+			continue
+		}
+		values[i] = utils.RandomValue(4096)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+
+	before := db.GetDBStatus()
+	assert.Greater(t, before.BlobCount, uint(1))
+	assert.Greater(t, before.BlobBytesToCollect, int64(0))
+
+	err = db.CompactBlobs()
+	assert.Nil(t, err)
+
+	after := db.GetDBStatus()
+	assert.Less(t, after.BlobBytesToCollect, before.BlobBytesToCollect)
+	assert.Less(t, after.DiskUsage, before.DiskUsage)
+
+	check := func(db *DB) {
+		for i := 0; i < 1000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, values[i], val)
+		}
+	}
+	check(db)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	check(db)
+}
+
+func TestCompactBlobsExpired(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-blob-3")
+	opts.DataDir = dir
+	opts.DataSize = 64 * 1024
+	opts.BlobThreshold = 1024
+	opts.BlobGCRatio = 0
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		err := db.PutWithTTL(utils.GetTestKey(i), utils.RandomValue(4096), 100*time.Millisecond)
+		assert.Nil(t, err)
+	}
+	value := utils.RandomValue(4096)
+	assert.Nil(t, db.Put(utils.GetTestKey(100), value))
+	assert.Greater(t, len(db.inactiveBlob), 1)
+	time.Sleep(150 * time.Millisecond)
+
+	// expired values are not moved, only the active blob file is left
+	activeSize, err := db.activeBlob.Size()
+	assert.Nil(t, err)
+	assert.Nil(t, db.CompactBlobs())
+	assert.Equal(t, 0, len(db.inactiveBlob))
+	blobSize, err := db.blobSize()
+	assert.Nil(t, err)
+	assert.Equal(t, activeSize, blobSize)
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db.Get(utils.GetTestKey(100))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+
+	assert.Nil(t, db.Close())
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(db.ListKeys()))
+}
+
+func TestRecoverActiveBlob(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-blob-4")
+	opts.DataDir = dir
+	opts.BlobThreshold = 1024
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 10; i++ {
+		values[i] = utils.RandomValue(4096)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	assert.Nil(t, db.Close())
+
+	// a torn write at the tail of the active blob file
+	name := content.GetBlobName(dir, 0)
+	info, err := os.Stat(name)
+	assert.Nil(t, err)
+	file, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte{0x12, 0x34, 0x56, 0x78, 0x00, 0x80})
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	opts.RecoverActiveBlock = false
+	_, err = CreateDB(opts)
+	assert.NotNil(t, err)
+
+	opts.RecoverActiveBlock = true
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	truncated, err := os.Stat(name)
+	assert.Nil(t, err)
+	assert.Equal(t, info.Size(), truncated.Size())
+
+	// new values follow the last valid one, and the file can be compacted in order
+	values[10] = utils.RandomValue(4096)
+	assert.Nil(t, db.Put(utils.GetTestKey(10), values[10]))
+	assert.Nil(t, db.sealActiveBlob())
+	db.options.BlobGCRatio = 0
+	assert.Nil(t, db.CompactBlobs())
+	for i, value := range values {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"bamboo/content"
+	"bamboo/diskIO"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// linkFile is fs.Link, replaced by tests to act as another file system
+var linkFile = func(fs diskIO.FileSystem, oldName, newName string) error {
+	return fs.Link(oldName, newName)
+}
+
+// Checkpoint makes a copy of the db in dir, which can be opened by CreateDB.
+// dir is in the file system of the db, in memory if the db is.
+// the active block is sealed, then sealed blocks, hints and blob files are hard linked into dir,
+// they are never written again, so the copy and the db share them safely.
+// a file is copied only if dir is on another file system.
+// writers are blocked while files are linked, but not while they are copied
+func (db *DB) Checkpoint(dir string) error {
+	if err := prepareEmptyDir(db.fs, dir); err != nil {
+		return err
+	}
+
+	toCopy, err := db.linkCheckpoint(dir)
+	// files to copy are opened, they are read even if removed from the db meanwhile
+	defer func() {
+		for _, file := range toCopy {
+			_ = file.src.Close()
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range toCopy {
+		if err := copyCheckpointFile(file.src, db.fs, file.dst); err != nil {
+			return err
+		}
+	}
+	return db.fs.SyncDir(dir)
+}
+
+// the dir is created, or it must be empty
+func prepareEmptyDir(fs diskIO.FileSystem, dir string) error {
+	entries, err := fs.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return fs.MkdirAll(dir)
+	}
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return ErrDirNotEmpty
+	}
+	return nil
+}
+
+type checkpointCopy struct {
+	src diskIO.File
+	dst string
+}
+
+func (db *DB) linkCheckpoint(dir string) ([]*checkpointCopy, error) {
+	db.muLock.Lock()
+	defer db.muLock.Unlock()
+
+	if db.activeBlock == nil {
+		return nil, nil
+	}
+
+	// active files are sealed, so all files linked are immutable
+	if err := db.syncActive(); err != nil {
+		return nil, err
+	}
+	if db.activeBlock.WritePos > 0 {
+		if err := db.sealActiveBlock(); err != nil {
+			return nil, err
+		}
+	}
+	if db.activeBlob != nil && db.activeBlob.WritePos > 0 {
+		if err := db.sealActiveBlob(); err != nil {
+			return nil, err
+		}
+	}
+
+	var names []string
+	for fileIndex := range db.inactiveBlock {
+		names = append(names, filepath.Base(content.GetBlockName(db.options.DataDir, fileIndex)))
+		names = append(names, filepath.Base(content.GetBlockHintName(db.options.DataDir, fileIndex)))
+	}
+	for fileIndex := range db.inactiveBlob {
+		names = append(names, filepath.Base(content.GetBlobName(db.options.DataDir, fileIndex)))
+	}
+	// a merge installed
+	names = append(names, content.HintFileTag, content.MergeFinishedTag)
+
+	var toCopy []*checkpointCopy
+	for _, name := range names {
+		src, dst := filepath.Join(db.options.DataDir, name), filepath.Join(dir, name)
+		err := linkFile(db.fs, src, dst)
+		if err == nil || os.IsNotExist(err) {
+			// a block without hint, or no merge
+			continue
+		}
+		if !errors.Is(err, syscall.EXDEV) {
+			return toCopy, err
+		}
+
+		file, err := db.fs.Open(src)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return toCopy, err
+		}
+		toCopy = append(toCopy, &checkpointCopy{src: file, dst: dst})
+	}
+
+	// the copy writes to its own active files, not to the linked ones
+	activeBlock := content.GetBlockName(dir, db.activeBlock.FileIndex)
+	if err := createEmptyFile(db.fs, activeBlock); err != nil {
+		return toCopy, err
+	}
+	if db.activeBlob != nil {
+		activeBlob := content.GetBlobName(dir, db.activeBlob.FileIndex)
+		if err := createEmptyFile(db.fs, activeBlob); err != nil {
+			return toCopy, err
+		}
+	}
+	return toCopy, nil
+}
+
+func createEmptyFile(fs diskIO.FileSystem, name string) error {
+	file, err := fs.Create(name)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+func copyCheckpointFile(src diskIO.File, fs diskIO.FileSystem, dst string) error {
+	file, err := fs.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, src)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
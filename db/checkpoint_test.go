@@ -0,0 +1,124 @@
+package db
+
+import (
+	"bamboo/content"
+	"bamboo/db/utils"
+	"bamboo/diskIO"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func prepareCheckpointDB(t *testing.T, name string) (*DB, map[int][]byte) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", name)
+	opts.DataDir = dir
+	opts.DataSize = 64 * 1024
+	opts.BlobThreshold = 1024
+	db, err := CreateDB(opts)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 1000; i++ {
+		values[i] = utils.RandomValue(128)
+		// some values are in blob files
+		if i%10 == 0 {
+			values[i] = utils.RandomValue(2048)
+		}
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 100; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		delete(values, i)
+	}
+	return db, values
+}
+
+func TestCheckpoint(t *testing.T) {
+	db, values := prepareCheckpointDB(t, "bamboo-checkpoint-4")
+	defer destroyDB(db)
+
+	dir, _ := os.MkdirTemp("", "bamboo-checkpoint-5")
+	err := db.Checkpoint(dir)
+	assert.Nil(t, err)
+
+	// sealed files are shared
+	src, err := os.Stat(content.GetBlockName(db.options.DataDir, 0))
+	assert.Nil(t, err)
+	dst, err := os.Stat(content.GetBlockName(dir, 0))
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(src, dst))
+
+	// writes after checkpoint are not in it
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(2048))
+		assert.Nil(t, err)
+	}
+	err = db.Compact(CompactOptions{})
+	assert.Nil(t, err)
+
+	opts := DefaultOptions
+	opts.DataDir = dir
+	opts.DataSize = 64 * 1024
+	opts.BlobThreshold = 1024
+	copied, err := CreateDB(opts)
+	defer destroyDB(copied)
+	assert.Nil(t, err)
+	checkValues(t, copied, values)
+
+	// writes to the copy do not change the db
+	for i := 0; i < 100; i++ {
+		err := copied.Put(utils.GetTestKey(i), utils.RandomValue(2048))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, copied.Close())
+	copied, err = CreateDB(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(copied.ListKeys()))
+
+	assert.Equal(t, 1000, len(db.ListKeys()))
+	for i := 0; i < 1000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	// dir is not empty
+	err = db.Checkpoint(dir)
+	assert.Equal(t, ErrDirNotEmpty, err)
+}
+
+// on another file system, files are copied
+func TestCheckpointCopy(t *testing.T) {
+	db, values := prepareCheckpointDB(t, "bamboo-checkpoint-6")
+	defer destroyDB(db)
+
+	link := linkFile
+	linkFile = func(fs diskIO.FileSystem, oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EXDEV}
+	}
+	defer func() {
+		linkFile = link
+	}()
+
+	dir, _ := os.MkdirTemp("", "bamboo-checkpoint-7")
+	err := db.Checkpoint(dir)
+	assert.Nil(t, err)
+
+	src, err := os.Stat(content.GetBlockName(db.options.DataDir, 0))
+	assert.Nil(t, err)
+	dst, err := os.Stat(content.GetBlockName(dir, 0))
+	assert.Nil(t, err)
+	assert.False(t, os.SameFile(src, dst))
+	assert.Equal(t, src.Size(), dst.Size())
+
+	opts := DefaultOptions
+	opts.DataDir = dir
+	copied, err := CreateDB(opts)
+	defer destroyDB(copied)
+	assert.Nil(t, err)
+	checkValues(t, copied, values)
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"bamboo/content"
+	"bamboo/diskIO"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bamboo/db/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChecksum(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-checksum")
+	opts.DataDir = dir
+	opts.DataSize = 64 * 1024
+	opts.MergeThreshold = 0
+	opts.BlobThreshold = 512
+	opts.Checksum = ChecksumCastagnoli
+	db, err := CreateDB(opts)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			values[i] = utils.RandomValue(64 + i%3*300)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+		}
+	}
+	check := func() {
+		for i, value := range values {
+			read, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, value, read)
+		}
+	}
+
+	put(0, 2000)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		delete(values, i)
+	}
+	assert.Nil(t, db.Merge())
+	check()
+	assert.Nil(t, db.Close())
+
+	block, err := content.OpenBlock(dir, 0, diskIO.FileSystemIO)
+	assert.Nil(t, err)
+	assert.Equal(t, ChecksumCastagnoli, block.Checksum())
+	assert.Nil(t, block.Close())
+
+	// files of both checksums in one db
+	opts.Checksum = ChecksumIEEE
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	check()
+	put(2000, 3000)
+	check()
+	assert.Nil(t, db.Close())
+
+	// without the index checkpoint and block hints, logs of new blocks are checked on open
+	assert.Nil(t, os.Remove(filepath.Join(dir, indexCheckpointName)))
+	hints, _ := filepath.Glob(filepath.Join(dir, "*"+content.HintSuffix))
+	assert.Greater(t, len(hints), 0)
+	for _, hint := range hints {
+		assert.Nil(t, os.Remove(hint))
+	}
+	opts.Checksum = ChecksumCastagnoli
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	check()
+	assert.Nil(t, db.Merge())
+	check()
+	destroyDB(db)
+
+	opts.Checksum = 7
+	_, err = CreateDB(opts)
+	assert.NotNil(t, err)
+}
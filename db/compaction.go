@@ -0,0 +1,277 @@
+package db
+
+import (
+	"bamboo/content"
+	"io"
+	"sort"
+)
+
+// BlockStat is the size and the garbage of a block
+type BlockStat struct {
+	FileIndex uint32
+	Size      int64
+	// Garbage: bytes of logs which are not used anymore
+	Garbage int64
+}
+
+func (stat BlockStat) GarbageRatio() float32 {
+	if stat.Size == 0 {
+		return 0
+	}
+	return float32(stat.Garbage) / float32(stat.Size)
+}
+
+// BlockStats returns the stat of every block, sorted by file index
+func (db *DB) BlockStats() ([]BlockStat, error) {
+	db.muLock.RLock()
+	defer db.muLock.RUnlock()
+
+	stats, err := db.inactiveBlockStats()
+	if err != nil {
+		return nil, err
+	}
+
+	if db.activeBlock != nil {
+		size, err := db.activeBlock.Size()
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, BlockStat{
+			FileIndex: db.activeBlock.FileIndex,
+			Size:      size,
+			Garbage:   db.blockGarbage[db.activeBlock.FileIndex],
+		})
+	}
+	return stats, nil
+}
+
+func (db *DB) inactiveBlockStats() ([]BlockStat, error) {
+	stats := make([]BlockStat, 0, len(db.inactiveBlock)+1)
+	for fileIndex, block := range db.inactiveBlock {
+		size, err := block.Size()
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, BlockStat{
+			FileIndex: fileIndex,
+			Size:      size,
+			Garbage:   db.blockGarbage[fileIndex],
+		})
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].FileIndex < stats[j].FileIndex
+	})
+	return stats, nil
+}
+
+// Compact rewrites the live logs of sealed blocks with the highest garbage ratio
+// into the active block, updates the index in place, then removes these blocks.
+// unlike Merge, it needs no merge directory
+func (db *DB) Compact(options CompactOptions) error {
+	db.muLock.Lock()
+
+	if db.activeBlock == nil {
+		db.muLock.Unlock()
+		return nil
+	}
+
+	// merge and compaction read the same blocks
+	if db.inMergeProcess {
+		db.muLock.Unlock()
+		return ErrMergeInProgress
+	}
+
+	stats, err := db.inactiveBlockStats()
+	if err != nil {
+		db.muLock.Unlock()
+		return err
+	}
+
+	// highest garbage ratio first
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].GarbageRatio() > stats[j].GarbageRatio()
+	})
+
+	var blocksToCompact []*content.BlockFile
+	for _, stat := range stats {
+		if stat.GarbageRatio() < options.MinGarbageRatio {
+			break
+		}
+		if options.MaxBlocks > 0 && len(blocksToCompact) >= options.MaxBlocks {
+			break
+		}
+		blocksToCompact = append(blocksToCompact, db.inactiveBlock[stat.FileIndex])
+	}
+
+	// old blocks first, so a tombstone may be dropped when its block is the oldest
+	sort.Slice(blocksToCompact, func(i, j int) bool {
+		return blocksToCompact[i].FileIndex < blocksToCompact[j].FileIndex
+	})
+	blocksToCompact, err = db.withoutSplitBatches(blocksToCompact)
+	if err != nil {
+		db.muLock.Unlock()
+		return err
+	}
+
+	if len(blocksToCompact) == 0 {
+		db.muLock.Unlock()
+		return nil
+	}
+
+	db.inMergeProcess = true
+	db.muLock.Unlock()
+
+	defer func() {
+		db.muLock.Lock()
+		db.inMergeProcess = false
+		db.muLock.Unlock()
+	}()
+
+	for _, block := range blocksToCompact {
+		if err := db.compactBlock(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) compactBlock(block *content.BlockFile) error {
+	keepTombstones := db.needTombstones(block.FileIndex)
+
+	offset := int64(0)
+	for {
+		log, size, err := block.ReadLog(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		if err := db.relocateLog(log, block.FileIndex, offset, keepTombstones); err != nil {
+			return err
+		}
+		offset += size
+	}
+
+	db.muLock.Lock()
+	defer db.muLock.Unlock()
+
+	// relocated logs are synced before the old block is removed
+	if err := db.syncActive(); err != nil {
+		return err
+	}
+	db.bytesCount = 0
+
+	delete(db.inactiveBlock, block.FileIndex)
+	db.spaceToCollect -= db.blockGarbage[block.FileIndex]
+	delete(db.blockGarbage, block.FileIndex)
+
+	if err := db.removeBlockHint(block.FileIndex); err != nil {
+		return err
+	}
+	return db.removeFile(block, content.GetBlockName(db.options.DataDir, block.FileIndex))
+}
+
+// withoutSplitBatches drops a block which starts within an atomic batch, if the block before it stays.
+// the finish record of the batch may be in the block, and the records of the batch in the block
+// before are replayed only with it. compacting the block before first rewrites them without seq.
+// blocks are sorted by file index, the caller holds db.muLock
+func (db *DB) withoutSplitBatches(blocks []*content.BlockFile) ([]*content.BlockFile, error) {
+	kept := make(map[uint32]bool)
+	result := make([]*content.BlockFile, 0, len(blocks))
+	for _, block := range blocks {
+		split, err := startsInBatch(block)
+		if err != nil {
+			return nil, err
+		}
+		if split && block.FileIndex > 0 {
+			prev := block.FileIndex - 1
+			if _, ok := db.inactiveBlock[prev]; ok && !kept[prev] {
+				continue
+			}
+		}
+		kept[block.FileIndex] = true
+		result = append(result, block)
+	}
+	return result, nil
+}
+
+// startsInBatch: the first log of block is written by an atomic batch,
+// which may have begun in the block before
+func startsInBatch(block *content.BlockFile) (bool, error) {
+	log, _, err := block.ReadLog(0)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, seqNo := parseLogKey(log.Key)
+	return seqNo != initialTransactionSeq, nil
+}
+
+// needTombstones: a tombstone hides older logs of the key, it can be dropped only
+// if its block is the oldest, and no finished merge is waiting to be installed
+func (db *DB) needTombstones(fileIndex uint32) bool {
+	db.muLock.RLock()
+	defer db.muLock.RUnlock()
+
+	for otherIndex := range db.inactiveBlock {
+		if otherIndex < fileIndex {
+			return true
+		}
+	}
+
+	return db.hasMergeToInstall()
+}
+
+// relocateLog: write a log which is still used to the active block
+func (db *DB) relocateLog(log *content.LogStruct, fileIndex uint32, offset int64, keepTombstones bool) error {
+	db.muLock.Lock()
+	defer db.muLock.Unlock()
+
+	dataKey, _ := parseLogKey(log.Key)
+
+	switch log.Type {
+	case content.LogNormal:
+		pos := db.index.Get(dataKey)
+		if pos == nil || pos.FileIndex != fileIndex || pos.Offset != offset {
+			return nil
+		}
+
+		// a blob pointer is copied, the value in blob file is not moved
+		newPos, err := db.writeLog(&content.LogStruct{
+			Key:    encodeLogKeyWithSeqNo(dataKey, initialTransactionSeq),
+			Value:  log.Value,
+			Type:   content.LogNormal,
+			Expire: log.Expire,
+			Blob:   log.Blob,
+		})
+		if err != nil {
+			return err
+		}
+
+		// the old log goes away with its block, it is not garbage of other files
+		db.index.Put(dataKey, newPos)
+	case content.LogDeleted:
+		// the key has been put again, or nothing older to hide
+		if !keepTombstones || db.index.Get(dataKey) != nil {
+			return nil
+		}
+
+		newPos, err := db.writeLog(&content.LogStruct{
+			Key:  encodeLogKeyWithSeqNo(dataKey, initialTransactionSeq),
+			Type: content.LogDeleted,
+		})
+		if err != nil {
+			return err
+		}
+		db.addGarbage(newPos)
+	}
+
+	// transaction finished records are dropped, the transaction is in the index already,
+	// and no record of it is left in older blocks, see withoutSplitBatches
+	return nil
+}
@@ -0,0 +1,308 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bamboo/content"
+	"bamboo/db/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func blockFiles(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+content.Suffix))
+	return files
+}
+
+func TestCompact(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-compact-1")
+	opts.DataDir = dir
+	opts.DataSize = 1024 * 1024
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 4000; i++ {
+		values[i] = utils.RandomValue(1024)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+	// most of the first blocks are garbage
+	for i := 0; i < 2000; i++ {
+		if i%4 == 0 {
+			err := db.Delete(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			delete(values, i)
+		} else if i%4 != 1 {
+			values[i] = utils.RandomValue(1024)
+			err := db.Put(utils.GetTestKey(i), values[i])
+			assert.Nil(t, err)
+		}
+	}
+
+	stats, err := db.BlockStats()
+	assert.Nil(t, err)
+	assert.Greater(t, stats[0].GarbageRatio(), float32(0.5))
+	assert.Less(t, stats[len(stats)-2].GarbageRatio(), float32(0.5))
+
+	before := db.GetDBStatus()
+	blocks := len(blockFiles(dir))
+	err = db.Compact(CompactOptions{MaxBlocks: 2, MinGarbageRatio: 0.5})
+	assert.Nil(t, err)
+
+	// the two oldest blocks are gone, no merge dir is used
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(content.GetBlockName(dir, 0))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(content.GetBlockName(dir, 1))
+	assert.True(t, os.IsNotExist(err))
+	assert.Less(t, db.GetDBStatus().BytesToCollect, before.BytesToCollect)
+
+	check := func(db *DB) {
+		assert.Equal(t, len(values), len(db.ListKeys()))
+		for i := 0; i < 4000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			if expected, ok := values[i]; ok {
+				assert.Nil(t, err)
+				assert.Equal(t, expected, val)
+			} else {
+				assert.Equal(t, ErrKeyNotFound, err)
+			}
+		}
+	}
+	check(db)
+
+	// compact the rest
+	err = db.Compact(CompactOptions{MinGarbageRatio: 0.5})
+	assert.Nil(t, err)
+	assert.Less(t, len(blockFiles(dir)), blocks)
+	check(db)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	check(db)
+}
+
+// tombstone of a newer block still hides the log in an older block
+func TestCompactKeepTombstone(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-compact-2")
+	opts.DataDir = dir
+	opts.DataSize = 64 * 1024
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	key := []byte("deleted-key")
+	err = db.Put(key, []byte("value"))
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+
+	// a block of garbage and the tombstone
+	err = db.Delete(key)
+	assert.Nil(t, err)
+	for j := 0; j < 2; j++ {
+		for i := 100; i < 150; i++ {
+			err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+			assert.Nil(t, err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i+1000), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+
+	// block 0 holds the old log, block 1 the tombstone, block 1 and 2 are mostly garbage
+	stats, err := db.BlockStats()
+	assert.Nil(t, err)
+	assert.Less(t, stats[0].GarbageRatio(), float32(0.3))
+	assert.Greater(t, stats[1].GarbageRatio(), float32(0.3))
+	assert.Greater(t, stats[2].GarbageRatio(), float32(0.3))
+
+	err = db.Compact(CompactOptions{MaxBlocks: 2, MinGarbageRatio: 0.3})
+	assert.Nil(t, err)
+	_, err = os.Stat(content.GetBlockName(dir, 1))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(content.GetBlockName(dir, 2))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(content.GetBlockName(dir, 0))
+	assert.Nil(t, err)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	_, err = db.Get(key)
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+// hint entries of compacted blocks are skipped on restart
+func TestCompactMergedBlocks(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-compact-3")
+	opts.DataDir = dir
+	opts.DataSize = 256 * 1024
+	opts.MergeThreshold = 0
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// merged blocks hold live logs
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	err = db.Compact(CompactOptions{MinGarbageRatio: 0})
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(db.ListKeys()))
+	for i := 0; i < 1000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	for i := 0; i < 1000; i++ {
+		if i%2 == 0 {
+			err = db.Delete(utils.GetTestKey(i))
+		} else {
+			err = db.Put(utils.GetTestKey(i), []byte("new"))
+		}
+		assert.Nil(t, err)
+	}
+	err = db.Compact(CompactOptions{MinGarbageRatio: 0.5})
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 500, len(db.ListKeys()))
+	for i := 1; i < 1000; i += 2 {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("new"), val)
+	}
+}
+
+// a batch spans two blocks, its finish record in the newer block is kept
+// while the older block holds records of the batch
+func TestCompactSpanningBatch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-compact-4")
+	opts.DataDir = dir
+	opts.DataSize = 8 * 1024
+	opts.IndexCheckpoint = false
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 10; i++ {
+		values[i] = utils.RandomValue(200)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	batch := db.NewAtomicWrite(DefaultWriteOptions)
+	for i := 10; i < 60; i++ {
+		values[i] = utils.RandomValue(200)
+		assert.Nil(t, batch.Put(utils.GetTestKey(i), values[i]))
+	}
+	assert.Nil(t, batch.Commit())
+
+	// the batch is in block 0 and block 1, then block 1 becomes garbage
+	var inBlock0 int
+	for i := 10; i < 60; i++ {
+		switch db.index.Get(utils.GetTestKey(i)).FileIndex {
+		case 0:
+			inBlock0++
+		case 1:
+			values[i] = utils.RandomValue(200)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+		}
+	}
+	assert.Greater(t, inBlock0, 0)
+	for i := 100; i < 150; i++ {
+		values[i] = utils.RandomValue(200)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+
+	reopen := func() {
+		assert.Nil(t, db.Close())
+		db, err = CreateDB(opts)
+		assert.Nil(t, err)
+		checkValues(t, db, values)
+	}
+
+	err = db.Compact(CompactOptions{MinGarbageRatio: 0.3})
+	assert.Nil(t, err)
+	checkValues(t, db, values)
+	reopen()
+
+	// block 0 becomes garbage too, both are compacted, old blocks first
+	for i := 0; i < 40; i++ {
+		values[i] = utils.RandomValue(200)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	err = db.Compact(CompactOptions{MinGarbageRatio: 0.3})
+	assert.Nil(t, err)
+	_, err = os.Stat(content.GetBlockName(dir, 0))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(content.GetBlockName(dir, 1))
+	assert.True(t, os.IsNotExist(err))
+	checkValues(t, db, values)
+	reopen()
+}
+
+// compaction and merge exclude each other, and may run at the same time
+func TestCompactWhileMerge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-compact-5")
+	opts.DataDir = dir
+	opts.DataSize = 16 * 1024
+	opts.MergeThreshold = 0
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	values := make(map[int][]byte)
+	for j := 0; j < 2; j++ {
+		for i := 0; i < 200; i++ {
+			values[i] = utils.RandomValue(128)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+		}
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- db.Merge()
+	}()
+	go func() {
+		errs <- db.Compact(CompactOptions{MinGarbageRatio: 0.3})
+	}()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != ErrMergeInProgress {
+			assert.Nil(t, err)
+		}
+	}
+	checkValues(t, db, values)
+}
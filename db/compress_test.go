@@ -0,0 +1,75 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"bamboo/db/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func jsonValue(i int) []byte {
+	return bytes.Repeat([]byte(fmt.Sprintf(`{"id":%d,"name":"bamboo","tags":["kv","log"]},`, i)), 32)
+}
+
+func TestCompression(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-compress")
+	opts.DataDir = dir
+	opts.MergeThreshold = 0
+	opts.Compression = FlateCompression
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), jsonValue(i))
+		assert.Nil(t, err)
+	}
+	// random value does not shrink much, but is still readable
+	randomValue := utils.RandomValue(16)
+	err = db.Put(utils.GetTestKey(1000), randomValue)
+	assert.Nil(t, err)
+
+	stat := db.GetDBStatus()
+	assert.Greater(t, stat.UncompressedBytes, int64(0))
+	assert.Less(t, stat.CompressedBytes, stat.UncompressedBytes/4)
+	assert.Less(t, stat.DiskUsage, stat.UncompressedBytes/4)
+
+	for i := 0; i < 1000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, jsonValue(i), val)
+	}
+
+	// old raw logs and new compressed logs live together
+	err = db.Close()
+	assert.Nil(t, err)
+	opts.Compression = NoCompression
+	db2, err := CreateDB(opts)
+	assert.Nil(t, err)
+	err = db2.Put(utils.GetTestKey(0), jsonValue(2000))
+	assert.Nil(t, err)
+	err = db2.Merge()
+	assert.Nil(t, err)
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	db3, err := CreateDB(opts)
+	assert.Nil(t, err)
+	val, err := db3.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, jsonValue(2000), val)
+	val, err = db3.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	assert.Equal(t, jsonValue(999), val)
+	val, err = db3.Get(utils.GetTestKey(1000))
+	assert.Nil(t, err)
+	assert.Equal(t, randomValue, val)
+	err = db3.Close()
+	assert.Nil(t, err)
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"bamboo/content"
+	"bytes"
+	"time"
+)
+
+// conditional writes read and write the key in one critical section of db.muLock,
+// so they are linearizable with Put and Delete, which update index under the same lock
+
+// CompareAndSwap: put newValue, if the current value equals oldValue.
+// a nil oldValue matches a key which does not exist.
+// return if the condition matched, and the value has been swapped
+func (db *DB) CompareAndSwap(key, oldValue, newValue []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrEmptyKey
+	}
+
+	db.muLock.Lock()
+	defer db.muLock.Unlock()
+
+	current, exist, err := db.currentValue(key)
+	if err != nil {
+		return false, err
+	}
+
+	if oldValue == nil {
+		if exist {
+			return false, nil
+		}
+	} else if !exist || !bytes.Equal(current, oldValue) {
+		return false, nil
+	}
+
+	return true, db.conditionalWrite(key, newValue, content.LogNormal)
+}
+
+// PutIfAbsent: put the value, if the key does not exist.
+// return if the value has been put
+func (db *DB) PutIfAbsent(key, value []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrEmptyKey
+	}
+
+	db.muLock.Lock()
+	defer db.muLock.Unlock()
+
+	_, exist, err := db.currentValue(key)
+	if err != nil || exist {
+		return false, err
+	}
+
+	return true, db.conditionalWrite(key, value, content.LogNormal)
+}
+
+// GetAndSet: put the value, and return the old one.
+// the bool is false, if the key did not exist
+func (db *DB) GetAndSet(key, value []byte) ([]byte, bool, error) {
+	if len(key) == 0 {
+		return nil, false, ErrEmptyKey
+	}
+
+	db.muLock.Lock()
+	defer db.muLock.Unlock()
+
+	current, exist, err := db.currentValue(key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := db.conditionalWrite(key, value, content.LogNormal); err != nil {
+		return nil, false, err
+	}
+	return current, exist, nil
+}
+
+// DeleteIfEquals: delete the key, if the current value equals value.
+// return if the key has been deleted
+func (db *DB) DeleteIfEquals(key, value []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, ErrEmptyKey
+	}
+
+	db.muLock.Lock()
+	defer db.muLock.Unlock()
+
+	current, exist, err := db.currentValue(key)
+	if err != nil || !exist || !bytes.Equal(current, value) {
+		return false, err
+	}
+
+	return true, db.conditionalWrite(key, nil, content.LogDeleted)
+}
+
+// currentValue: value of the key, expired key does not exist. the caller holds db.muLock
+func (db *DB) currentValue(key []byte) ([]byte, bool, error) {
+	pos := db.index.Get(key)
+	if pos == nil || pos.IsExpired(time.Now().UnixNano()) {
+		return nil, false, nil
+	}
+
+	value, err := db.GetValueFormLog(pos)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// conditionalWrite: append the log and update index. the caller holds db.muLock
+func (db *DB) conditionalWrite(key, value []byte, logType content.LogType) error {
+	pos, err := db.appendLog(&content.LogStruct{
+		Key:   encodeLogKeyWithSeqNo(key, initialTransactionSeq),
+		Value: value,
+		Type:  logType,
+	})
+	if err != nil {
+		return err
+	}
+
+	db.updateIndex(key, logType, pos)
+	return nil
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"bamboo/db/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConditionalWrite(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-conditional-1")
+	opts.DataDir = dir
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	key := utils.GetTestKey(1)
+
+	// PutIfAbsent
+	ok, err := db.PutIfAbsent(key, []byte("a"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = db.PutIfAbsent(key, []byte("b"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// CompareAndSwap
+	ok, err = db.CompareAndSwap(key, []byte("b"), []byte("c"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.CompareAndSwap(key, nil, []byte("c"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.CompareAndSwap(key, []byte("a"), []byte("c"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = db.CompareAndSwap(utils.GetTestKey(2), nil, []byte("x"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// GetAndSet
+	old, exist, err := db.GetAndSet(key, []byte("d"))
+	assert.Nil(t, err)
+	assert.True(t, exist)
+	assert.Equal(t, []byte("c"), old)
+	old, exist, err = db.GetAndSet(utils.GetTestKey(3), []byte("d"))
+	assert.Nil(t, err)
+	assert.False(t, exist)
+	assert.Nil(t, old)
+
+	// DeleteIfEquals
+	ok, err = db.DeleteIfEquals(key, []byte("c"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	ok, err = db.DeleteIfEquals(key, []byte("d"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = db.DeleteIfEquals(key, []byte("d"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	_, err = db.Get(key)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// expired key does not exist
+	err = db.PutWithTTL(key, []byte("e"), time.Millisecond)
+	assert.Nil(t, err)
+	time.Sleep(5 * time.Millisecond)
+	ok, err = db.PutIfAbsent(key, []byte("f"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	_, err = db.PutIfAbsent(nil, []byte("f"))
+	assert.Equal(t, ErrEmptyKey, err)
+}
+
+func TestConcurrentCompareAndSwap(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-conditional-2")
+	opts.DataDir = dir
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	key := []byte("counter")
+	err = db.Put(key, []byte("0"))
+	assert.Nil(t, err)
+
+	// every increase retries until its swap matches
+	wg := new(sync.WaitGroup)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				for {
+					val, err := db.Get(key)
+					assert.Nil(t, err)
+					n, _ := strconv.Atoi(string(val))
+					ok, err := db.CompareAndSwap(key, val, []byte(fmt.Sprint(n+1)))
+					assert.Nil(t, err)
+					if ok {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("800"), val)
+}
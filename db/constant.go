@@ -1,6 +1,9 @@
 package db
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 var (
 	ErrEmptyKey                = errors.New("empty key")
@@ -10,14 +13,32 @@ var (
 	ErrDataDirectory           = errors.New("data directory error")
 	ErrDataExceedAtomicMaxSize = errors.New("data exceed atomic max size")
 	ErrMergeFailed             = errors.New("merge failed")
+	ErrMergeInProgress         = errors.New("merge or compaction is in progress")
 	ErrDBIsUsing               = errors.New("db is using")
 	ErrMergeSizeNotEnough      = errors.New("merge size not enough")
 	ErrMergeNotReach           = errors.New("merge data scale not reach the threshold")
+	ErrInvalidTTL              = errors.New("ttl is not positive")
+	ErrSnapshotClosed          = errors.New("snapshot is closed")
+	ErrTxnConflict             = errors.New("transaction conflict, a key read has been changed")
+	ErrTxnFinished             = errors.New("transaction has been committed or rolled back")
+	ErrDirNotEmpty             = errors.New("target directory is not empty")
+	ErrBackupChain             = errors.New("backup chain is broken")
+	ErrBackupCorrupted         = errors.New("backup file does not match its checksum")
 )
 
 const (
 	initialTransactionSeq uint64 = 0
 	mergeDirPath                 = "-BT-MERGE"
 	mergeFinishedTag             = "MERGE.FINISHED"
+	mergedBlocksTag              = "MERGED.BLOCKS"
+	indexCheckpointName          = "INDEX.CHECKPOINT"
+	backupManifestName           = "BACKUP.MANIFEST"
+	restoreTempSuffix            = ".restoring"
 	FileLockName                 = "IOLOCK"
+	quarantineSuffix             = ".quarantine"
+	// maxMergeRetryDelay: the longest wait of background merge after failures
+	maxMergeRetryDelay = time.Hour
+
+	// NoExpire is returned by TTL for keys without deadline
+	NoExpire time.Duration = -1
 )
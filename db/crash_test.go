@@ -0,0 +1,394 @@
+package db
+
+import (
+	"bamboo/diskIO"
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	crashPut = iota
+	crashDelete
+	crashBatch
+	crashMerge
+	crashCompact
+	crashReopen
+)
+
+const crashKeys = 24
+
+// crashOp: a step of the workload, a nil value is a delete
+type crashOp struct {
+	kind   int
+	keys   [][]byte
+	values [][]byte
+}
+
+// crashWorkload: the same ops for the same seed
+func crashWorkload(seed int64, count int) []crashOp {
+	r := rand.New(rand.NewSource(seed))
+	randomKey := func() []byte {
+		return []byte(fmt.Sprintf("crash-key-%03d", r.Intn(crashKeys)))
+	}
+	randomValue := func() []byte {
+		value := make([]byte, 8+r.Intn(120))
+		r.Read(value)
+		return value
+	}
+
+	ops := make([]crashOp, 0, count)
+	for i := 0; i < count; i++ {
+		switch n := r.Intn(100); {
+		case n < 55:
+			ops = append(ops, crashOp{kind: crashPut, keys: [][]byte{randomKey()}, values: [][]byte{randomValue()}})
+		case n < 70:
+			ops = append(ops, crashOp{kind: crashDelete, keys: [][]byte{randomKey()}, values: [][]byte{nil}})
+		case n < 90:
+			op := crashOp{kind: crashBatch}
+			seen := make(map[string]bool)
+			for j := 2 + r.Intn(4); j > 0; j-- {
+				key := randomKey()
+				if seen[string(key)] {
+					continue
+				}
+				seen[string(key)] = true
+				var value []byte
+				if r.Intn(4) > 0 {
+					value = randomValue()
+				}
+				op.keys, op.values = append(op.keys, key), append(op.values, value)
+			}
+			ops = append(ops, op)
+		case n < 93:
+			ops = append(ops, crashOp{kind: crashMerge})
+		case n < 96:
+			ops = append(ops, crashOp{kind: crashCompact})
+		default:
+			ops = append(ops, crashOp{kind: crashReopen})
+		}
+	}
+	return ops
+}
+
+func crashOptions(dir string, faults *diskIO.FaultInjector) Options {
+	opts := DefaultOptions
+	opts.DataDir = dir
+	opts.InMemory = true
+	opts.DataSize = 1024
+	opts.SyncData = true
+	opts.BlobThreshold = 96
+	opts.MergeThreshold = 0
+	opts.faults = faults
+	return opts
+}
+
+func isInjected(err error) bool {
+	return errors.Is(err, diskIO.ErrInjectedCrash) || errors.Is(err, diskIO.ErrInjectedFault)
+}
+
+// applyCrashOp: err is only an injected fault
+func applyCrashOp(db *DB, opts Options, op crashOp) (*DB, error) {
+	var err error
+	switch op.kind {
+	case crashPut:
+		err = db.Put(op.keys[0], op.values[0])
+	case crashDelete:
+		err = db.Delete(op.keys[0])
+	case crashBatch:
+		batch := db.NewAtomicWrite(WriteOptions{MaxWriteCount: 100, SyncCommit: true})
+		for i, key := range op.keys {
+			if op.values[i] == nil {
+				err = batch.Delete(key)
+			} else {
+				err = batch.Put(key, op.values[i])
+			}
+			if err != nil {
+				return db, err
+			}
+		}
+		err = batch.Commit()
+	case crashMerge:
+		// the merge may not be needed
+		if err = db.Merge(); !isInjected(err) {
+			err = nil
+		}
+	case crashCompact:
+		// nothing to compact, or a merge is running
+		if err = db.Compact(CompactOptions{MaxBlocks: 1, MinGarbageRatio: 0.3}); !isInjected(err) {
+			err = nil
+		}
+	case crashReopen:
+		// the files are closed even if Close fails
+		closeErr := db.Close()
+		reopened, err := CreateDB(opts)
+		if err != nil {
+			return nil, err
+		}
+		return reopened, closeErr
+	}
+	return db, err
+}
+
+// checkCrashKeys: the value of every key is in allowed, a nil value means the key is not found
+func checkCrashKeys(t *testing.T, db *DB, allowed func(key string, value []byte) bool) {
+	for i := 0; i < crashKeys; i++ {
+		key := fmt.Sprintf("crash-key-%03d", i)
+		value, err := db.Get([]byte(key))
+		if err == ErrKeyNotFound {
+			value, err = nil, nil
+		}
+		if !assert.Nil(t, err, key) {
+			continue
+		}
+		assert.True(t, allowed(key, value), "%s has an unexpected value", key)
+	}
+}
+
+// crash at every sampled io call, drop what is not synced, and reopen:
+// every acknowledged write survives, and the op in flight is done wholly or not at all
+func TestCrashConsistency(t *testing.T) {
+	testCrashConsistency(t, 7, 400)
+}
+
+// a compaction drops the finish record of a batch, whose records are in an older block
+func TestCrashConsistencyCompact(t *testing.T) {
+	testCrashConsistency(t, 19, 400)
+}
+
+func testCrashConsistency(t *testing.T, seed int64, runs int64) {
+	const opCount = 150
+	ops := crashWorkload(seed, opCount)
+	dir := "/bamboo-crash"
+
+	// count the io calls of the whole workload
+	injector := diskIO.NewFaultInjector()
+	db, err := CreateDB(crashOptions(dir, injector))
+	assert.Nil(t, err)
+	for _, op := range ops {
+		db, err = applyCrashOp(db, crashOptions(dir, injector), op)
+		if !assert.Nil(t, err) {
+			return
+		}
+	}
+	destroyDB(db)
+	calls := injector.Calls()
+	assert.Greater(t, calls, int64(opCount))
+
+	if testing.Short() {
+		runs = 50
+	}
+	stride := calls/runs + 1
+
+	for at := int64(1); at <= calls; at += stride {
+		injector := diskIO.NewFaultInjector(diskIO.Fault{Call: diskIO.AnyCall, At: at, Kind: diskIO.FaultCrash})
+		opts := crashOptions(dir, injector)
+
+		// acknowledged values, and the op in flight at the crash
+		model := make(map[string][]byte)
+		inFlight := -1
+		db, err := CreateDB(opts)
+		for i := 0; err == nil && i < len(ops); i++ {
+			if db, err = applyCrashOp(db, opts, ops[i]); err != nil {
+				inFlight = i
+				break
+			}
+			for j, key := range ops[i].keys {
+				model[string(key)] = ops[i].values[j]
+			}
+		}
+		// batches are written in map order, so the count of calls varies a little
+		if !injector.Crashed() {
+			assert.Nil(t, err)
+			_ = db.Close()
+			_ = diskIO.Memory.RemoveAll(dir)
+			continue
+		}
+		if !assert.True(t, isInjected(err), "crash at %d: %v", at, err) {
+			return
+		}
+
+		// the process dies: files are left open, unsynced bytes are lost
+		if db != nil {
+			_ = db.fLock.Unlock()
+		}
+		assert.Nil(t, injector.DropUnsynced())
+
+		recovered, err := CreateDB(crashOptions(dir, nil))
+		if !assert.Nil(t, err, "crash at %d, op %d in flight", at, inFlight) {
+			return
+		}
+
+		// keys of a batch in flight are all old or all new
+		var oldSeen, newSeen bool
+		checkCrashKeys(t, recovered, func(key string, value []byte) bool {
+			if inFlight >= 0 {
+				for j, opKey := range ops[inFlight].keys {
+					if string(opKey) != key {
+						continue
+					}
+					isOld, isNew := bytes.Equal(value, model[key]), bytes.Equal(value, ops[inFlight].values[j])
+					oldSeen = oldSeen || (isOld && !isNew)
+					newSeen = newSeen || (isNew && !isOld)
+					return isOld || isNew
+				}
+			}
+			return bytes.Equal(value, model[key])
+		})
+		assert.False(t, oldSeen && newSeen, "crash at %d: op %d is partly visible", at, inFlight)
+
+		// the recovered db can be written and opened again
+		assert.Nil(t, recovered.Put([]byte("after-crash"), []byte("value")))
+		assert.Nil(t, recovered.Close())
+		reopened, err := CreateDB(crashOptions(dir, nil))
+		if !assert.Nil(t, err, "crash at %d", at) {
+			return
+		}
+		value, err := reopened.Get([]byte("after-crash"))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value"), value)
+		destroyDB(reopened)
+
+		if t.Failed() {
+			t.Logf("first failure: crash at call %d of %d, op %d in flight", at, calls, inFlight)
+			return
+		}
+	}
+}
+
+// a failed write or sync fails only its op: the db goes on, and after reopen
+// every acknowledged write is there, a failed op is done wholly or not at all
+func TestFaultInjection(t *testing.T) {
+	ops := crashWorkload(11, 120)
+	dir := "/bamboo-fault"
+
+	for _, fault := range []diskIO.Fault{
+		{Call: diskIO.WriteCall, At: 40, Kind: diskIO.FaultShortWrite},
+		{Call: diskIO.WriteCall, At: 41, Kind: diskIO.FaultShortWrite},
+		{Call: diskIO.WriteCall, At: 90, Kind: diskIO.FaultError},
+		{Call: diskIO.SyncCall, At: 30, Kind: diskIO.FaultError},
+		{Call: diskIO.MetaCall, At: 6, Kind: diskIO.FaultError},
+	} {
+		second := fault
+		second.At *= 3
+		injector := diskIO.NewFaultInjector(fault, second)
+		opts := crashOptions(dir, injector)
+
+		// key -> values it may have
+		allowed := make(map[string][][]byte)
+		isAllowed := func(key string, value []byte) bool {
+			values, ok := allowed[key]
+			if !ok {
+				return value == nil
+			}
+			for _, allowedValue := range values {
+				if bytes.Equal(value, allowedValue) {
+					return true
+				}
+			}
+			return false
+		}
+
+		failed := 0
+		db, err := CreateDB(opts)
+		if !assert.Nil(t, err) {
+			return
+		}
+		for i, op := range ops {
+			next, err := applyCrashOp(db, opts, op)
+			if next == nil {
+				// the reopen failed, open it again
+				next, err = CreateDB(opts)
+				if !assert.Nil(t, err) {
+					return
+				}
+			}
+			db = next
+
+			if err != nil {
+				assert.True(t, isInjected(err), "%v", err)
+				failed++
+			}
+			for j, key := range op.keys {
+				values := allowed[string(key)]
+				if err == nil {
+					values = nil
+				} else if values == nil {
+					// a key never written is not found
+					values = [][]byte{nil}
+				}
+				allowed[string(key)] = append(values, op.values[j])
+			}
+
+			// the db goes on after a failed op
+			checkCrashKeys(t, db, isAllowed)
+			if t.Failed() {
+				t.Logf("fault %+v: first failure after op %d", fault, i)
+				return
+			}
+		}
+		assert.Greater(t, failed, 0, "fault %+v", fault)
+		assert.False(t, injector.Crashed())
+		_ = db.Close()
+
+		reopened, err := CreateDB(crashOptions(dir, nil))
+		if !assert.Nil(t, err, "fault %+v", fault) {
+			return
+		}
+		checkCrashKeys(t, reopened, isAllowed)
+		destroyDB(reopened)
+	}
+}
+
+// a corrupted write is never read as a wrong value: its key is lost, or fails by crc
+func TestFaultCorruption(t *testing.T) {
+	ops := crashWorkload(13, 120)
+	dir := "/bamboo-corrupt"
+
+	for _, at := range []int64{5, 50, 100, 150, 200} {
+		injector := diskIO.NewFaultInjector(diskIO.Fault{Call: diskIO.WriteCall, At: at, Kind: diskIO.FaultCorrupt})
+		opts := crashOptions(dir, injector)
+		opts.CorruptionPolicy = CorruptionSkip
+
+		// key -> every value written to it
+		written := make(map[string][][]byte)
+		db, err := CreateDB(opts)
+		if !assert.Nil(t, err) {
+			return
+		}
+		for _, op := range ops {
+			for j, key := range op.keys {
+				written[string(key)] = append(written[string(key)], op.values[j])
+			}
+			if db, err = applyCrashOp(db, opts, op); err != nil {
+				break
+			}
+		}
+		if db != nil {
+			_ = db.Close()
+		}
+
+		opts.faults = nil
+		reopened, err := CreateDB(opts)
+		if !assert.Nil(t, err, "corrupt at %d", at) {
+			continue
+		}
+		for i := 0; i < crashKeys; i++ {
+			key := fmt.Sprintf("crash-key-%03d", i)
+			value, err := reopened.Get([]byte(key))
+			if err != nil {
+				continue
+			}
+			found := false
+			for _, writtenValue := range written[key] {
+				found = found || bytes.Equal(value, writtenValue)
+			}
+			assert.True(t, found, "corrupt at %d: %s has a wrong value", at, key)
+		}
+		destroyDB(reopened)
+	}
+}
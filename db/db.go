@@ -7,15 +7,13 @@ import (
 	"bamboo/index"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
-
-	"github.com/gofrs/flock"
+	"time"
 )
 
 type DB struct {
@@ -27,18 +25,50 @@ type DB struct {
 	fileList       []int
 	atomicSeq      uint64
 	inMergeProcess bool
-	fLock          *flock.Flock
+	fLock          diskIO.FileLock
+	// fs: where the files of db are, memory or disk
+	fs             diskIO.FileSystem
 	bytesCount     uint
 	spaceToCollect int64
+	groupCommit    *groupCommitter
+	activeBlob     *content.BlockFile
+	inactiveBlob   map[uint32]*content.BlockFile
+	mergeScheduler *mergeScheduler
+	progressLock   *sync.Mutex
+	mergeProgress  *MergeProgress
+	// bytes of logs which are not used anymore, per block and per blob file
+	blockGarbage map[uint32]int64
+	blobGarbage  map[uint32]int64
+	// live snapshots, and files they keep from removal
+	snapshots       map[*Snapshot]struct{}
+	pendingRemovals []*pendingRemoval
+	// value bytes written with compression since open
+	uncompressedBytes int64
+	compressedBytes   int64
+	// key, type and position of logs in active block, written as its hint when sealed
+	activeHints []*content.TransActionLog
+	// writeSeq counts writes since open, keyVersions keeps the seq of the last write
+	// of keys written while txns are open, so a commit can check what it read
+	writeSeq    uint64
+	openTxns    map[*Txn]struct{}
+	keyVersions map[string]uint64
 }
 
 // get the status of the db
 // how many files, how many keys, how many bytes
 type DBStatus struct {
-	BlockCount     uint
+	BlockCount uint
+	// KeyCount: keys visible to Get, expired keys are not counted
 	KeyCount       uint
 	BytesToCollect int64
 	DiskUsage      int64
+	// BlobCount and BlobBytesToCollect: blob files and their unused bytes
+	BlobCount          uint
+	BlobBytesToCollect int64
+	// UncompressedBytes and CompressedBytes: the raw and stored size of
+	// compressed values written since the db was opened
+	UncompressedBytes int64
+	CompressedBytes   int64
 }
 
 func CreateDB(options Options) (*DB, error) {
@@ -47,16 +77,23 @@ func CreateDB(options Options) (*DB, error) {
 		return nil, err
 	}
 
+	fs := diskIO.OS
+	if options.InMemory {
+		fs = diskIO.Memory
+	}
+	if options.faults != nil {
+		fs = options.faults.FileSystem(fs)
+	}
+
 	// judge if the data directory exists
-	if _, err := os.Stat(options.DataDir); os.IsNotExist(err) {
-		if err := os.Mkdir(options.DataDir, os.ModePerm); err != nil {
+	if _, err := fs.Stat(options.DataDir); os.IsNotExist(err) {
+		if err := fs.Mkdir(options.DataDir); err != nil {
 			return nil, err
 		}
 	}
 
 	// lock to dir: only a process can use the db
-	fLock := flock.New(filepath.Join(options.DataDir, FileLockName))
-	isLocked, err := fLock.TryLock()
+	fLock, isLocked, err := fs.TryLock(filepath.Join(options.DataDir, FileLockName))
 	if err != nil {
 		return nil, err
 	}
@@ -68,37 +105,79 @@ func CreateDB(options Options) (*DB, error) {
 		options:       options,
 		muLock:        new(sync.RWMutex),
 		inactiveBlock: make(map[uint32]*content.BlockFile),
+		inactiveBlob:  make(map[uint32]*content.BlockFile),
+		blockGarbage:  make(map[uint32]int64),
+		blobGarbage:   make(map[uint32]int64),
+		snapshots:     make(map[*Snapshot]struct{}),
+		openTxns:      make(map[*Txn]struct{}),
+		keyVersions:   make(map[string]uint64),
 		index:         index.NewIndexer(options.IndexType),
 		fLock:         fLock,
+		fs:            fs,
+		groupCommit:   newGroupCommitter(),
+		progressLock:  new(sync.Mutex),
+	}
+
+	if err := db.open(); err != nil {
+		// release files and the lock, so the dir can be opened again
+		for _, block := range db.inactiveBlock {
+			_ = block.Close()
+		}
+		if db.activeBlock != nil {
+			_ = db.activeBlock.Close()
+		}
+		db.closeBlobs()
+		_ = fLock.Unlock()
+		return nil, err
+	}
+
+	if options.AutoMerge.Interval > 0 {
+		db.mergeScheduler = newMergeScheduler(db)
 	}
+	return db, nil
+}
 
+// load blocks and build the memory index
+func (db *DB) open() error {
 	// first, check if has merge dir
 	if err := db.getMergeBlocks(); err != nil {
-		return nil, err
+		return err
 	}
 
 	// load data from disk
 	if err := db.loadFromDisk(); err != nil {
-		return nil, err
+		return err
 	}
 
-	// load from hint
-	if err := db.getIndexFromHint(); err != nil {
-		return nil, err
+	// load from index checkpoint, or from hint
+	checkpoint, err := db.loadIndexCheckpoint()
+	if err != nil {
+		return err
+	}
+	if checkpoint == nil {
+		if err := db.getIndexFromHint(); err != nil {
+			return err
+		}
 	}
 
 	// update memory index
-	if err := db.updateMemoryIndex(); err != nil {
-		return nil, err
+	if err := db.updateMemoryIndex(checkpoint); err != nil {
+		return err
+	}
+
+	// the checkpoint is stale once the db is written
+	if err := db.fs.Remove(db.indexCheckpointPath()); err != nil && !os.IsNotExist(err) {
+		return err
 	}
 
 	// set io to system io, because need to write or sync data
-	if db.options.QuickStart {
+	if db.mmapOnOpen() {
 		if err := db.restoreFileSystemIO(); err != nil {
-			return nil, err
+			return err
 		}
 	}
-	return db, nil
+
+	return db.recountBlobGarbage()
 }
 
 // why need to restore file system io?
@@ -108,7 +187,8 @@ func (db *DB) restoreFileSystemIO() error {
 		return nil
 	}
 
-	if err := db.activeBlock.SetIOManager(db.options.DataDir, diskIO.FileSystemIO); err != nil {
+	// the active block is written, with buffered or system io
+	if err := db.activeBlock.SetIOManager(db.options.DataDir, db.blockIOType()); err != nil {
 		return err
 	}
 
@@ -130,16 +210,22 @@ func (db *DB) GetDBStatus() *DBStatus {
 		blocksCnt++
 	}
 
-	DiskUsage, err := utils.GetDirSize(db.options.DataDir)
+	DiskUsage, err := utils.GetDirSizeFrom(db.fs, db.options.DataDir)
 	if err != nil {
 		panic(fmt.Sprintf("GetDirSize failed, error: %v", err))
 	}
 
 	return &DBStatus{
 		BlockCount:     blocksCnt,
-		KeyCount:       uint(db.index.Size()),
+		KeyCount:       db.liveKeyCount(),
 		BytesToCollect: db.spaceToCollect,
 		DiskUsage:      DiskUsage,
+
+		BlobCount:          uint(len(db.allBlobs())),
+		BlobBytesToCollect: db.blobBytesToCollect(),
+
+		UncompressedBytes: db.uncompressedBytes,
+		CompressedBytes:   db.compressedBytes,
 	}
 }
 
@@ -160,19 +246,108 @@ func validateOptions(options Options) error {
 		return errors.New("MergeThreshold is not in range [0, 1]")
 	}
 
+	if options.Compression != NoCompression && options.Compression != FlateCompression {
+		return errors.New("Compression is not supported")
+	}
+
+	if !content.IsChecksumSupported(options.Checksum) {
+		return errors.New("Checksum is not supported")
+	}
+
+	if options.BlobGCRatio < 0 || options.BlobGCRatio > 1 {
+		return errors.New("BlobGCRatio is not in range [0, 1]")
+	}
+
+	if options.OpenWorkers < 0 {
+		return errors.New("OpenWorkers is negative")
+	}
+
+	if options.BufferedWrite.BufferSize < 0 || options.BufferedWrite.FlushInterval < 0 {
+		return errors.New("BufferedWrite.BufferSize or BufferedWrite.FlushInterval is negative")
+	}
+
+	if options.MMapWrite && options.BufferedWrite.BufferSize > 0 {
+		return errors.New("MMapWrite and BufferedWrite can not be used together")
+	}
+
+	if options.InMemory && (options.MMapWrite || options.BufferedWrite.BufferSize > 0) {
+		return errors.New("InMemory can not be used with MMapWrite or BufferedWrite")
+	}
+
+	if options.AutoMerge.Interval < 0 {
+		return errors.New("AutoMerge.Interval is negative")
+	}
+
+	if options.AutoMerge.Ratio < 0 || options.AutoMerge.Ratio > 1 {
+		return errors.New("AutoMerge.Ratio is not in range [0, 1]")
+	}
+
+	day := 24 * time.Hour
+	if options.AutoMerge.WindowStart < 0 || options.AutoMerge.WindowStart >= day ||
+		options.AutoMerge.WindowEnd < 0 || options.AutoMerge.WindowEnd >= day {
+		return errors.New("AutoMerge window is not in one day")
+	}
+
 	return nil
 }
 
+// options to open a block of the db
+func (db *DB) blockOptions(ioType diskIO.IOType) content.BlockOptions {
+	options := content.BlockOptions{
+		IOType:       ioType,
+		KeyProvider:  db.options.KeyProvider,
+		IOOptions:    diskIO.IOOptions{Faults: db.options.faults},
+		Checksum:     db.options.Checksum,
+		LegacyFormat: db.options.legacyFormat,
+	}
+	switch ioType {
+	case diskIO.MMapWriteIO:
+		options.IOOptions.Prealloc = int64(db.options.DataSize)
+	case diskIO.BufferedIO:
+		options.IOOptions.BufferSize = db.options.BufferedWrite.BufferSize
+		options.IOOptions.FlushInterval = db.options.BufferedWrite.FlushInterval
+		options.IOOptions.SyncOnFlush = db.options.BufferedWrite.SyncOnFlush
+	}
+	return options
+}
+
+// blockIOType: io of the blocks which may be written
+func (db *DB) blockIOType() diskIO.IOType {
+	if db.options.InMemory {
+		return diskIO.MemoryIO
+	}
+	if db.options.MMapWrite {
+		return diskIO.MMapWriteIO
+	}
+	if db.options.BufferedWrite.BufferSize > 0 {
+		return diskIO.BufferedIO
+	}
+	return diskIO.FileSystemIO
+}
+
+// fileIOType: io of blob, hint and other files
+func (db *DB) fileIOType() diskIO.IOType {
+	if db.options.InMemory {
+		return diskIO.MemoryIO
+	}
+	return diskIO.FileSystemIO
+}
+
+// mmapOnOpen: blocks are read by mmap on open, and reopened to write after
+func (db *DB) mmapOnOpen() bool {
+	return db.options.QuickStart && !db.options.MMapWrite && !db.options.InMemory
+}
+
 func (db *DB) setActiveBlock() error {
 	var initialFileIndex uint32 = 0
 	if db.activeBlock != nil {
 		initialFileIndex = db.activeBlock.FileIndex + 1
 	}
 
-	newFile, err := content.OpenBlock(db.options.DataDir, initialFileIndex, diskIO.FileSystemIO)
+	newFile, err := content.OpenBlockWithOptions(db.options.DataDir, initialFileIndex, db.blockOptions(db.blockIOType()))
 
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	db.activeBlock = newFile
@@ -180,43 +355,54 @@ func (db *DB) setActiveBlock() error {
 }
 
 // why return indexer?
-// 1. append log to current active block
+// 1. write log to current active block, without sync
 // 2. update index, and return new indexer
-func (db *DB) appendLog(log *content.LogStruct) (*content.LogStructIndex, error) {
+func (db *DB) writeLog(log *content.LogStruct) (*content.LogStructIndex, error) {
 	// if empty
 	if db.activeBlock == nil {
 		if err := db.setActiveBlock(); err != nil {
-			panic(err)
+			return nil, err
 		}
 	}
 
+	// large value: write it to a blob file, and keep a pointer in the block
+	var blobPointer *content.BlobPointer
+	if log.Blob {
+		blobPointer, _ = content.DecodeBlobPointer(log.Value)
+	} else if db.isBlobValue(log) {
+		pointer, err := db.writeBlob(log)
+		if err != nil {
+			return nil, err
+		}
+		blobPointer = pointer
+		log = &content.LogStruct{
+			Key:    log.Key,
+			Value:  content.EncodeBlobPointer(pointer),
+			Type:   log.Type,
+			Expire: log.Expire,
+			Blob:   true,
+		}
+	}
+
+	log = db.compressLog(log)
+
 	// write log to active block
-	encodeLog, size := content.Encoder(log)
+	encodeLog, size := db.activeBlock.Encode(log)
 	// update bytes count
 	db.bytesCount += uint(size)
 
 	// if reach the max size
-	if db.activeBlock.WritePos+size > int64(db.options.DataSize) {
-		// sync and close the active block
-		if err := db.activeBlock.Sync(); err != nil {
-			panic(err)
-		}
-
-		// transfer active block to inactive block
-		db.inactiveBlock[db.activeBlock.FileIndex] = db.activeBlock
-
-		// create a new active block
-		if err := db.setActiveBlock(); err != nil {
+	if db.activeBlock.WritePos+db.activeBlock.WriteSize(size) > int64(db.options.DataSize) {
+		// sync and close the active block, with the blob file it points to
+		if err := db.syncActive(); err != nil {
 			return nil, err
 		}
-	}
 
-	// check options: weather to sync data
-	if db.options.SyncData && db.bytesCount >= db.options.SyncThreshold {
-		if err := db.activeBlock.Sync(); err != nil {
+		if err := db.sealActiveBlock(); err != nil {
 			return nil, err
 		}
-		db.bytesCount = 0
+		// the old block may be of another checksum
+		encodeLog, _ = db.activeBlock.Encode(log)
 	}
 
 	writePos := db.activeBlock.WritePos
@@ -224,54 +410,181 @@ func (db *DB) appendLog(log *content.LogStruct) (*content.LogStructIndex, error)
 		return nil, err
 	}
 
-	// if sync data
-	if db.options.SyncData {
-		if err := db.activeBlock.Sync(); err != nil {
-			return nil, err
-		}
-	}
-
 	// build index
 	logIndex := &content.LogStructIndex{
 		FileIndex:     db.activeBlock.FileIndex,
 		Offset:        writePos,
-		DiskByteUsage: uint32(size),
+		DiskByteUsage: uint32(db.activeBlock.WritePos - writePos),
+		Expire:        log.Expire,
+		Blob:          blobPointer,
 	}
 
+	db.activeHints = append(db.activeHints, &content.TransActionLog{
+		Log:      &content.LogStruct{Key: log.Key, Type: log.Type},
+		Position: logIndex,
+	})
 	return logIndex, nil
 }
 
-func (db *DB) lockedAppendLog(log *content.LogStruct) (*content.LogStructIndex, error) {
-	db.muLock.Lock()
-	defer db.muLock.Unlock()
-	return db.appendLog(log)
+// sealActiveBlock: the synced active block is trimmed and its hint is written,
+// then it becomes inactive and a new active block is created.
+// so only the last block may have a preallocated tail after a crash
+func (db *DB) sealActiveBlock() error {
+	sealed, hints := db.activeBlock, db.activeHints
+
+	// drop the preallocated tail, a sealed block ends with its last log
+	if db.options.MMapWrite {
+		if err := sealed.Truncate(sealed.WritePos); err != nil {
+			return err
+		}
+	}
+
+	// without the hint, the block is read on open
+	size, err := sealed.Size()
+	if err != nil {
+		return err
+	}
+	err = content.WriteBlockHint(db.options.DataDir, sealed.FileIndex, size, hints, db.blockOptions(db.fileIOType()))
+	if err != nil {
+		return err
+	}
+
+	// create a new active block
+	if err := db.setActiveBlock(); err != nil {
+		return err
+	}
+	db.inactiveBlock[sealed.FileIndex] = sealed
+	db.activeHints = nil
+	return nil
 }
 
-func (db *DB) Put(key []byte, value []byte) error {
-	if len(key) == 0 {
-		return ErrEmptyKey
+// removeBlockHint: the hint goes away with its block
+func (db *DB) removeBlockHint(fileIndex uint32) error {
+	err := db.fs.Remove(content.GetBlockHintName(db.options.DataDir, fileIndex))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// compress value, if it shrinks
+func (db *DB) compressLog(log *content.LogStruct) *content.LogStruct {
+	if db.options.Compression != FlateCompression || log.Compressed || log.Blob {
+		return log
 	}
 
-	logStruct := &content.LogStruct{
-		Key:   encodeLogKeyWithSeqNo(key, initialTransactionSeq),
-		Value: value,
-		Type:  content.LogNormal,
+	compressed, ok := content.CompressValue(log.Value)
+	if !ok {
+		return log
+	}
+
+	db.uncompressedBytes += int64(len(log.Value))
+	db.compressedBytes += int64(len(compressed))
+	return &content.LogStruct{
+		Key:        log.Key,
+		Value:      compressed,
+		Type:       log.Type,
+		Expire:     log.Expire,
+		Compressed: true,
 	}
+}
 
-	// append log to active block
-	pos, err := db.lockedAppendLog(logStruct)
+// appendLog = writeLog + sync (if SyncData)
+func (db *DB) appendLog(log *content.LogStruct) (*content.LogStructIndex, error) {
+	logIndex, err := db.writeLog(log)
 	if err != nil {
+		return nil, err
+	}
+
+	// if sync data
+	if db.options.SyncData {
+		if err := db.syncActive(); err != nil {
+			return nil, err
+		}
+		db.bytesCount = 0
+	}
+
+	return logIndex, nil
+}
+
+// append log and update memory index in one critical section,
+// so compaction never sees a written log which is not indexed yet.
+// with SyncData on, concurrent writers share one fsync through group commit, unless it is disabled
+func (db *DB) lockedAppendLog(log *content.LogStruct) error {
+	if db.options.SyncData && !db.options.DisableGroupCommit {
+		_, err := db.groupCommit.append(db, log)
 		return err
 	}
 
-	// update index
-	if oldIndexer := db.index.Put(key, pos); oldIndexer != nil {
-		db.spaceToCollect += int64(oldIndexer.DiskByteUsage)
+	db.muLock.Lock()
+	defer db.muLock.Unlock()
+
+	pos, err := db.appendLog(log)
+	if err != nil {
+		return err
 	}
 
+	dataKey, _ := parseLogKey(log.Key)
+	db.updateIndex(dataKey, log.Type, pos)
 	return nil
 }
 
+// updateIndex applies a written log to memory index, and counts the space to collect.
+// an expired log is the same as a deleted one
+func (db *DB) updateIndex(key []byte, logType content.LogType, pos *content.LogStructIndex) {
+	var oldIndexer *content.LogStructIndex
+	if logType == content.LogDeleted || pos.IsExpired(time.Now().UnixNano()) {
+		oldIndexer, _ = db.index.Delete(key)
+		// the entry is deleted, so the space need to collect
+		db.addGarbage(pos)
+	} else {
+		oldIndexer = db.index.Put(key, pos)
+	}
+
+	if oldIndexer != nil {
+		db.addGarbage(oldIndexer)
+	}
+	db.noteWrite(key)
+}
+
+// addGarbage: the log of pos is not used anymore
+func (db *DB) addGarbage(pos *content.LogStructIndex) {
+	db.spaceToCollect += int64(pos.DiskByteUsage)
+	db.blockGarbage[pos.FileIndex] += int64(pos.DiskByteUsage)
+	if pos.Blob != nil {
+		db.blobGarbage[pos.Blob.FileIndex] += int64(pos.Blob.DiskByteUsage)
+	}
+}
+
+func (db *DB) Put(key []byte, value []byte) error {
+	return db.put(key, value, 0)
+}
+
+// PutWithTTL: put the key, which expires after ttl
+func (db *DB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return db.put(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// expire: unix nano deadline, 0 means never expire
+func (db *DB) put(key []byte, value []byte, expire int64) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+
+	logStruct := &content.LogStruct{
+		Key:    encodeLogKeyWithSeqNo(key, initialTransactionSeq),
+		Value:  value,
+		Type:   content.LogNormal,
+		Expire: expire,
+	}
+
+	// append log to active block, and update index
+	return db.lockedAppendLog(logStruct)
+}
+
 func (db *DB) Get(key []byte) ([]byte, error) {
 	db.muLock.RLock()
 	defer db.muLock.RUnlock()
@@ -282,57 +595,107 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 
 	// get index
 	logStruct := db.index.Get(key)
-	if logStruct == nil {
+	if logStruct == nil || logStruct.IsExpired(time.Now().UnixNano()) {
 		return nil, ErrKeyNotFound
 	}
 
 	return db.GetValueFormLog(logStruct)
 }
 
-func (db *DB) Delete(key []byte) error {
+// Expire: reset the ttl of an existing key, ttl <= 0 removes the ttl
+func (db *DB) Expire(key []byte, ttl time.Duration) error {
 	if len(key) == 0 {
 		return ErrEmptyKey
 	}
 
-	if pos := db.index.Get(key); pos == nil {
-		return nil
-	}
+	db.muLock.Lock()
+	defer db.muLock.Unlock()
 
-	// add tag to log
-	log := &content.LogStruct{
-		Key:  encodeLogKeyWithSeqNo(key, initialTransactionSeq),
-		Type: content.LogDeleted,
+	pos := db.index.Get(key)
+	if pos == nil || pos.IsExpired(time.Now().UnixNano()) {
+		return ErrKeyNotFound
 	}
 
-	// add log to active block
-	curIndexer, err := db.lockedAppendLog(log)
+	value, err := db.GetValueFormLog(pos)
 	if err != nil {
 		return err
 	}
-	// the entry is deleted, so the space need to collect
-	db.spaceToCollect += int64(curIndexer.DiskByteUsage)
 
-	//remove key
-	oldIndexer, succeed := db.index.Delete(key)
-	if !succeed {
-		return ErrIndexUpdateFailed
+	var expire int64
+	if ttl > 0 {
+		expire = time.Now().Add(ttl).UnixNano()
 	}
-	if oldIndexer != nil {
-		db.spaceToCollect += int64(oldIndexer.DiskByteUsage)
+
+	// rewrite the value with the new deadline
+	newPos, err := db.appendLog(&content.LogStruct{
+		Key:    encodeLogKeyWithSeqNo(key, initialTransactionSeq),
+		Value:  value,
+		Type:   content.LogNormal,
+		Expire: expire,
+	})
+	if err != nil {
+		return err
 	}
 
+	db.updateIndex(key, content.LogNormal, newPos)
 	return nil
 }
 
+// TTL: get the remaining time to live of the key, NoExpire if the key never expires
+func (db *DB) TTL(key []byte) (time.Duration, error) {
+	if len(key) == 0 {
+		return 0, ErrEmptyKey
+	}
+
+	now := time.Now().UnixNano()
+	pos := db.index.Get(key)
+	if pos == nil || pos.IsExpired(now) {
+		return 0, ErrKeyNotFound
+	}
+
+	if pos.Expire == 0 {
+		return NoExpire, nil
+	}
+	return time.Duration(pos.Expire - now), nil
+}
+
+func (db *DB) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+
+	if pos := db.index.Get(key); pos == nil {
+		return nil
+	}
+
+	// add tag to log
+	log := &content.LogStruct{
+		Key:  encodeLogKeyWithSeqNo(key, initialTransactionSeq),
+		Type: content.LogDeleted,
+	}
+
+	// add log to active block, and remove key
+	return db.lockedAppendLog(log)
+}
+
 func (db *DB) loadFromDisk() error {
-	dir, err := os.ReadDir(db.options.DataDir)
+	dir, err := db.fs.ReadDir(db.options.DataDir)
 	if err != nil {
 		return err
 	}
 
 	var fileList []int
+	var blobList []int
 
 	for _, dir := range dir {
+		if strings.HasSuffix(dir.Name(), content.BlobSuffix) {
+			blobIndex, err := strconv.Atoi(strings.TrimSuffix(dir.Name(), content.BlobSuffix))
+			if err != nil {
+				return ErrDataDirectory
+			}
+			blobList = append(blobList, blobIndex)
+		}
+
 		if strings.HasSuffix(dir.Name(), content.Suffix) {
 			fileNames := strings.Split(dir.Name(), ".")
 			fileIndex, err := strconv.Atoi(fileNames[0])
@@ -348,18 +711,26 @@ func (db *DB) loadFromDisk() error {
 	sort.Ints(fileList)
 	db.fileList = fileList
 
+	if err := db.loadBlobs(blobList); err != nil {
+		return err
+	}
+
 	// load index
 	for i, fileIndex := range fileList {
+		// sealed blocks are only read, and never trimmed on close
+		ioType := db.fileIOType()
+		if i == len(fileList)-1 {
+			ioType = db.blockIOType()
+		}
 		// quick start: mmap
-		ioType := diskIO.FileSystemIO
-		if db.options.QuickStart {
+		if db.mmapOnOpen() {
 			ioType = diskIO.MMapIO
 		}
 
-		dataBlock, err := content.OpenBlock(db.options.DataDir, uint32(fileIndex), ioType)
+		dataBlock, err := content.OpenBlockWithOptions(db.options.DataDir, uint32(fileIndex), db.blockOptions(ioType))
 
 		if err != nil {
-			return errors.New("error here")
+			return err
 		}
 
 		if i == len(fileList)-1 {
@@ -371,16 +742,22 @@ func (db *DB) loadFromDisk() error {
 	return nil
 }
 
-func (db *DB) updateMemoryIndex() error {
+// updateMemoryIndex replays the logs of blocks, from the position of checkpoint if not nil
+func (db *DB) updateMemoryIndex(checkpoint *indexCheckpoint) error {
 	// empty db
 	if len(db.fileList) == 0 {
 		return nil
 	}
 
+	startIndex, startOffset := uint32(0), int64(0)
+	if checkpoint != nil {
+		startIndex, startOffset = checkpoint.activeFileIndex, checkpoint.writePos
+	}
+
 	hasMerged, exclusiveMergeId := false, uint32(0)
 	mergeFinishedName := filepath.Join(db.options.DataDir, content.MergeFinishedTag)
 
-	if _, err := os.Stat(mergeFinishedName); err == nil {
+	if _, err := db.fs.Stat(mergeFinishedName); err == nil {
 		finId, err := db.getExclusiveMergeBlockId(db.options.DataDir)
 		if err != nil {
 			return err
@@ -389,24 +766,11 @@ func (db *DB) updateMemoryIndex() error {
 		exclusiveMergeId = finId
 	}
 
-	var updateIndexFromType = func(key []byte, logType content.LogType, logPos *content.LogStructIndex) {
-		var oldIndexer *content.LogStructIndex
-		if logType == content.LogDeleted {
-			oldIndexer, _ = db.index.Delete(key)
-			db.spaceToCollect += int64(logPos.DiskByteUsage)
-		} else {
-			oldIndexer = db.index.Put(key, logPos)
-		}
-
-		if oldIndexer != nil {
-			db.spaceToCollect += int64(oldIndexer.DiskByteUsage)
-		}
-	}
-
 	transactionMap := make(map[uint64][]*content.TransActionLog)
-	var currentTransactionSeq = initialTransactionSeq
+	var currentTransactionSeq = db.atomicSeq
 
-	// visit each file
+	// blocks to read
+	var reads []*blockRead
 	for i, fileIndex := range db.fileList {
 		var curIndex = uint32(fileIndex)
 
@@ -415,47 +779,60 @@ func (db *DB) updateMemoryIndex() error {
 			continue
 		}
 
-		var curBlockFile *content.BlockFile
-		if curIndex == db.activeBlock.FileIndex {
-			curBlockFile = db.activeBlock
-		} else {
-			curBlockFile = db.inactiveBlock[curIndex]
+		// in the checkpoint already
+		if curIndex < startIndex {
+			continue
 		}
-
-		// read log
 		offset := int64(0)
-		for {
-			log, size, err := curBlockFile.ReadLog(offset)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return err
-			}
+		if curIndex == startIndex {
+			offset = startOffset
+		}
 
-			// update memory index
-			logPos := &content.LogStructIndex{
-				FileIndex:     curIndex,
-				Offset:        offset,
-				DiskByteUsage: uint32(size),
+		reads = append(reads, &blockRead{
+			block:    db.blockFile(curIndex),
+			offset:   offset,
+			isActive: i == len(db.fileList)-1,
+		})
+	}
+
+	// blocks are read in parallel, and applied in file order
+	reader := db.newBlockReader(reads)
+	defer reader.stop()
+
+	for _, read := range reads {
+		result := reader.take()
+		if result.err != nil {
+			return result.err
+		}
+		blockLogs := result.logs
+
+		if read.isActive {
+			// logs before offset are from the checkpoint
+			if read.offset == 0 {
+				db.activeHints = nil
 			}
+			db.activeHints = append(db.activeHints, blockLogs...)
+		}
+
+		for _, blockLog := range blockLogs {
+			log, logPos := blockLog.Log, blockLog.Position
 
 			// get transaction seq
 			dataKey, seqNo := parseLogKey(log.Key)
 			// no transaction
 			if seqNo == initialTransactionSeq {
-				updateIndexFromType(dataKey, log.Type, logPos)
+				db.updateIndex(dataKey, log.Type, logPos)
 			} else {
 				// if finish the transaction
 				if log.Type == content.LogAtomicFinish {
 					for _, transLog := range transactionMap[seqNo] {
-						updateIndexFromType(transLog.Log.Key, transLog.Log.Type, transLog.Position)
+						db.updateIndex(transLog.Log.Key, transLog.Log.Type, transLog.Position)
 					}
 					delete(transactionMap, seqNo)
+					db.addGarbage(logPos)
 				} else {
-					log.Key = dataKey
 					transactionMap[seqNo] = append(transactionMap[seqNo], &content.TransActionLog{
-						Log:      log,
+						Log:      &content.LogStruct{Key: dataKey, Type: log.Type},
 						Position: logPos,
 					})
 				}
@@ -465,11 +842,13 @@ func (db *DB) updateMemoryIndex() error {
 			if seqNo > currentTransactionSeq {
 				currentTransactionSeq = seqNo
 			}
-			offset += size
 		}
+	}
 
-		if i == len(db.fileList)-1 {
-			db.activeBlock.WritePos = offset
+	// logs of unfinished transactions are never used
+	for _, transLogs := range transactionMap {
+		for _, transLog := range transLogs {
+			db.addGarbage(transLog.Position)
 		}
 	}
 
@@ -478,14 +857,31 @@ func (db *DB) updateMemoryIndex() error {
 }
 
 func (db *DB) GetValueFormLog(logPos *content.LogStructIndex) ([]byte, error) {
-	var fileToFind *content.BlockFile
+	return readValue(db, logPos)
+}
 
-	if db.activeBlock.FileIndex == logPos.FileIndex {
-		fileToFind = db.activeBlock
-	} else {
-		fileToFind = db.inactiveBlock[logPos.FileIndex]
+// fileSource finds the files to read logs from, the db or a snapshot of it
+type fileSource interface {
+	blockFile(fileIndex uint32) *content.BlockFile
+	blobFile(fileIndex uint32) *content.BlockFile
+}
+
+func (db *DB) blockFile(fileIndex uint32) *content.BlockFile {
+	if db.activeBlock != nil && db.activeBlock.FileIndex == fileIndex {
+		return db.activeBlock
 	}
+	return db.inactiveBlock[fileIndex]
+}
 
+func (db *DB) blobFile(fileIndex uint32) *content.BlockFile {
+	if db.activeBlob != nil && db.activeBlob.FileIndex == fileIndex {
+		return db.activeBlob
+	}
+	return db.inactiveBlob[fileIndex]
+}
+
+func readValue(files fileSource, logPos *content.LogStructIndex) ([]byte, error) {
+	fileToFind := files.blockFile(logPos.FileIndex)
 	if fileToFind == nil {
 		return nil, ErrBlockFileNotFound
 	}
@@ -500,6 +896,12 @@ func (db *DB) GetValueFormLog(logPos *content.LogStructIndex) ([]byte, error) {
 		return nil, ErrKeyNotFound
 	}
 
+	// the value is in a blob file
+	if log.Blob {
+		pointer, _ := content.DecodeBlobPointer(log.Value)
+		return readBlob(files.blobFile(pointer.FileIndex), pointer)
+	}
+
 	return log.Value, nil
 }
 
@@ -509,7 +911,7 @@ func (db *DB) Sync() error {
 	}
 	db.muLock.Lock()
 	defer db.muLock.Unlock()
-	return db.activeBlock.Sync()
+	return db.syncActive()
 }
 
 func (db *DB) Close() error {
@@ -520,12 +922,25 @@ func (db *DB) Close() error {
 		}
 	}()
 
+	// cancel the running background merge
+	if db.mergeScheduler != nil {
+		db.mergeScheduler.stop()
+	}
+
 	if db.activeBlock == nil {
 		return nil
 	}
 	db.muLock.Lock()
 	defer db.muLock.Unlock()
 
+	// the files are closed even if the checkpoint fails, the next open reads the blocks then
+	var checkpointErr error
+	if db.options.IndexCheckpoint && !db.hasMergeToInstall() {
+		if checkpointErr = db.syncActive(); checkpointErr == nil {
+			checkpointErr = db.writeIndexCheckpoint()
+		}
+	}
+
 	// close active block
 	if err := db.activeBlock.Close(); err != nil {
 		return err
@@ -538,19 +953,42 @@ func (db *DB) Close() error {
 		}
 	}
 
-	return nil
+	if err := db.closeBlobs(); err != nil {
+		return err
+	}
+
+	// files kept for snapshots
+	if err := db.removePending(true); err != nil {
+		return err
+	}
+	return checkpointErr
+}
+
+// liveKeyCount: keys of the index which are not expired
+func (db *DB) liveKeyCount() uint {
+	now := time.Now().UnixNano()
+	count := uint(0)
+	iterator := db.index.Iterator(false)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if !iterator.Value().IsExpired(now) {
+			count++
+		}
+	}
+	return count
 }
 
 func (db *DB) ListKeys() [][]byte {
 	Iterator := db.index.Iterator(false)
-	keys := make([][]byte, db.index.Size())
-
-	var index int
+	keys := make([][]byte, 0, db.index.Size())
 
+	now := time.Now().UnixNano()
 	Iterator.Rewind()
 	for Iterator.Valid() {
-		keys[index] = Iterator.Key()
-		index++
+		// skip expired keys
+		if !Iterator.Value().IsExpired(now) {
+			keys = append(keys, Iterator.Key())
+		}
 		Iterator.Next()
 	}
 
@@ -561,8 +999,13 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 	db.muLock.RLock()
 	defer db.muLock.RUnlock()
 
+	now := time.Now().UnixNano()
 	Iterator := db.index.Iterator(false)
 	for Iterator.Rewind(); Iterator.Valid(); Iterator.Next() {
+		if Iterator.Value().IsExpired(now) {
+			continue
+		}
+
 		value, err := db.GetValueFormLog(Iterator.Value())
 		if err != nil {
 			return err
@@ -582,7 +1025,7 @@ func destroyDB(db *DB) {
 		if db.activeBlock != nil {
 			_ = db.Close()
 		}
-		err := os.RemoveAll(db.options.DataDir)
+		err := db.fs.RemoveAll(db.options.DataDir)
 		if err != nil {
 			panic(err)
 		}
@@ -593,5 +1036,12 @@ func destroyDB(db *DB) {
 func (db *DB) Backup(dir string) error {
 	db.muLock.RLock()
 	defer db.muLock.RUnlock()
-	return utils.BackupDir(db.options.DataDir, dir, []string{FileLockName})
+
+	// buffered logs are not in the file yet
+	if db.activeBlock != nil {
+		if err := db.syncActive(); err != nil {
+			return err
+		}
+	}
+	return utils.BackupDirFrom(db.fs, db.options.DataDir, dir, []string{FileLockName})
 }
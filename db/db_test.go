@@ -1,9 +1,12 @@
 package db
 
 import (
+	"bamboo/content"
 	"bamboo/db/utils"
+	"bamboo/diskIO"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
@@ -403,3 +406,239 @@ func TestBackup(t *testing.T) {
 	err = db.Backup(backupDir)
 	assert.Nil(t, err)
 }
+
+func TestMMapWrite(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-mmap-write")
+	opts.DataDir = dir
+	opts.DataSize = 4 * 1024
+	opts.MMapWrite = true
+	opts.MergeThreshold = 0
+	db, err := CreateDB(opts)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 200; i++ {
+		values[i] = utils.RandomValue(64)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		delete(values, i)
+	}
+	checkValues(t, db, values)
+
+	// the active block is preallocated, sealed blocks are trimmed
+	fi, err := os.Stat(content.GetBlockName(dir, db.activeBlock.FileIndex))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(opts.DataSize), fi.Size())
+	assert.Greater(t, len(db.inactiveBlock), 1)
+	for fileIndex, block := range db.inactiveBlock {
+		fi, err := os.Stat(content.GetBlockName(dir, fileIndex))
+		assert.Nil(t, err)
+		assert.Equal(t, block.WritePos+block.HeaderSize(), fi.Size())
+	}
+
+	// a crash leaves the zero filled tail, which is cut off on open
+	crashDir, _ := os.MkdirTemp("", "bamboo-mmap-write")
+	defer os.RemoveAll(crashDir)
+	assert.Nil(t, db.Sync())
+	assert.Nil(t, db.Backup(crashDir))
+	crashOpts := opts
+	crashOpts.DataDir = crashDir
+	crashDB, err := CreateDB(crashOpts)
+	assert.Nil(t, err)
+	checkValues(t, crashDB, values)
+	assert.Nil(t, crashDB.Close())
+
+	activeIndex, writePos := db.activeBlock.FileIndex, db.activeBlock.WritePos+db.activeBlock.HeaderSize()
+	assert.Nil(t, db.Close())
+	fi, err = os.Stat(content.GetBlockName(dir, activeIndex))
+	assert.Nil(t, err)
+	assert.Equal(t, writePos, fi.Size())
+
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	checkValues(t, db, values)
+	for i := 200; i < 300; i++ {
+		values[i] = utils.RandomValue(64)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	assert.Nil(t, db.Merge())
+	checkValues(t, db, values)
+}
+
+func TestMMapWriteCrash(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-mmap-crash")
+	opts.DataDir = dir
+	opts.DataSize = 4 * 1024
+	opts.MMapWrite = true
+	db, err := CreateDB(opts)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 200; i++ {
+		values[i] = utils.RandomValue(64)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	activeIndex := db.activeBlock.FileIndex
+	assert.Greater(t, activeIndex, uint32(1))
+	assert.Nil(t, db.Close())
+
+	// sealed blocks are not touched by open and close
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	sealedName := content.GetBlockName(dir, 0)
+	assert.Nil(t, os.Chtimes(sealedName, old, old))
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	checkValues(t, db, values)
+	assert.Nil(t, db.Close())
+	fi, err := os.Stat(sealedName)
+	assert.Nil(t, err)
+	assert.Equal(t, old, fi.ModTime())
+
+	// a crash before the last sealed block is trimmed, and before its hint is written
+	appendZero := func(name string, n int) {
+		file, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0644)
+		assert.Nil(t, err)
+		_, err = file.Write(make([]byte, n))
+		assert.Nil(t, err)
+		assert.Nil(t, file.Close())
+	}
+	lastSealed := content.GetBlockName(dir, activeIndex-1)
+	sealedInfo, err := os.Stat(lastSealed)
+	assert.Nil(t, err)
+	appendZero(lastSealed, 1024)
+	appendZero(content.GetBlockName(dir, activeIndex), 1024)
+	assert.Nil(t, os.Remove(content.GetBlockHintName(dir, activeIndex-1)))
+	assert.Nil(t, os.Remove(filepath.Join(dir, indexCheckpointName)))
+
+	// the zero tail is not a torn write
+	opts.RecoverActiveBlock = false
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	checkValues(t, db, values)
+	fi, err = os.Stat(lastSealed)
+	assert.Nil(t, err)
+	assert.Equal(t, sealedInfo.Size(), fi.Size())
+}
+
+func TestBufferedWrite(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-buffered-write")
+	opts.DataDir = dir
+	opts.DataSize = 16 * 1024
+	opts.BufferedWrite = BufferedWriteOptions{
+		BufferSize:    4 * 1024,
+		FlushInterval: 10 * time.Millisecond,
+	}
+	db, err := CreateDB(opts)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 20; i++ {
+		values[i] = utils.RandomValue(64)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	// buffered logs are read from memory
+	activePath := content.GetBlockName(dir, db.activeBlock.FileIndex)
+	fi, err := os.Stat(activePath)
+	assert.Nil(t, err)
+	assert.Less(t, fi.Size(), db.activeBlock.WritePos)
+	checkValues(t, db, values)
+
+	// flushed in background
+	assert.Eventually(t, func() bool {
+		fi, err := os.Stat(activePath)
+		return err == nil && fi.Size() == db.activeBlock.WritePos+db.activeBlock.HeaderSize()
+	}, time.Second, time.Millisecond)
+
+	for i := 20; i < 1000; i++ {
+		values[i] = utils.RandomValue(64)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	assert.Greater(t, len(db.inactiveBlock), 1)
+	assert.Nil(t, db.Close())
+
+	for _, quickStart := range []bool{false, true} {
+		opts.QuickStart = quickStart
+		db, err = CreateDB(opts)
+		assert.Nil(t, err)
+		checkValues(t, db, values)
+		_, buffered := db.activeBlock.IOManager.(*diskIO.BufferedWriter)
+		assert.True(t, buffered)
+		assert.Nil(t, db.Close())
+	}
+
+	opts.MMapWrite = true
+	_, err = CreateDB(opts)
+	assert.NotNil(t, err)
+	assert.Nil(t, os.RemoveAll(dir))
+}
+
+func TestInMemory(t *testing.T) {
+	opts := DefaultOptions
+	opts.DataDir = "/bamboo-memory"
+	opts.DataSize = 4 * 1024
+	opts.MergeThreshold = 0
+	opts.InMemory = true
+	db, err := CreateDB(opts)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 500; i++ {
+		values[i] = utils.RandomValue(64)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		delete(values, i)
+	}
+	checkValues(t, db, values)
+	assert.Greater(t, len(db.inactiveBlock), 1)
+
+	// nothing is on disk
+	_, err = os.Stat(opts.DataDir)
+	assert.True(t, os.IsNotExist(err))
+	_, err = diskIO.Memory.Stat(content.GetBlockName(opts.DataDir, 0))
+	assert.Nil(t, err)
+	_, err = CreateDB(opts)
+	assert.Equal(t, ErrDBIsUsing, err)
+
+	assert.Nil(t, db.Merge())
+	checkValues(t, db, values)
+	assert.Greater(t, db.GetDBStatus().DiskUsage, int64(0))
+
+	// reopen from memory
+	assert.Nil(t, db.Close())
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	checkValues(t, db, values)
+
+	// backup to disk
+	backupDir, _ := os.MkdirTemp("", "bamboo-memory-backup")
+	defer os.RemoveAll(backupDir)
+	assert.Nil(t, db.Backup(backupDir))
+	diskOpts := DefaultOptions
+	diskOpts.DataDir = backupDir
+	diskDB, err := CreateDB(diskOpts)
+	assert.Nil(t, err)
+	checkValues(t, diskDB, values)
+	assert.Nil(t, diskDB.Close())
+
+	// a checkpoint stays in memory
+	checkpointOpts := opts
+	checkpointOpts.DataDir = "/bamboo-memory-checkpoint"
+	assert.Nil(t, db.Checkpoint(checkpointOpts.DataDir))
+	checkpointDB, err := CreateDB(checkpointOpts)
+	assert.Nil(t, err)
+	checkValues(t, checkpointDB, values)
+	destroyDB(checkpointDB)
+
+	destroyDB(db)
+	_, err = diskIO.Memory.Stat(opts.DataDir)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"bamboo/content"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bamboo/db/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncryption(t *testing.T) {
+	keys := map[uint32][]byte{
+		1: bytes.Repeat([]byte{1}, 32),
+		2: bytes.Repeat([]byte{2}, 16),
+	}
+
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-encrypt")
+	opts.DataDir = dir
+	opts.DataSize = 256 * 1024
+	opts.MergeThreshold = 0
+	opts.BlobThreshold = 64
+	opts.KeyProvider = content.NewStaticKeyProvider(1, keys)
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 10000; i++ {
+		err := db.Put(utils.GetTestKey(i), []byte("secret-value"))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 5000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Greater(t, len(db.inactiveBlock), 0)
+
+	// large values are in blob files
+	blobValue := bytes.Repeat([]byte("secret-value"), 10)
+	for i := 10000; i < 13000; i++ {
+		err := db.Put(utils.GetTestKey(i), blobValue)
+		assert.Nil(t, err)
+	}
+	assert.Greater(t, len(db.inactiveBlob), 0)
+
+	// no plain text in any file
+	checkNoPlainText := func() {
+		files, err := os.ReadDir(dir)
+		assert.Nil(t, err)
+		for _, file := range files {
+			if file.Name() == FileLockName {
+				continue
+			}
+			raw, err := os.ReadFile(filepath.Join(dir, file.Name()))
+			assert.Nil(t, err)
+			assert.False(t, bytes.Contains(raw, []byte("secret-value")), file.Name())
+			assert.False(t, bytes.Contains(raw, []byte("bamboo-key")), file.Name())
+		}
+	}
+	checkNoPlainText()
+
+	// rotate key in merge
+	opts.KeyProvider = content.NewStaticKeyProvider(2, keys)
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := CreateDB(opts)
+	assert.Nil(t, err)
+	err = db2.Merge()
+	assert.Nil(t, err)
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	// the old key is not needed anymore
+	opts.KeyProvider = content.NewStaticKeyProvider(2, map[uint32][]byte{2: keys[2]})
+	db3, err := CreateDB(opts)
+	assert.Nil(t, err)
+	checkNoPlainText()
+	assert.Equal(t, uint32(2), db3.activeBlock.KeyId())
+	for _, block := range db3.inactiveBlock {
+		assert.Equal(t, uint32(2), block.KeyId())
+	}
+	for _, blob := range db3.allBlobs() {
+		assert.Equal(t, uint32(2), blob.KeyId())
+	}
+	assert.Equal(t, 8000, len(db3.ListKeys()))
+	val, err := db3.Get(utils.GetTestKey(9999))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("secret-value"), val)
+	val, err = db3.Get(utils.GetTestKey(12999))
+	assert.Nil(t, err)
+	assert.Equal(t, blobValue, val)
+	err = db3.Close()
+	assert.Nil(t, err)
+
+	// without key provider
+	opts.KeyProvider = nil
+	_, err = CreateDB(opts)
+	assert.Equal(t, content.ErrKeyProviderMissing, err)
+}
+
+func TestEncryptionMergeLegacy(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-encrypt-legacy")
+	opts.DataDir = dir
+	opts.DataSize = 4 * 1024
+	opts.MergeThreshold = 0
+	opts.KeyProvider = content.NewStaticKeyProvider(1, map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)})
+	// blocks sealed by the offsets of their logs, as older versions wrote them
+	opts.legacyFormat = true
+	db, err := CreateDB(opts)
+	assert.Nil(t, err)
+
+	// every block is full of live logs
+	values := make(map[int][]byte)
+	for i := 0; i < 2000; i++ {
+		values[i] = utils.RandomValue(8)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	assert.Greater(t, len(db.inactiveBlock), 10)
+	assert.Nil(t, db.Close())
+
+	// logs get their own nonces in merge, merged blocks are larger
+	opts.legacyFormat = false
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Merge())
+	checkValues(t, db, values)
+
+	assert.Nil(t, db.Close())
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	defer destroyDB(db)
+	checkValues(t, db, values)
+}
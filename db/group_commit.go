@@ -0,0 +1,99 @@
+package db
+
+import (
+	"bamboo/content"
+	"sync"
+)
+
+// pendingWrite is a log waiting in the group commit queue
+type pendingWrite struct {
+	log  *content.LogStruct
+	pos  *content.LogStructIndex
+	err  error
+	done chan struct{}
+}
+
+// groupCommitter lets concurrent writers share one fsync:
+// 1. every writer pushes its log to the queue
+// 2. the writer who gets the leader slot takes the whole queue, writes it and syncs once
+// 3. the leader updates memory index and wakes every writer of the batch,
+// only after the batch is durable
+type groupCommitter struct {
+	queueLock *sync.Mutex
+	queue     []*pendingWrite
+	leader    chan struct{}
+}
+
+func newGroupCommitter() *groupCommitter {
+	return &groupCommitter{
+		queueLock: new(sync.Mutex),
+		leader:    make(chan struct{}, 1),
+	}
+}
+
+// append returns after the log is written and synced, by this writer or by another leader
+func (gc *groupCommitter) append(db *DB, log *content.LogStruct) (*content.LogStructIndex, error) {
+	req := &pendingWrite{log: log, done: make(chan struct{})}
+
+	gc.queueLock.Lock()
+	gc.queue = append(gc.queue, req)
+	gc.queueLock.Unlock()
+
+	select {
+	case <-req.done:
+		// committed by another leader
+		return req.pos, req.err
+	case gc.leader <- struct{}{}:
+	}
+
+	// the batch which holds req may finish between queueing and getting the leader slot
+	select {
+	case <-req.done:
+		<-gc.leader
+		return req.pos, req.err
+	default:
+	}
+
+	gc.queueLock.Lock()
+	batch := gc.queue
+	gc.queue = nil
+	gc.queueLock.Unlock()
+
+	db.commitBatch(batch)
+	<-gc.leader
+
+	return req.pos, req.err
+}
+
+// write all logs of batch, sync once, update index, then wake up every writer
+func (db *DB) commitBatch(batch []*pendingWrite) {
+	db.muLock.Lock()
+
+	var written []*pendingWrite
+	for _, req := range batch {
+		req.pos, req.err = db.writeLog(req.log)
+		if req.err == nil {
+			written = append(written, req)
+		}
+	}
+
+	if len(written) > 0 {
+		if err := db.syncActive(); err != nil {
+			// nothing in the batch is durable
+			for _, req := range written {
+				req.pos, req.err = nil, err
+			}
+		} else {
+			for _, req := range written {
+				dataKey, _ := parseLogKey(req.log.Key)
+				db.updateIndex(dataKey, req.log.Type, req.pos)
+			}
+		}
+		db.bytesCount = 0
+	}
+	db.muLock.Unlock()
+
+	for _, req := range batch {
+		close(req.done)
+	}
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"bamboo/db/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupCommit(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-group-commit")
+	opts.DataDir = dir
+	opts.SyncData = true
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	wg := new(sync.WaitGroup)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g * 100; i < (g+1)*100; i++ {
+				err := db.Put(utils.GetTestKey(i), utils.ConcurrencyRandomValue(64))
+				assert.Nil(t, err)
+			}
+			for i := g * 100; i < g*100+10; i++ {
+				err := db.Delete(utils.GetTestKey(i))
+				assert.Nil(t, err)
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Equal(t, 1440, len(db.ListKeys()))
+
+	// restart check
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db2, err := CreateDB(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1440, len(db2.ListKeys()))
+	for g := 0; g < 16; g++ {
+		_, err := db2.Get(utils.GetTestKey(g * 100))
+		assert.Equal(t, ErrKeyNotFound, err)
+		val, err := db2.Get(utils.GetTestKey(g*100 + 50))
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+	}
+	err = db2.Close()
+	assert.Nil(t, err)
+}
+
+func TestGroupCommitDisabled(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-group-commit-2")
+	opts.DataDir = dir
+	opts.SyncData = true
+	opts.DisableGroupCommit = true
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// every write syncs by itself
+	wg := new(sync.WaitGroup)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g * 50; i < (g+1)*50; i++ {
+				err := db.Put(utils.GetTestKey(i), utils.ConcurrencyRandomValue(64))
+				assert.Nil(t, err)
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Equal(t, 400, len(db.ListKeys()))
+	assert.Equal(t, uint(0), db.bytesCount)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 400, len(db.ListKeys()))
+}
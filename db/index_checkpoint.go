@@ -0,0 +1,307 @@
+package db
+
+import (
+	"bamboo/content"
+	"bamboo/index"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// index checkpoint: written on Close, so the next open loads the memory index
+// from it and replays only the logs written after it.
+// it is a file of logs, the first byte of each key is the kind of the log:
+// 1. header: version, active block, its write pos, atomic seq
+// 2. a block of the db and its size, to find out if the blocks have been changed
+// 3. garbage of a block
+// 4. an index entry
+// 5. a log of the active block, for its hint when it is sealed
+// 6. footer: crc of all logs before it, and their count
+// it is removed once loaded, so a crash never leaves a stale checkpoint behind
+
+const (
+	indexCheckpointVersion uint64 = 1
+
+	checkpointHeader  byte = 'H'
+	checkpointBlock   byte = 'B'
+	checkpointGarbage byte = 'G'
+	checkpointIndex   byte = 'I'
+	checkpointActive  byte = 'A'
+	checkpointFooter  byte = 'F'
+)
+
+var errCheckpointNotMatch = errors.New("index checkpoint is corrupt or does not match the blocks")
+
+// indexCheckpoint: the position the logs are replayed from, and the active block logs
+type indexCheckpoint struct {
+	activeFileIndex uint32
+	writePos        int64
+	atomicSeq       uint64
+	blockSizes      map[uint32]int64
+	blockGarbage    map[uint32]int64
+	activeHints     []*content.TransActionLog
+}
+
+func (db *DB) indexCheckpointPath() string {
+	return filepath.Join(db.options.DataDir, indexCheckpointName)
+}
+
+// checkpointWriter writes the logs of a checkpoint, and sums their crc
+type checkpointWriter struct {
+	file  *content.BlockFile
+	crc   uint32
+	count int
+}
+
+func (w *checkpointWriter) write(kind byte, key []byte, logType content.LogType, value []byte) error {
+	log := &content.LogStruct{
+		Key:   append([]byte{kind}, key...),
+		Type:  logType,
+		Value: value,
+	}
+	w.crc = checkpointCRC(w.file.Checksum(), w.crc, log)
+	w.count++
+
+	encodedLog, _ := w.file.Encode(log)
+	return w.file.Write(encodedLog)
+}
+
+// checkpointCRC: by the checksum of the checkpoint file
+func checkpointCRC(checksum content.ChecksumType, crc uint32, log *content.LogStruct) uint32 {
+	crc = content.UpdateChecksum(checksum, crc, log.Key)
+	crc = content.UpdateChecksum(checksum, crc, []byte{log.Type})
+	return content.UpdateChecksum(checksum, crc, log.Value)
+}
+
+func putVarints(values ...int64) []byte {
+	buffer := make([]byte, binary.MaxVarintLen64*len(values))
+	index := 0
+	for _, value := range values {
+		index += binary.PutVarint(buffer[index:], value)
+	}
+	return buffer[:index]
+}
+
+// getVarints decodes count varints, which must fill the whole buffer
+func getVarints(buffer []byte, count int) ([]int64, bool) {
+	values := make([]int64, count)
+	index := 0
+	for i := range values {
+		value, n := binary.Varint(buffer[index:])
+		if n <= 0 {
+			return nil, false
+		}
+		values[i] = value
+		index += n
+	}
+	return values, index == len(buffer)
+}
+
+// writeIndexCheckpoint dumps the memory index, the caller holds db.muLock
+// and has synced the active block
+func (db *DB) writeIndexCheckpoint() error {
+	path := db.indexCheckpointPath()
+	tempPath := path + ".tmp"
+	_ = db.fs.Remove(tempPath)
+
+	file, err := content.NewBlockFile(tempPath, 0, db.blockOptions(db.fileIOType()))
+	if err != nil {
+		return err
+	}
+
+	err = db.writeCheckpointLogs(&checkpointWriter{file: file})
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = db.fs.Remove(tempPath)
+		return err
+	}
+	return db.fs.Rename(tempPath, path)
+}
+
+func (db *DB) writeCheckpointLogs(w *checkpointWriter) error {
+	header := putVarints(int64(indexCheckpointVersion), int64(db.activeBlock.FileIndex),
+		db.activeBlock.WritePos, int64(db.atomicSeq))
+	if err := w.write(checkpointHeader, nil, content.LogNormal, header); err != nil {
+		return err
+	}
+
+	blocks := []*content.BlockFile{db.activeBlock}
+	for _, block := range db.inactiveBlock {
+		blocks = append(blocks, block)
+	}
+	for _, block := range blocks {
+		size, err := block.Size()
+		if err != nil {
+			return err
+		}
+		if err := w.write(checkpointBlock, nil, content.LogNormal, putVarints(int64(block.FileIndex), size)); err != nil {
+			return err
+		}
+	}
+
+	for fileIndex, garbage := range db.blockGarbage {
+		if err := w.write(checkpointGarbage, nil, content.LogNormal, putVarints(int64(fileIndex), garbage)); err != nil {
+			return err
+		}
+	}
+
+	iterator := db.index.Iterator(false)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		if err := w.write(checkpointIndex, iterator.Key(), content.LogNormal, content.EncodeIndex(iterator.Value())); err != nil {
+			return err
+		}
+	}
+
+	for _, hint := range db.activeHints {
+		if err := w.write(checkpointActive, hint.Log.Key, hint.Log.Type, content.EncodeIndex(hint.Position)); err != nil {
+			return err
+		}
+	}
+
+	return w.write(checkpointFooter, nil, content.LogNormal, putVarints(int64(w.crc), int64(w.count)))
+}
+
+// loadIndexCheckpoint loads the memory index from the checkpoint, if it matches the blocks.
+// it returns the checkpoint, or nil if the whole index needs to be built from the blocks
+func (db *DB) loadIndexCheckpoint() (*indexCheckpoint, error) {
+	path := db.indexCheckpointPath()
+	if _, err := db.fs.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	checkpoint, err := db.readIndexCheckpoint(path)
+	if err == nil {
+		err = db.matchIndexCheckpoint(checkpoint)
+	}
+	if err != nil {
+		// the logs are read again, into a clean index
+		log.Printf("bamboo: index checkpoint: %v, rebuild the index\n", err)
+		db.index = index.NewIndexer(db.options.IndexType)
+		return nil, nil
+	}
+
+	db.blockGarbage = checkpoint.blockGarbage
+	db.spaceToCollect = 0
+	for _, garbage := range db.blockGarbage {
+		db.spaceToCollect += garbage
+	}
+	db.atomicSeq = checkpoint.atomicSeq
+	db.activeHints = checkpoint.activeHints
+	return checkpoint, nil
+}
+
+// readIndexCheckpoint reads the checkpoint, index entries are put into db.index
+func (db *DB) readIndexCheckpoint(path string) (*indexCheckpoint, error) {
+	file, err := content.NewBlockFile(path, 0, db.blockOptions(db.fileIOType()))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	checkpoint := &indexCheckpoint{
+		blockSizes:   make(map[uint32]int64),
+		blockGarbage: make(map[uint32]int64),
+	}
+	crc, count := uint32(0), 0
+	hasHeader := false
+	offset := int64(0)
+	for {
+		entry, size, err := file.ReadLog(offset)
+		if err != nil || len(entry.Key) == 0 {
+			// the footer is missing, or a log is broken
+			return nil, errCheckpointNotMatch
+		}
+		offset += size
+
+		kind, key := entry.Key[0], entry.Key[1:]
+		// the header is the first log
+		if hasHeader == (kind == checkpointHeader) {
+			return nil, errCheckpointNotMatch
+		}
+
+		switch kind {
+		case checkpointHeader:
+			values, ok := getVarints(entry.Value, 4)
+			if !ok || uint64(values[0]) != indexCheckpointVersion {
+				return nil, errCheckpointNotMatch
+			}
+			checkpoint.activeFileIndex = uint32(values[1])
+			checkpoint.writePos = values[2]
+			checkpoint.atomicSeq = uint64(values[3])
+			hasHeader = true
+		case checkpointBlock, checkpointGarbage:
+			values, ok := getVarints(entry.Value, 2)
+			if !ok {
+				return nil, errCheckpointNotMatch
+			}
+			if kind == checkpointBlock {
+				checkpoint.blockSizes[uint32(values[0])] = values[1]
+			} else {
+				checkpoint.blockGarbage[uint32(values[0])] = values[1]
+			}
+		case checkpointIndex:
+			db.index.Put(key, content.DecodeIndex(entry.Value))
+		case checkpointActive:
+			checkpoint.activeHints = append(checkpoint.activeHints, &content.TransActionLog{
+				Log:      &content.LogStruct{Key: key, Type: entry.Type},
+				Position: content.DecodeIndex(entry.Value),
+			})
+		case checkpointFooter:
+			values, ok := getVarints(entry.Value, 2)
+			if !ok || uint32(values[0]) != crc || int(values[1]) != count {
+				return nil, errCheckpointNotMatch
+			}
+			// nothing is after the footer
+			if _, _, err := file.ReadLog(offset); err != io.EOF {
+				return nil, errCheckpointNotMatch
+			}
+			return checkpoint, nil
+		default:
+			return nil, errCheckpointNotMatch
+		}
+
+		crc = checkpointCRC(file.Checksum(), crc, entry)
+		count++
+	}
+}
+
+// matchIndexCheckpoint: the blocks are the same as when the checkpoint is written,
+// except the logs appended after it
+func (db *DB) matchIndexCheckpoint(checkpoint *indexCheckpoint) error {
+	if len(db.fileList) == 0 {
+		return errCheckpointNotMatch
+	}
+
+	for _, fileIndex := range db.fileList {
+		block := db.blockFile(uint32(fileIndex))
+		recorded, ok := checkpoint.blockSizes[block.FileIndex]
+		delete(checkpoint.blockSizes, block.FileIndex)
+		// a new block after the checkpoint
+		if !ok && block.FileIndex > checkpoint.activeFileIndex {
+			continue
+		}
+
+		size, err := block.Size()
+		if err != nil {
+			return err
+		}
+		if !ok || size < recorded || (size != recorded && block.FileIndex != checkpoint.activeFileIndex) {
+			return errCheckpointNotMatch
+		}
+	}
+
+	// a block has been removed
+	if len(checkpoint.blockSizes) > 0 {
+		return errCheckpointNotMatch
+	}
+	return nil
+}
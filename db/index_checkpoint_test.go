@@ -0,0 +1,184 @@
+package db
+
+import (
+	"bamboo/content"
+	"bamboo/db/utils"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// keys 0-999 put, 0-99 deleted, 1000-1099 put in a batch
+func prepareCheckpoint(t *testing.T, opts Options) map[int][]byte {
+	db, err := CreateDB(opts)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 1000; i++ {
+		values[i] = utils.RandomValue(128)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 100; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		delete(values, i)
+	}
+	wb := db.NewAtomicWrite(DefaultWriteOptions)
+	for i := 1000; i < 1100; i++ {
+		values[i] = utils.RandomValue(128)
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), values[i]))
+	}
+	assert.Nil(t, wb.Commit())
+	assert.Greater(t, len(db.inactiveBlock), 1)
+
+	assert.Nil(t, db.Close())
+	return values
+}
+
+func checkValues(t *testing.T, db *DB, values map[int][]byte) {
+	assert.Equal(t, len(values), len(db.ListKeys()))
+	for i, value := range values {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+}
+
+func TestIndexCheckpoint(t *testing.T) {
+	for _, indexType := range []IndexType{BTree, ART} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bamboo-checkpoint-1")
+		opts.DataDir = dir
+		opts.DataSize = 64 * 1024
+		opts.IndexType = indexType
+		values := prepareCheckpoint(t, opts)
+
+		checkpointName := filepath.Join(dir, indexCheckpointName)
+		_, err := os.Stat(checkpointName)
+		assert.Nil(t, err)
+
+		// the blocks are not read: broken logs and missing hints are not found
+		fileName := content.GetBlockName(dir, 0)
+		data, err := os.ReadFile(fileName)
+		assert.Nil(t, err)
+		good := append([]byte(nil), data...)
+		data[40] ^= 0xff
+		assert.Nil(t, os.WriteFile(fileName, data, 0644))
+		assert.Nil(t, os.Remove(content.GetBlockHintName(dir, 0)))
+
+		db, err := CreateDB(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(1), db.atomicSeq)
+		checkValues(t, db, values)
+		assert.Nil(t, db.Close())
+		assert.Nil(t, os.WriteFile(fileName, good, 0644))
+
+		// same as built from the blocks
+		db, err = CreateDB(opts)
+		assert.Nil(t, err)
+		// removed once loaded
+		_, err = os.Stat(checkpointName)
+		assert.True(t, os.IsNotExist(err))
+		status := db.GetDBStatus()
+		assert.Nil(t, db.Close())
+
+		assert.Nil(t, os.Remove(checkpointName))
+		opts.IndexCheckpoint = false
+		db, err = CreateDB(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, status.BytesToCollect, db.GetDBStatus().BytesToCollect)
+		assert.Equal(t, uint64(1), db.atomicSeq)
+		destroyDB(db)
+	}
+}
+
+// logs written after the checkpoint are replayed
+func TestIndexCheckpointTail(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-checkpoint-2")
+	opts.DataDir = dir
+	opts.DataSize = 64 * 1024
+	values := prepareCheckpoint(t, opts)
+
+	// write without checkpoint, as an older version does
+	checkpointName := filepath.Join(dir, indexCheckpointName)
+	checkpoint, err := os.ReadFile(checkpointName)
+	assert.Nil(t, err)
+	opts.IndexCheckpoint = false
+	db, err := CreateDB(opts)
+	assert.Nil(t, err)
+	activeIndex := db.activeBlock.FileIndex
+	for i := 500; i < 1000; i++ {
+		values[i] = utils.RandomValue(128)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+	wb := db.NewAtomicWrite(DefaultWriteOptions)
+	for i := 1000; i < 1050; i++ {
+		assert.Nil(t, wb.Delete(utils.GetTestKey(i)))
+		delete(values, i)
+	}
+	assert.Nil(t, wb.Commit())
+	assert.Greater(t, db.activeBlock.FileIndex, activeIndex)
+	assert.Nil(t, db.Close())
+	assert.Nil(t, os.WriteFile(checkpointName, checkpoint, 0644))
+
+	opts.IndexCheckpoint = true
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	checkValues(t, db, values)
+	assert.Equal(t, uint64(2), db.atomicSeq)
+
+	// the hint of the active block has the logs from the checkpoint too
+	activeIndex = db.activeBlock.FileIndex
+	for db.activeBlock.FileIndex == activeIndex {
+		err := db.Put(utils.GetTestKey(2000), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	size, err := db.inactiveBlock[activeIndex].Size()
+	assert.Nil(t, err)
+	_, err = content.ReadBlockHint(dir, activeIndex, size, content.BlockOptions{})
+	assert.Nil(t, err)
+	destroyDB(db)
+}
+
+// a checkpoint which does not match the blocks is not used
+func TestIndexCheckpointStale(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-checkpoint-3")
+	opts.DataDir = dir
+	opts.DataSize = 64 * 1024
+	values := prepareCheckpoint(t, opts)
+
+	checkpointName := filepath.Join(dir, indexCheckpointName)
+	checkpoint, err := os.ReadFile(checkpointName)
+	assert.Nil(t, err)
+
+	// broken
+	broken := append([]byte(nil), checkpoint...)
+	broken[len(broken)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(checkpointName, broken, 0644))
+	db, err := CreateDB(opts)
+	assert.Nil(t, err)
+	checkValues(t, db, values)
+	_, err = os.Stat(checkpointName)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, db.Close())
+
+	// blocks changed by compaction
+	opts.IndexCheckpoint = false
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	err = db.Compact(CompactOptions{MaxBlocks: 1})
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+	assert.Nil(t, os.WriteFile(checkpointName, checkpoint, 0644))
+
+	db, err = CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	checkValues(t, db, values)
+}
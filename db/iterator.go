@@ -2,13 +2,16 @@ package db
 
 import (
 	"bamboo/index"
+	"time"
 )
 
 // Iterator is an interface for iterating over key-value pairs in a Bitcask database.
 type Iterator struct {
 	indexIterator index.Iterator
 	db            *DB
-	options       IteratorOptions
+	// snapshot: if set, values and expiration are read from the snapshot
+	snapshot *Snapshot
+	options  IteratorOptions
 }
 
 // NewIterator creates a new Iterator.
@@ -24,6 +27,7 @@ func (db *DB) NewIterator(options IteratorOptions) *Iterator {
 // Next moves the iterator to the next key-value pair.
 func (i *Iterator) Next() {
 	i.indexIterator.Next()
+	i.Skip()
 }
 
 // Valid returns true if the iterator is positioned at a valid key-value pair.
@@ -31,19 +35,21 @@ func (i *Iterator) Valid() bool {
 	return i.indexIterator.Valid()
 }
 
-// Skip to next key
+// Skip to next key, which matches the prefix and is not expired
 func (i *Iterator) Skip() {
 	prefixLen := len(i.options.Prefix)
-	if prefixLen == 0 {
-		return
+	now := time.Now().UnixNano()
+	if i.snapshot != nil {
+		now = i.snapshot.readTime
 	}
 
 	for i.Valid() {
 		key := i.indexIterator.Key()
-		if len(key) >= prefixLen && string(key[:prefixLen]) == string(i.options.Prefix) {
+		if !i.indexIterator.Value().IsExpired(now) &&
+			(prefixLen == 0 || len(key) >= prefixLen && string(key[:prefixLen]) == string(i.options.Prefix)) {
 			return
 		}
-		i.Next()
+		i.indexIterator.Next()
 	}
 }
 
@@ -67,9 +73,22 @@ func (i *Iterator) Key() []byte {
 // Value returns the value of the current key-value pair.
 func (i *Iterator) Value() ([]byte, error) {
 	logPos := i.indexIterator.Value()
-	i.db.muLock.RLock()
+	if i.snapshot != nil {
+		if i.snapshot.closed {
+			return nil, ErrSnapshotClosed
+		}
+		return readValue(i.snapshot, logPos)
+	}
 
+	i.db.muLock.RLock()
 	defer i.db.muLock.RUnlock()
+
+	// compaction and merge move logs after the iterator is created,
+	// the position is looked up again, the old block may be replaced
+	logPos = i.db.index.Get(i.Key())
+	if logPos == nil || logPos.IsExpired(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
 	return i.db.GetValueFormLog(logPos)
 }
 
@@ -3,78 +3,136 @@ package db
 import (
 	"bamboo/content"
 	"bamboo/db/utils"
+	"context"
 	"io"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// MergeProgress: blocks and bytes read, and the records copied or dropped
+type MergeProgress struct {
+	TotalBlocks     int
+	BlocksProcessed int
+	TotalBytes      int64
+	BytesProcessed  int64
+	LiveRecords     int64
+	DroppedRecords  int64
+}
+
 func (db *DB) Merge() error {
-	if db.activeBlock == nil {
-		return nil
+	return db.MergeWithContext(context.Background(), DefaultMergeOptions)
+}
+
+// MergeWithContext merges with a read rate limit, and reports the progress.
+// if ctx is done, the partial merge is discarded and ctx.Err() is returned
+func (db *DB) MergeWithContext(ctx context.Context, options MergeOptions) error {
+	return db.merge(ctx, db.options.MergeThreshold, options)
+}
+
+// MergeStatus returns the progress of the running merge, false if no merge is running
+func (db *DB) MergeStatus() (MergeProgress, bool) {
+	db.progressLock.Lock()
+	defer db.progressLock.Unlock()
+
+	if db.mergeProgress == nil {
+		return MergeProgress{}, false
 	}
+	return *db.mergeProgress, true
+}
 
+// merge if the ratio of space to collect reaches threshold
+func (db *DB) merge(ctx context.Context, threshold float32, options MergeOptions) error {
 	db.muLock.Lock()
 
+	if db.activeBlock == nil {
+		db.muLock.Unlock()
+		return nil
+	}
+
 	// if is merging, return
 	if db.inMergeProcess {
 		db.muLock.Unlock()
-		return ErrMergeFailed
+		return ErrMergeInProgress
 	}
 
 	// check if reach merge threshold
-	totalDirSize, err := utils.GetDirSize(db.options.DataDir)
+	totalDirSize, err := utils.GetDirSizeFrom(db.fs, db.options.DataDir)
 	if err != nil {
 		db.muLock.Unlock()
 		return err
 	}
-	curRatio := float32(db.spaceToCollect) / float32(totalDirSize)
-	if curRatio < db.options.MergeThreshold {
-		db.muLock.Unlock()
-		return ErrMergeNotReach
-	}
-
-	// check if has enough space to merge
-	availableDiskSpace, err := utils.GetAvailableDiskSpace()
+	// blob files are not merged, they are collected by CompactBlobs
+	blobSize, err := db.blobSize()
 	if err != nil {
 		db.muLock.Unlock()
 		return err
 	}
-	if uint64(totalDirSize-db.spaceToCollect) >= availableDiskSpace {
+	totalDirSize -= blobSize
+	curRatio := float32(db.spaceToCollect) / float32(totalDirSize)
+	if curRatio < threshold {
 		db.muLock.Unlock()
-		return ErrMergeSizeNotEnough
+		return ErrMergeNotReach
 	}
 
+	// check if has enough space to merge, a db in memory has no disk
+	if !db.options.InMemory {
+		availableDiskSpace, err := utils.GetAvailableDiskSpace()
+		if err != nil {
+			db.muLock.Unlock()
+			return err
+		}
+		if uint64(totalDirSize-db.spaceToCollect) >= availableDiskSpace {
+			db.muLock.Unlock()
+			return ErrMergeSizeNotEnough
+		}
+	}
+
+	// the flag is read by compaction and background merge, under the lock
 	db.inMergeProcess = true
 	defer func() {
+		db.muLock.Lock()
 		db.inMergeProcess = false
+		db.muLock.Unlock()
 	}()
 
 	// Sync active block
-	if err := db.activeBlock.Sync(); err != nil {
+	if err := db.syncActive(); err != nil {
 		db.muLock.Unlock()
 		return err
 	}
 
-	// close active block
-	db.inactiveBlock[db.activeBlock.FileIndex] = db.activeBlock
-	// open new active block
-	if err := db.setActiveBlock(); err != nil {
+	// close active block, and open new active block
+	if err := db.sealActiveBlock(); err != nil {
 		db.muLock.Unlock()
-		return nil
+		return err
 	}
 
 	exceptFileIndex := db.activeBlock.FileIndex
 
 	// get all files to merge
 	filesToMerge := make([]*content.BlockFile, 0)
+	progress := MergeProgress{}
 	for _, file := range db.inactiveBlock {
 		filesToMerge = append(filesToMerge, file)
+		size, err := file.Size()
+		if err != nil {
+			db.muLock.Unlock()
+			return err
+		}
+		progress.TotalBytes += size
 	}
+	progress.TotalBlocks = len(filesToMerge)
 	db.muLock.Unlock()
 
+	db.setMergeProgress(&progress)
+	defer db.setMergeProgress(nil)
+
 	// sort and merge
 	sort.Slice(filesToMerge, func(i, j int) bool {
 		return filesToMerge[i].FileIndex < filesToMerge[j].FileIndex
@@ -82,15 +140,20 @@ func (db *DB) Merge() error {
 
 	mergePath := db.getMergePath()
 
+	// the last merge is not installed yet
+	if db.hasMergeToInstall() {
+		return ErrMergeFailed
+	}
+
 	// if has merge dir, remove it
-	if _, err := os.Stat(mergePath); err == nil {
-		if err := os.RemoveAll(mergePath); err != nil {
+	if _, err := db.fs.Stat(mergePath); err == nil {
+		if err := db.fs.RemoveAll(mergePath); err != nil {
 			return err
 		}
 	}
 
 	// create merge dir
-	if err := os.Mkdir(mergePath, os.ModePerm); err != nil {
+	if err := db.fs.Mkdir(mergePath); err != nil {
 		return err
 	}
 
@@ -98,21 +161,55 @@ func (db *DB) Merge() error {
 	mergeOptions := db.options
 	mergeOptions.DataDir = mergePath
 	mergeOptions.SyncData = false
+	// values keep their place, pointers to blob files are copied as they are
+	mergeOptions.BlobThreshold = 0
+	mergeOptions.AutoMerge.Interval = 0
+	// its index is empty, a checkpoint of it must not be installed
+	mergeOptions.IndexCheckpoint = false
 	mergeEngine, err := CreateDB(mergeOptions)
 	if err != nil {
 		return err
 	}
 
 	// open hint file
-	hintFile, err := content.GenerateNewHintBlock(mergePath)
+	hintFile, err := content.GenerateNewHintBlockWithOptions(mergePath, db.blockOptions(db.fileIOType()))
 	if err != nil {
+		_ = mergeEngine.Close()
 		return err
 	}
 
+	// a merge without the finished tag is useless, discard it
+	finished, closed := false, false
+	closeMergeFiles := func() {
+		if !closed {
+			_ = hintFile.Close()
+			_ = mergeEngine.Close()
+			closed = true
+		}
+	}
+	defer func() {
+		closeMergeFiles()
+		if !finished {
+			_ = db.fs.RemoveAll(mergePath)
+		}
+	}()
+
+	limiter := newRateLimiter(options.BytesPerSecond)
+
+	// expired keys are not copied, so their space is collected
+	now := time.Now().UnixNano()
+	// new position of each copied key, to repoint memory index after merge
+	relocated := make(map[string]*content.LogStructIndex)
+	var expiredKeys [][]byte
+
 	// traverse all files to merge
 	for _, file := range filesToMerge {
 		offset := int64(0)
 		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
 			log, size, err := file.ReadLog(int64(offset))
 			if err != nil {
 				if err == io.EOF {
@@ -126,11 +223,21 @@ func (db *DB) Merge() error {
 			logIndexer := db.index.Get(dataKey)
 
 			// compare with memory index
-			if logIndexer != nil &&
+			current := logIndexer != nil &&
 				logIndexer.FileIndex == file.FileIndex &&
-				logIndexer.Offset == offset {
+				logIndexer.Offset == offset
+			live := current && !logIndexer.IsExpired(now)
+			if current && !live {
+				expiredKeys = append(expiredKeys, dataKey)
+			}
+			if live {
 				// clear transaction log
-				log.Key = encodeLogKeyWithSeqNo(log.Key, initialTransactionSeq)
+				log.Key = encodeLogKeyWithSeqNo(dataKey, initialTransactionSeq)
+				// a log sealed by its own nonce is larger than in a legacy block,
+				// the last id left to merged blocks takes the rest of them
+				if mergeEngine.activeBlock != nil && mergeEngine.activeBlock.FileIndex+1 >= exceptFileIndex {
+					mergeEngine.options.DataSize = math.MaxUint32
+				}
 				indexToWrite, err := mergeEngine.appendLog(log)
 				if err != nil {
 					return err
@@ -139,8 +246,29 @@ func (db *DB) Merge() error {
 				if err != nil {
 					return err
 				}
+				relocated[string(dataKey)] = indexToWrite
 			}
 			offset += size
+
+			db.updateMergeProgress(func(p *MergeProgress) {
+				p.BytesProcessed += size
+				if live {
+					p.LiveRecords++
+				} else {
+					p.DroppedRecords++
+				}
+			})
+			if err := limiter.wait(ctx, size); err != nil {
+				return err
+			}
+		}
+
+		db.updateMergeProgress(func(p *MergeProgress) {
+			p.BlocksProcessed++
+		})
+		if options.Progress != nil {
+			status, _ := db.MergeStatus()
+			options.Progress(status)
 		}
 	}
 
@@ -152,68 +280,313 @@ func (db *DB) Merge() error {
 		return err
 	}
 
+	// the last chance to cancel, the merge is installed after the finished tag
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// merged blocks are numbered from 0
+	mergedBlocks := 0
+	if mergeEngine.activeBlock != nil {
+		mergedBlocks = int(mergeEngine.activeBlock.FileIndex) + 1
+	}
+	// merged blocks take the ids of the old blocks
+	if mergedBlocks > int(exceptFileIndex) {
+		return ErrMergeFailed
+	}
+	closeMergeFiles()
+
 	// write merge finished tag
-	mergeFinishedBlock, err := content.GenerateMergeFinishedBlock(mergePath)
+	if err := db.writeMergeFinished(mergePath, exceptFileIndex, mergedBlocks); err != nil {
+		return err
+	}
+	finished = true
+
+	// if install fails, the merge dir is installed on restart
+	if err := db.installMerge(mergePath, relocated, expiredKeys); err != nil {
+		return err
+	}
+
+	// blob files are not merged, the ones sealed with a retired key are rewritten now
+	return db.compactBlobs(true)
+}
+
+// hasMergeToInstall: a finished merge failed to install, it is installed on next open
+func (db *DB) hasMergeToInstall() bool {
+	mergeFinishedName := filepath.Join(db.getMergePath(), content.MergeFinishedTag)
+	_, err := db.fs.Stat(mergeFinishedName)
+	return err == nil
+}
+
+// merge finished file:
+// 1. the exclusive block id, blocks before it are replaced by the merge
+// 2. the count of merged blocks
+// it is written to a temp file, and renamed when synced, so it is never seen half written
+func (db *DB) writeMergeFinished(mergePath string, exclusiveId uint32, mergedBlocks int) error {
+	name := filepath.Join(mergePath, content.MergeFinishedTag)
+	tempName := name + ".tmp"
+	_ = db.fs.Remove(tempName)
+
+	mergeFinishedBlock, err := content.NewBlockFile(tempName, 0, db.blockOptions(db.fileIOType()))
 	if err != nil {
 		return err
 	}
 
 	mergeLog := &content.LogStruct{
 		Key:   []byte(mergeFinishedTag),
-		Value: []byte(strconv.Itoa(int(exceptFileIndex))),
+		Value: []byte(strconv.Itoa(int(exclusiveId))),
+	}
+	countLog := &content.LogStruct{
+		Key:   []byte(mergedBlocksTag),
+		Value: []byte(strconv.Itoa(mergedBlocks)),
 	}
 
-	encodedLog, _ := content.Encoder(mergeLog)
-	if err := mergeFinishedBlock.Write(encodedLog); err != nil {
-		return err
+	for _, log := range []*content.LogStruct{mergeLog, countLog} {
+		encodedLog, _ := mergeFinishedBlock.Encode(log)
+		if err := mergeFinishedBlock.Write(encodedLog); err != nil {
+			_ = mergeFinishedBlock.Close()
+			return err
+		}
 	}
 	if err := mergeFinishedBlock.Sync(); err != nil {
+		_ = mergeFinishedBlock.Close()
+		return err
+	}
+	if err := mergeFinishedBlock.Close(); err != nil {
 		return err
 	}
+	return db.fs.Rename(tempName, name)
+}
+
+// installMerge swaps in the merged blocks while the db is open:
+// 1. files are moved into the data dir, see installMergeFiles
+// 2. old blocks are closed when no snapshot reads them
+// 3. memory index is repointed to the merged blocks, if the key has not been written during merge
+func (db *DB) installMerge(mergePath string, relocated map[string]*content.LogStructIndex, expiredKeys [][]byte) error {
+	db.muLock.Lock()
+	defer db.muLock.Unlock()
 
+	exclusiveId, mergedBlocks, err := db.installMergeFiles(mergePath)
+	if err != nil {
+		return err
+	}
+
+	// the files of old blocks are removed or replaced already
+	for fileIndex, block := range db.inactiveBlock {
+		if fileIndex < exclusiveId {
+			delete(db.inactiveBlock, fileIndex)
+			delete(db.blockGarbage, fileIndex)
+			if err := db.removeFile(block, ""); err != nil {
+				return err
+			}
+		}
+	}
+
+	for fileIndex := uint32(0); fileIndex < uint32(mergedBlocks); fileIndex++ {
+		block, err := content.OpenBlockWithOptions(db.options.DataDir, fileIndex, db.blockOptions(db.fileIOType()))
+		if err != nil {
+			return err
+		}
+		db.inactiveBlock[fileIndex] = block
+	}
+
+	for key, newPos := range relocated {
+		current := db.index.Get([]byte(key))
+		if current != nil && current.FileIndex < exclusiveId {
+			db.index.Put([]byte(key), newPos)
+		} else {
+			// written or deleted during merge, the merged log is garbage
+			db.blockGarbage[newPos.FileIndex] += int64(newPos.DiskByteUsage)
+		}
+	}
+
+	for _, key := range expiredKeys {
+		if current := db.index.Get(key); current != nil && current.FileIndex < exclusiveId {
+			db.index.Delete(key)
+			if current.Blob != nil {
+				db.blobGarbage[current.Blob.FileIndex] += int64(current.Blob.DiskByteUsage)
+			}
+		}
+	}
+
+	// garbage is left only in the merged logs above, and in blocks after merge
+	db.spaceToCollect = 0
+	for _, garbage := range db.blockGarbage {
+		db.spaceToCollect += garbage
+	}
 	return nil
 }
 
+// installMergeFiles moves a finished merge into the data dir.
+// it can run again after a crash in the middle:
+// 1. old blocks without a merged block of the same id are removed
+// 2. merged blocks and the hint file replace the files of the same name
+// 3. the merge finished file is moved at last, then the merge dir is removed
+func (db *DB) installMergeFiles(mergeDir string) (uint32, int, error) {
+	exclusiveId, mergedBlocks, err := db.readMergeFinished(mergeDir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// remove old blocks, merge of an older version does not record the count.
+	// merged blocks are loaded from the merge hint, their block hints are not used
+	for fileId := uint32(0); fileId < exclusiveId; fileId++ {
+		if err := db.removeBlockHint(fileId); err != nil {
+			return 0, 0, err
+		}
+		if int(fileId) < mergedBlocks {
+			continue
+		}
+		fileName := content.GetBlockName(db.options.DataDir, fileId)
+		if err := db.fs.Remove(fileName); err != nil && !os.IsNotExist(err) {
+			return 0, 0, err
+		}
+		db.forgetPendingPath(fileName)
+	}
+
+	childDirs, err := db.fs.ReadDir(mergeDir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// move merged blocks to data dir
+	for _, dir := range append(childDirs, nil) {
+		// the merge finished file is the last one
+		name := content.MergeFinishedTag
+		if dir != nil {
+			name = dir.Name()
+			if name == FileLockName || name == content.MergeFinishedTag || name == indexCheckpointName ||
+				strings.HasSuffix(name, content.HintSuffix) {
+				continue
+			}
+		}
+
+		srcPath := filepath.Join(mergeDir, name)
+		targetPath := filepath.Join(db.options.DataDir, name)
+		if err := db.fs.Rename(srcPath, targetPath); err != nil {
+			return 0, 0, err
+		}
+		db.forgetPendingPath(targetPath)
+	}
+
+	return exclusiveId, mergedBlocks, db.fs.RemoveAll(mergeDir)
+}
+
+func (db *DB) setMergeProgress(progress *MergeProgress) {
+	db.progressLock.Lock()
+	defer db.progressLock.Unlock()
+	db.mergeProgress = progress
+}
+
+func (db *DB) updateMergeProgress(fn func(p *MergeProgress)) {
+	db.progressLock.Lock()
+	defer db.progressLock.Unlock()
+	if db.mergeProgress != nil {
+		fn(db.mergeProgress)
+	}
+}
+
+// rateLimiter sleeps when the bytes read are ahead of bytesPerSecond
+type rateLimiter struct {
+	bytesPerSecond int64
+	start          time.Time
+	bytes          int64
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{bytesPerSecond: bytesPerSecond, start: time.Now()}
+}
+
+func (rl *rateLimiter) wait(ctx context.Context, n int64) error {
+	if rl.bytesPerSecond <= 0 {
+		return nil
+	}
+
+	rl.bytes += n
+	expected := time.Duration(float64(rl.bytes) / float64(rl.bytesPerSecond) * float64(time.Second))
+	ahead := expected - time.Since(rl.start)
+	// short sleeps are not accurate, wait until the debt is large enough
+	if ahead < 10*time.Millisecond {
+		return nil
+	}
+
+	timer := time.NewTimer(ahead)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
 func (db *DB) getMergePath() string {
-	targetPath := path.Dir(path.Clean(db.options.DataDir))
-	base := path.Base(db.options.DataDir)
+	return mergePathOf(db.options.DataDir)
+}
+
+// mergePathOf: the merge dir of the data dir, beside it
+func mergePathOf(dataDir string) string {
+	targetPath := path.Dir(path.Clean(dataDir))
+	base := path.Base(dataDir)
 	return filepath.Join(targetPath, base+mergeDirPath)
 }
 
 // getExclusiveMergeBlock
 func (db *DB) getExclusiveMergeBlockId(dir string) (uint32, error) {
-	mergeFinishedFile, err := content.GenerateMergeFinishedBlock(dir)
+	exclusiveId, _, err := db.readMergeFinished(dir)
+	return exclusiveId, err
+}
+
+// readMergeFinished returns the exclusive block id and the count of merged blocks,
+// the count is -1 if the merge finished file is written by an older version
+func (db *DB) readMergeFinished(dir string) (uint32, int, error) {
+	mergeFinishedFile, err := content.GenerateMergeFinishedBlockWithOptions(dir, db.blockOptions(db.fileIOType()))
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
+	defer mergeFinishedFile.Close()
 
-	rec, _, err := mergeFinishedFile.ReadLog(0)
+	rec, size, err := mergeFinishedFile.ReadLog(0)
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 
 	exclusiveMergeId, err := strconv.Atoi(string(rec.Value))
 	if err != nil {
-		return 0, err
+		return 0, 0, err
+	}
+
+	countRec, _, err := mergeFinishedFile.ReadLog(size)
+	if err == io.EOF {
+		return uint32(exclusiveMergeId), -1, nil
 	}
-	return uint32(exclusiveMergeId), nil
+	if err != nil {
+		return 0, 0, err
+	}
+
+	mergedBlocks, err := strconv.Atoi(string(countRec.Value))
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint32(exclusiveMergeId), mergedBlocks, nil
 }
 
 func (db *DB) getIndexFromHint() error {
 	hintName := filepath.Join(db.options.DataDir, content.HintFileTag)
 
 	// check if hint file exists
-	if _, err := os.Stat(hintName); os.IsNotExist(err) {
+	if _, err := db.fs.Stat(hintName); os.IsNotExist(err) {
 		return nil
 	}
 
 	// open hint file
-	hintFile, err := content.GenerateNewHintBlock(db.options.DataDir)
+	hintFile, err := content.GenerateNewHintBlockWithOptions(db.options.DataDir, db.blockOptions(db.fileIOType()))
 	if err != nil {
 		return err
 	}
 
 	// get indexer from hint file
+	now := time.Now().UnixNano()
 	offset := int64(0)
 	for {
 		log, size, err := hintFile.ReadLog(offset)
@@ -225,7 +598,13 @@ func (db *DB) getIndexFromHint() error {
 		}
 
 		position := content.DecodeIndex(log.Value)
-		db.index.Put(log.Key, position)
+		if db.blockFile(position.FileIndex) == nil {
+			// the block has been compacted, its live logs are in newer blocks
+		} else if position.IsExpired(now) {
+			db.addGarbage(position)
+		} else {
+			db.index.Put(log.Key, position)
+		}
 		offset += size
 	}
 
@@ -236,60 +615,18 @@ func (db *DB) getMergeBlocks() error {
 	mergeDir := db.getMergePath()
 
 	// check if merge dir exists
-	if _, err := os.Stat(mergeDir); os.IsNotExist(err) {
-		return nil
-	}
-
-	defer func() {
-		_ = os.RemoveAll(mergeDir)
-	}()
-
-	childDirs, err := os.ReadDir(mergeDir)
-	if err != nil {
-		return err
-	}
-
-	// check if merge has finished
-	var isMergeFinished = false
-	var mergeFileBlocks []string
-	for _, dir := range childDirs {
-		if dir.Name() == content.MergeFinishedTag {
-			isMergeFinished = true
-		}
-		if dir.Name() == FileLockName {
-			continue
-		}
-		mergeFileBlocks = append(mergeFileBlocks, dir.Name())
-	}
-
-	// if not finished
-	if !isMergeFinished {
+	if _, err := db.fs.Stat(mergeDir); os.IsNotExist(err) {
 		return nil
 	}
 
-	exclusiveBlockId, err := db.getExclusiveMergeBlockId(mergeDir)
-	if err != nil {
-		return err
+	// if not finished, the merge is discarded
+	mergeFinishedName := filepath.Join(mergeDir, content.MergeFinishedTag)
+	if _, err := db.fs.Stat(mergeFinishedName); os.IsNotExist(err) {
+		return db.fs.RemoveAll(mergeDir)
 	}
 
-	// remove inactive files
-	for fileId := uint32(0); fileId < exclusiveBlockId; fileId++ {
-		fileName := content.GetBlockName(db.options.DataDir, fileId)
-		if _, err := os.Stat(fileName); err == nil {
-			if err := os.Remove(fileName); err != nil {
-				return err
-			}
-		}
-	}
-
-	// move active block to merge dir
-	for _, file := range mergeFileBlocks {
-		srcPath := filepath.Join(mergeDir, file)
-		targetPath := filepath.Join(db.options.DataDir, file)
-		if err := os.Rename(srcPath, targetPath); err != nil {
-			return err
-		}
-	}
-
-	return nil
+	// an online install stopped by a crash is done here,
+	// on failure the merge dir is kept to try again on next open
+	_, _, err := db.installMergeFiles(mergeDir)
+	return err
 }
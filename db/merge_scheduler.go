@@ -0,0 +1,154 @@
+package db
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// MergeResult is the result of a background merge
+type MergeResult struct {
+	Start    time.Time
+	Duration time.Duration
+	Err      error
+}
+
+// mergeScheduler checks the db every interval, and merges when:
+// 1. now is in the merge window
+// 2. there are enough sealed blocks
+// 3. the ratio of space to collect reaches AutoMerge.Ratio, merge recomputes it from the garbage left.
+// a failed merge is logged and kept as the last result, and retried after a growing delay
+type mergeScheduler struct {
+	db      *DB
+	options AutoMergeOptions
+	// cancel the running merge on stop
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	resultLock *sync.Mutex
+	lastResult *MergeResult
+	// failures in a row, no merge is tried before retryAt
+	failures int
+	retryAt  time.Time
+}
+
+func newMergeScheduler(db *DB) *mergeScheduler {
+	ctx, cancel := context.WithCancel(context.Background())
+	ms := &mergeScheduler{
+		db:         db,
+		options:    db.options.AutoMerge,
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+		resultLock: new(sync.Mutex),
+	}
+	go ms.run()
+	return ms
+}
+
+func (ms *mergeScheduler) run() {
+	defer close(ms.done)
+
+	ticker := time.NewTicker(ms.options.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ms.ctx.Done():
+			return
+		case now := <-ticker.C:
+			ms.tryMerge(now)
+		}
+	}
+}
+
+// tryMerge returns false if the merge is skipped, nothing has run then
+func (ms *mergeScheduler) tryMerge(now time.Time) bool {
+	if !inMergeWindow(now, ms.options.WindowStart, ms.options.WindowEnd) || now.Before(ms.retryAt) {
+		return false
+	}
+
+	ms.db.muLock.RLock()
+	sealedBlocks := len(ms.db.inactiveBlock)
+	ms.db.muLock.RUnlock()
+	if sealedBlocks < ms.options.MinSealedBlocks {
+		return false
+	}
+
+	start := time.Now()
+	err := ms.db.merge(ms.ctx, ms.options.Ratio, DefaultMergeOptions)
+	// not reach the ratio, merged or compacted by someone else, or stopped: nothing has run
+	if err == ErrMergeNotReach || err == ErrMergeInProgress || err == context.Canceled {
+		return false
+	}
+
+	if err != nil {
+		ms.failures++
+		ms.retryAt = now.Add(ms.retryDelay())
+		log.Printf("bamboo: background merge: %v, retry after %v\n", err, ms.retryAt.Sub(now))
+	} else {
+		ms.failures = 0
+		ms.retryAt = time.Time{}
+	}
+
+	ms.resultLock.Lock()
+	ms.lastResult = &MergeResult{
+		Start:    start,
+		Duration: time.Since(start),
+		Err:      err,
+	}
+	ms.resultLock.Unlock()
+	return true
+}
+
+// retryDelay: the interval, doubled for each failure in a row, at most maxMergeRetryDelay
+func (ms *mergeScheduler) retryDelay() time.Duration {
+	delay := ms.options.Interval
+	for i := 1; i < ms.failures && delay < maxMergeRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxMergeRetryDelay {
+		delay = maxMergeRetryDelay
+	}
+	return delay
+}
+
+// stop the scheduler, the running merge is cancelled
+func (ms *mergeScheduler) stop() {
+	ms.cancel()
+	<-ms.done
+}
+
+// [start, end) from local midnight, the window crosses midnight if start > end
+func inMergeWindow(now time.Time, start, end time.Duration) bool {
+	if start == end {
+		return true
+	}
+
+	year, month, day := now.Date()
+	offset := now.Sub(time.Date(year, month, day, 0, 0, 0, 0, now.Location()))
+	if start < end {
+		return offset >= start && offset < end
+	}
+	return offset >= start || offset < end
+}
+
+// LastMergeResult returns the result of the last background merge, a failure is kept in Err.
+// nil if background merge is disabled or has not run yet
+func (db *DB) LastMergeResult() *MergeResult {
+	if db.mergeScheduler == nil {
+		return nil
+	}
+
+	ms := db.mergeScheduler
+	ms.resultLock.Lock()
+	defer ms.resultLock.Unlock()
+
+	if ms.lastResult == nil {
+		return nil
+	}
+	result := *ms.lastResult
+	return &result
+}
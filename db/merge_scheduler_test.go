@@ -0,0 +1,192 @@
+package db
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"bamboo/db/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a scheduler which is not run by a ticker, the test decides when it checks the db
+func newIdleMergeScheduler(db *DB, options AutoMergeOptions) *mergeScheduler {
+	return &mergeScheduler{
+		db:         db,
+		options:    options,
+		ctx:        context.Background(),
+		resultLock: new(sync.Mutex),
+	}
+}
+
+func TestAutoMerge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-auto-merge-1")
+	opts.DataDir = dir
+	opts.DataSize = 1024 * 1024
+	opts.AutoMerge.Interval = 0
+	db, err := CreateDB(opts)
+	defer func() { destroyDB(db) }()
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	ms := newIdleMergeScheduler(db, AutoMergeOptions{
+		Interval:        10 * time.Millisecond,
+		Ratio:           0,
+		MinSealedBlocks: 2,
+	})
+	// too few sealed blocks
+	for i := 0; i < 1500; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 1, len(db.inactiveBlock))
+	assert.False(t, ms.tryMerge(time.Now()))
+	assert.Nil(t, ms.lastResult)
+
+	ms.options.Ratio = 0.3
+	for i := 1500; i < 5000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+	// not reach the ratio
+	assert.False(t, ms.tryMerge(time.Now()))
+	assert.Nil(t, ms.lastResult)
+
+	for i := 0; i < 4000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.True(t, ms.tryMerge(time.Now()))
+	if assert.NotNil(t, ms.lastResult) {
+		assert.Nil(t, ms.lastResult.Err)
+	}
+	assert.Equal(t, 1000, len(db.ListKeys()))
+
+	// in background
+	err = db.Close()
+	assert.Nil(t, err)
+	opts.AutoMerge = ms.options
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	for n := 0; n < 4; n++ {
+		for i := 4000; i < 5000; i++ {
+			err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+			assert.Nil(t, err)
+		}
+	}
+
+	var result *MergeResult
+	for i := 0; i < 200 && result == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		result = db.LastMergeResult()
+	}
+	assert.NotNil(t, result)
+	assert.Nil(t, result.Err)
+	assert.Greater(t, result.Duration, time.Duration(0))
+
+	// stop on close, the merged blocks are used on restart
+	err = db.Close()
+	assert.Nil(t, err)
+	opts.AutoMerge.Interval = 0
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(db.ListKeys()))
+	assert.Nil(t, db.LastMergeResult())
+}
+
+func TestAutoMergeWindow(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-auto-merge-2")
+	opts.DataDir = dir
+	opts.DataSize = 1024 * 1024
+	opts.AutoMerge.Interval = 0
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+
+	// a window from 2:00 to 4:00
+	ms := newIdleMergeScheduler(db, AutoMergeOptions{
+		Interval:    10 * time.Millisecond,
+		WindowStart: 2 * time.Hour,
+		WindowEnd:   4 * time.Hour,
+	})
+	at := func(hour int) time.Time {
+		return time.Date(2024, 1, 1, hour, 30, 0, 0, time.Local)
+	}
+	assert.False(t, ms.tryMerge(at(5)))
+	assert.Nil(t, ms.lastResult)
+
+	assert.True(t, ms.tryMerge(at(3)))
+	if assert.NotNil(t, ms.lastResult) {
+		assert.Nil(t, ms.lastResult.Err)
+	}
+	assert.Equal(t, 2000, len(db.ListKeys()))
+}
+
+func TestAutoMergeFailure(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-auto-merge-3")
+	opts.DataDir = dir
+	opts.DataSize = 1024 * 1024
+	opts.AutoMerge.Interval = 10 * time.Millisecond
+	opts.AutoMerge.Ratio = 0
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// a finished merge which is not installed, every merge fails
+	err = os.MkdirAll(db.getMergePath(), os.ModePerm)
+	assert.Nil(t, err)
+	err = os.WriteFile(filepath.Join(db.getMergePath(), mergeFinishedTag), nil, 0644)
+	assert.Nil(t, err)
+
+	for i := 0; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+
+	var result *MergeResult
+	for i := 0; i < 200 && result == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+		result = db.LastMergeResult()
+	}
+	assert.NotNil(t, result)
+	assert.Equal(t, ErrMergeFailed, result.Err)
+
+	ms := &mergeScheduler{options: opts.AutoMerge}
+	ms.failures = 1
+	assert.Equal(t, 10*time.Millisecond, ms.retryDelay())
+	ms.failures = 3
+	assert.Equal(t, 40*time.Millisecond, ms.retryDelay())
+	ms.failures = 100
+	assert.Equal(t, maxMergeRetryDelay, ms.retryDelay())
+
+	err = os.RemoveAll(db.getMergePath())
+	assert.Nil(t, err)
+}
+
+func TestInMergeWindow(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2024, 1, 1, hour, 30, 0, 0, time.Local)
+	}
+
+	assert.True(t, inMergeWindow(at(3), 0, 0))
+	assert.True(t, inMergeWindow(at(3), 2*time.Hour, 4*time.Hour))
+	assert.False(t, inMergeWindow(at(5), 2*time.Hour, 4*time.Hour))
+	// crosses midnight
+	assert.True(t, inMergeWindow(at(23), 22*time.Hour, 2*time.Hour))
+	assert.True(t, inMergeWindow(at(1), 22*time.Hour, 2*time.Hour))
+	assert.False(t, inMergeWindow(at(12), 22*time.Hour, 2*time.Hour))
+}
@@ -2,9 +2,11 @@ package db
 
 import (
 	"bamboo/db/utils"
+	"context"
 	"os"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -202,3 +204,249 @@ func TestMergeInProcess(t *testing.T) {
 		assert.NotNil(t, val)
 	}
 }
+
+func TestMergeWithContext(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-merge-6")
+	opts.DataSize = 1024 * 1024
+	opts.MergeThreshold = 0
+	opts.DataDir = dir
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 5000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 2000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	var calls []MergeProgress
+	err = db.MergeWithContext(context.Background(), MergeOptions{
+		BytesPerSecond: 50 * 1024 * 1024,
+		Progress: func(progress MergeProgress) {
+			calls = append(calls, progress)
+		},
+	})
+	assert.Nil(t, err)
+
+	last := calls[len(calls)-1]
+	assert.Equal(t, last.TotalBlocks, len(calls))
+	assert.Equal(t, last.TotalBlocks, last.BlocksProcessed)
+	assert.Equal(t, last.TotalBytes, last.BytesProcessed)
+	assert.Equal(t, int64(3000), last.LiveRecords)
+	assert.Equal(t, int64(4000), last.DroppedRecords)
+	_, running := db.MergeStatus()
+	assert.False(t, running)
+}
+
+func TestMergeCancel(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-merge-7")
+	opts.DataSize = 1024 * 1024
+	opts.MergeThreshold = 0
+	opts.DataDir = dir
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 5000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+
+	// 1MB/s for 5MB: cancelled long before it finishes
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- db.MergeWithContext(ctx, MergeOptions{BytesPerSecond: 1024 * 1024})
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	progress, running := db.MergeStatus()
+	assert.True(t, running)
+	assert.Greater(t, progress.BytesProcessed, int64(0))
+	assert.Less(t, progress.BytesProcessed, progress.TotalBytes/2)
+
+	start := time.Now()
+	cancel()
+	err = <-done
+	assert.Equal(t, context.Canceled, err)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// partial work is discarded
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	_, running = db.MergeStatus()
+	assert.False(t, running)
+
+	// merge again
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 5000, len(db.ListKeys()))
+}
+
+// merge result is used without restart
+func TestMergeOnline(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-merge-8")
+	opts.DataSize = 1024 * 1024
+	opts.MergeThreshold = 0
+	opts.DataDir = dir
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 5000; i++ {
+		values[i] = utils.RandomValue(1024)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 4000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	before := db.GetDBStatus()
+	blocksBefore := len(blockFiles(dir))
+	snap := db.Snapshot()
+
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	// old blocks are gone, the garbage is collected
+	after := db.GetDBStatus()
+	assert.Less(t, len(blockFiles(dir)), blocksBefore)
+	assert.Less(t, after.DiskUsage, before.DiskUsage)
+	assert.Equal(t, int64(0), after.BytesToCollect)
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Equal(t, 1000, len(db.ListKeys()))
+	for i := 4000; i < 5000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], val)
+	}
+
+	// snapshot taken before merge reads the old blocks
+	val, err := snap.Get(utils.GetTestKey(4999))
+	assert.Nil(t, err)
+	assert.Equal(t, values[4999], val)
+	_, err = snap.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, snap.Close())
+
+	// write and merge again
+	for i := 4000; i < 4500; i++ {
+		values[i] = utils.RandomValue(1024)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), db.GetDBStatus().BytesToCollect)
+
+	iterator := db.NewIterator(DefaultIteratorOptions)
+	count := 0
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		val, err := iterator.Value()
+		assert.Nil(t, err)
+		assert.NotNil(t, val)
+		count++
+	}
+	iterator.Close()
+	assert.Equal(t, 1000, count)
+
+	// restart check
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(db.ListKeys()))
+	for i := 4000; i < 5000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], val)
+	}
+}
+
+// keys written during merge are not overwritten by the merged logs
+func TestMergeOnlineWrite(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-merge-9")
+	opts.DataSize = 1024 * 1024
+	opts.MergeThreshold = 0
+	opts.DataDir = dir
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 5000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- db.MergeWithContext(context.Background(), MergeOptions{BytesPerSecond: 5 * 1024 * 1024})
+	}()
+
+	// the first keys have been copied by merge
+	for {
+		progress, _ := db.MergeStatus()
+		if progress.BlocksProcessed >= 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	values := make(map[int][]byte)
+	for i := 0; i < 1000; i++ {
+		values[i] = utils.RandomValue(128)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+	for i := 1000; i < 2000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, <-done)
+
+	check := func(db *DB) {
+		assert.Equal(t, 4000, len(db.ListKeys()))
+		for i := 0; i < 1000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, values[i], val)
+		}
+		for i := 1000; i < 2000; i++ {
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+		for i := 2000; i < 5000; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.NotNil(t, val)
+		}
+	}
+	check(db)
+
+	// restart check
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	check(db)
+}
@@ -0,0 +1,96 @@
+package db
+
+import (
+	"bamboo/content"
+	"bamboo/diskIO"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Migrate rewrites the files of the closed db in dir as the format version.
+// only the headers change, so a db can be moved back to an older version the same way.
+// ErrDBIsUsing if the db is open, and content.ErrBlockVersion, with no file changed,
+// if a file can not be written in version
+func Migrate(dir string, version content.FormatVersion) error {
+	fs := diskIO.OS
+	if _, err := fs.Stat(dir); err != nil {
+		return err
+	}
+
+	fLock, isLocked, err := fs.TryLock(filepath.Join(dir, FileLockName))
+	if err != nil {
+		return err
+	}
+	if !isLocked {
+		return ErrDBIsUsing
+	}
+	defer fLock.Unlock()
+
+	// the files of an unfinished merge are in its own dir
+	dirs := []string{dir, mergePathOf(dir)}
+	files := make(map[string][]string)
+	for _, next := range dirs {
+		names, err := blockFormatFiles(fs, next)
+		if err != nil {
+			return err
+		}
+		files[next] = names
+	}
+
+	// check all files first, so a db is not left in two versions
+	for _, names := range files {
+		for _, name := range names {
+			if err := content.CheckBlockMigration(fs, name, version); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, next := range dirs {
+		changed := false
+		for _, name := range files[next] {
+			migrated, err := content.MigrateBlockFile(fs, name, version)
+			if err != nil {
+				return err
+			}
+			changed = changed || migrated
+		}
+		if changed {
+			if err := fs.SyncDir(next); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// blockFormatFiles: paths of the files in dir written by content.BlockFile
+func blockFormatFiles(fs diskIO.FileSystem, dir string) ([]string, error) {
+	entries, err := fs.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && isBlockFormatFile(entry.Name()) {
+			names = append(names, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return names, nil
+}
+
+// isBlockFormatFile: the file is written by content.BlockFile
+func isBlockFormatFile(name string) bool {
+	switch name {
+	case content.HintFileTag, mergeFinishedTag, indexCheckpointName:
+		return true
+	}
+	return strings.HasSuffix(name, content.Suffix) ||
+		strings.HasSuffix(name, content.BlobSuffix) ||
+		strings.HasSuffix(name, content.HintSuffix)
+}
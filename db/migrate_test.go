@@ -0,0 +1,101 @@
+package db
+
+import (
+	"bamboo/content"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bamboo/db/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the format version of every block format file in dir
+func formatVersions(t *testing.T, dir string) map[content.FormatVersion]int {
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	versions := make(map[content.FormatVersion]int)
+	for _, entry := range entries {
+		if !isBlockFormatFile(entry.Name()) {
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		assert.Nil(t, err)
+		if bytes.HasPrefix(raw, []byte("BTBK")) {
+			versions[content.FormatV1]++
+		} else {
+			versions[content.FormatLegacy]++
+		}
+	}
+	return versions
+}
+
+func TestMigrate(t *testing.T) {
+	for _, keyProvider := range []content.KeyProvider{nil, content.NewStaticKeyProvider(1, map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)})} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bamboo-migrate")
+		opts.DataDir = dir
+		opts.DataSize = 64 * 1024
+		opts.MergeThreshold = 0
+		opts.BlobThreshold = 512
+		opts.KeyProvider = keyProvider
+		db, err := CreateDB(opts)
+		assert.Nil(t, err)
+
+		values := make(map[int][]byte)
+		for i := 0; i < 2000; i++ {
+			values[i] = utils.RandomValue(64 + i%3*300)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+		}
+		for i := 0; i < 500; i++ {
+			assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+			delete(values, i)
+		}
+		assert.Nil(t, db.Merge())
+
+		// an open db can not be migrated
+		assert.Equal(t, ErrDBIsUsing, Migrate(dir, content.FormatLegacy))
+		assert.Nil(t, db.Close())
+		assert.Equal(t, 0, formatVersions(t, dir)[content.FormatLegacy])
+
+		checkValues := func() {
+			db, err := CreateDB(opts)
+			if !assert.Nil(t, err) {
+				return
+			}
+			for i := 0; i < 2000; i++ {
+				value, err := db.Get(utils.GetTestKey(i))
+				if _, ok := values[i]; !ok {
+					assert.Equal(t, ErrKeyNotFound, err)
+					continue
+				}
+				assert.Nil(t, err)
+				assert.Equal(t, values[i], value)
+			}
+			assert.Nil(t, db.Close())
+		}
+
+		// down to the legacy format and back. logs of new encrypted blocks have
+		// their own nonces, which the legacy format can not hold: nothing is changed
+		if keyProvider == nil {
+			assert.Nil(t, Migrate(dir, content.FormatLegacy))
+			assert.Equal(t, 0, formatVersions(t, dir)[content.FormatV1])
+		} else {
+			assert.Equal(t, content.ErrBlockVersion, Migrate(dir, content.FormatLegacy))
+			assert.Equal(t, 0, formatVersions(t, dir)[content.FormatLegacy])
+		}
+		checkValues()
+
+		assert.Nil(t, Migrate(dir, content.FormatV1))
+		assert.Equal(t, 0, formatVersions(t, dir)[content.FormatLegacy])
+		checkValues()
+
+		// a migrated db goes on
+		db, err = CreateDB(opts)
+		assert.Nil(t, err)
+		assert.Nil(t, db.Put([]byte("after-migrate"), []byte("value")))
+		destroyDB(db)
+	}
+}
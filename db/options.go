@@ -1,6 +1,11 @@
 package db
 
-import "os"
+import (
+	"bamboo/content"
+	"bamboo/diskIO"
+	"os"
+	"time"
+)
 
 type Options struct {
 	DataDir        string
@@ -10,6 +15,63 @@ type Options struct {
 	IndexType      IndexType
 	QuickStart     bool
 	MergeThreshold float32
+	// DisableGroupCommit: with SyncData on, every write syncs by itself under the db lock
+	DisableGroupCommit bool
+	// RecoverActiveBlock: truncate a torn tail of the active block on startup
+	RecoverActiveBlock bool
+	// CorruptionPolicy: what to do with a corrupted log in a sealed block
+	CorruptionPolicy CorruptionPolicy
+	// Compression: codec of values, a value is stored raw if it does not shrink
+	Compression CompressionType
+	// KeyProvider: if set, blocks, hint and merge files are encrypted with AES-GCM.
+	// new files use its current key, Merge rewrites old blocks and blob files with it
+	KeyProvider content.KeyProvider
+	// BlobThreshold: values not smaller than it are stored in blob files, 0 means never
+	BlobThreshold uint32
+	// BlobGCRatio: a sealed blob file is compacted when its unused ratio reaches it
+	BlobGCRatio float32
+	// AutoMerge: merge in background
+	AutoMerge AutoMergeOptions
+	// IndexCheckpoint: dump the memory index on Close, so the next open needs not read the blocks
+	IndexCheckpoint bool
+	// OpenWorkers: goroutines reading blocks on open, 0 means one per cpu
+	OpenWorkers int
+	// MMapWrite: read and write blocks through mmap, the active block is preallocated to DataSize
+	MMapWrite bool
+	// BufferedWrite: appends to the active block are buffered in memory
+	BufferedWrite BufferedWriteOptions
+	// InMemory: all files are kept in diskIO.Memory, they live until the process exits.
+	// DataDir names the db in memory, the db can be closed and opened again by it
+	InMemory bool
+	// Checksum: the crc algorithm of logs in new files, files written with another one are still read
+	Checksum ChecksumType
+
+	// faults: if set, every file of the db is written through it, for crash tests
+	faults *diskIO.FaultInjector
+	// legacyFormat: new blocks are written in the legacy format, as older versions did, for tests
+	legacyFormat bool
+}
+
+type BufferedWriteOptions struct {
+	// BufferSize: bytes buffered before they are written, 0 disables buffered write
+	BufferSize int
+	// FlushInterval: buffered bytes are written at most so long after Put, 0 means only when full or synced
+	FlushInterval time.Duration
+	// SyncOnFlush: fsync after the background flush
+	SyncOnFlush bool
+}
+
+type AutoMergeOptions struct {
+	// Interval: how often to check if a merge is needed, 0 disables background merge
+	Interval time.Duration
+	// Ratio: merge when the ratio of space to collect reaches it
+	Ratio float32
+	// WindowStart, WindowEnd: offset from local midnight, merge only in [start, end).
+	// start > end means the window crosses midnight, start == end means any time
+	WindowStart time.Duration
+	WindowEnd   time.Duration
+	// MinSealedBlocks: merge only if there are at least so many sealed blocks
+	MinSealedBlocks int
 }
 
 type IteratorOptions struct {
@@ -24,6 +86,31 @@ const (
 	ART   IndexType = 1
 )
 
+type CorruptionPolicy = int8
+
+const (
+	// CorruptionFail: CreateDB returns the error
+	CorruptionFail CorruptionPolicy = 0
+	// CorruptionSkip: skip the corrupted log, or the rest of the block if the log size is unknown
+	CorruptionSkip CorruptionPolicy = 1
+	// CorruptionQuarantine: move the whole block aside, none of its logs is loaded
+	CorruptionQuarantine CorruptionPolicy = 2
+)
+
+type ChecksumType = content.ChecksumType
+
+const (
+	ChecksumIEEE       ChecksumType = content.ChecksumIEEE
+	ChecksumCastagnoli ChecksumType = content.ChecksumCastagnoli
+)
+
+type CompressionType = content.CompressionType
+
+const (
+	NoCompression    CompressionType = content.NoCompression
+	FlateCompression CompressionType = content.FlateCompression
+)
+
 var DefaultOptions = Options{
 	DataDir:        os.TempDir(),
 	DataSize:       256 * 1024 * 1024,
@@ -32,6 +119,51 @@ var DefaultOptions = Options{
 	QuickStart:     true,
 	SyncThreshold:  1024,
 	MergeThreshold: 0.5,
+
+	RecoverActiveBlock: true,
+	CorruptionPolicy:   CorruptionFail,
+	Compression:        NoCompression,
+	BlobThreshold:      0,
+	BlobGCRatio:        0.5,
+	AutoMerge: AutoMergeOptions{
+		Interval:        0,
+		Ratio:           0.5,
+		MinSealedBlocks: 1,
+	},
+	IndexCheckpoint: true,
+	OpenWorkers:     0,
+	MMapWrite:       false,
+	BufferedWrite: BufferedWriteOptions{
+		BufferSize:    0,
+		FlushInterval: 0,
+		SyncOnFlush:   false,
+	},
+	InMemory: false,
+	Checksum: ChecksumIEEE,
+}
+
+type CompactOptions struct {
+	// MaxBlocks: compact at most so many blocks in one run, 0 means no limit
+	MaxBlocks int
+	// MinGarbageRatio: only blocks whose garbage ratio reaches it are compacted
+	MinGarbageRatio float32
+}
+
+var DefaultCompactOptions = CompactOptions{
+	MaxBlocks:       4,
+	MinGarbageRatio: 0.5,
+}
+
+type MergeOptions struct {
+	// BytesPerSecond: limit of bytes read from blocks, 0 means no limit
+	BytesPerSecond int64
+	// Progress: called after each block is merged
+	Progress func(progress MergeProgress)
+}
+
+var DefaultMergeOptions = MergeOptions{
+	BytesPerSecond: 0,
+	Progress:       nil,
 }
 
 var DefaultIteratorOptions = IteratorOptions{
@@ -0,0 +1,287 @@
+package db
+
+import (
+	"bamboo/content"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// readBlockLogs reads all logs of a block in order, values are dropped to save memory.
+// a preallocated zero tail of the active or the last sealed block, left by a crash, is trimmed.
+// a corrupted active block is truncated to its last valid log (if RecoverActiveBlock),
+// a corrupted sealed block is handled by CorruptionPolicy.
+// if the block is quarantined, no log is returned.
+func (db *DB) readBlockLogs(block *content.BlockFile, offset int64, isActive bool) ([]*content.TransActionLog, error) {
+	fileSize, err := block.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	var blockLogs []*content.TransActionLog
+	for {
+		rec, size, err := block.ReadLog(offset)
+		if err == nil {
+			var blobPointer *content.BlobPointer
+			if rec.Blob {
+				blobPointer, _ = content.DecodeBlobPointer(rec.Value)
+			}
+
+			rec.Value = nil
+			blockLogs = append(blockLogs, &content.TransActionLog{
+				Log: rec,
+				Position: &content.LogStructIndex{
+					FileIndex:     block.FileIndex,
+					Offset:        offset,
+					DiskByteUsage: uint32(size),
+					Expire:        rec.Expire,
+					Blob:          blobPointer,
+				},
+			})
+			offset += size
+			continue
+		}
+
+		// reach the end of valid logs, but some bytes are left
+		if err == io.EOF {
+			if offset >= fileSize {
+				break
+			}
+
+			zero, zeroErr := isZeroTail(block, offset, fileSize)
+			if zeroErr != nil {
+				return nil, zeroErr
+			}
+			if zero && (isActive || db.isLastSealed(block)) {
+				log.Printf("bamboo: block %d: trim %d preallocated bytes at offset %d\n",
+					block.FileIndex, fileSize-offset, offset)
+				if err := block.Truncate(offset); err != nil {
+					return nil, err
+				}
+				break
+			}
+			err = io.ErrUnexpectedEOF
+		}
+
+		if isActive {
+			if !db.options.RecoverActiveBlock {
+				return nil, err
+			}
+
+			// torn write: drop everything after the last valid log
+			log.Printf("bamboo: block %d: %v at offset %d, truncate %d bytes\n",
+				block.FileIndex, err, offset, fileSize-offset)
+			if err := block.Truncate(offset); err != nil {
+				return nil, err
+			}
+			break
+		}
+
+		switch db.options.CorruptionPolicy {
+		case CorruptionSkip:
+			// broken or undecryptable log with known size
+			if size > 0 {
+				log.Printf("bamboo: block %d: %v at offset %d, skip %d bytes\n",
+					block.FileIndex, err, offset, size)
+				offset += size
+				continue
+			}
+
+			// the size of log is unknown, skip the rest of the block
+			log.Printf("bamboo: block %d: %v at offset %d, skip the last %d bytes\n",
+				block.FileIndex, err, offset, fileSize-offset)
+			return blockLogs, nil
+
+		case CorruptionQuarantine:
+			log.Printf("bamboo: block %d: %v at offset %d, quarantine the block\n",
+				block.FileIndex, err, offset)
+			return nil, db.quarantineBlock(block)
+
+		default:
+			return nil, err
+		}
+	}
+
+	if isActive {
+		block.WritePos = offset
+	}
+	return blockLogs, nil
+}
+
+// isZeroTail: the bytes of block from offset to size are all zero
+func isZeroTail(block *content.BlockFile, offset, size int64) (bool, error) {
+	const chunkSize = 64 * 1024
+	for offset < size {
+		n := size - offset
+		if n > chunkSize {
+			n = chunkSize
+		}
+		data, err := block.ReadBytes(offset, n)
+		if err != nil {
+			return false, err
+		}
+		for _, b := range data {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		offset += n
+	}
+	return true, nil
+}
+
+// isLastSealed: the block is sealed just before the active block,
+// a crash may leave its tail untrimmed, if it is sealed by an older version
+func (db *DB) isLastSealed(block *content.BlockFile) bool {
+	return db.activeBlock != nil && block.FileIndex+1 == db.activeBlock.FileIndex
+}
+
+// quarantineBlock moves a sealed block aside, so it will not be loaded again
+func (db *DB) quarantineBlock(block *content.BlockFile) error {
+	if err := block.Close(); err != nil {
+		return err
+	}
+	// blocks are read in parallel on open
+	db.muLock.Lock()
+	delete(db.inactiveBlock, block.FileIndex)
+	db.muLock.Unlock()
+	if err := db.removeBlockHint(block.FileIndex); err != nil {
+		return err
+	}
+
+	fileName := content.GetBlockName(db.options.DataDir, block.FileIndex)
+	return db.fs.Rename(fileName, fileName+quarantineSuffix)
+}
+
+// readSealedBlockLogs reads the logs of a sealed block from its hint,
+// if the hint is missing or broken, the block is read, and the hint is written again
+func (db *DB) readSealedBlockLogs(block *content.BlockFile) ([]*content.TransActionLog, error) {
+	size, err := block.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	blockLogs, err := content.ReadBlockHint(db.options.DataDir, block.FileIndex, size, db.blockOptions(db.fileIOType()))
+	if err == nil {
+		return blockLogs, nil
+	}
+	if !os.IsNotExist(err) {
+		log.Printf("bamboo: block %d: hint: %v, read the block\n", block.FileIndex, err)
+	}
+
+	blockLogs, err = db.readBlockLogs(block, 0, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// quarantined, or some logs are skipped: the block is read on every open
+	readSize := int64(0)
+	for _, blockLog := range blockLogs {
+		readSize += int64(blockLog.Position.DiskByteUsage)
+	}
+	db.muLock.RLock()
+	_, ok := db.inactiveBlock[block.FileIndex]
+	db.muLock.RUnlock()
+	if !ok || readSize != size {
+		return blockLogs, nil
+	}
+	return blockLogs, content.WriteBlockHint(db.options.DataDir, block.FileIndex, size, blockLogs, db.blockOptions(db.fileIOType()))
+}
+
+// logsFrom: the logs at or after offset
+func logsFrom(blockLogs []*content.TransActionLog, offset int64) []*content.TransActionLog {
+	for i, blockLog := range blockLogs {
+		if blockLog.Position.Offset >= offset {
+			return blockLogs[i:]
+		}
+	}
+	return nil
+}
+
+// blockRead: a block to read on open, from offset
+type blockRead struct {
+	block    *content.BlockFile
+	offset   int64
+	isActive bool
+}
+
+type blockReadResult struct {
+	logs []*content.TransActionLog
+	err  error
+}
+
+// blockReader reads blocks by OpenWorkers goroutines, and returns the results in order.
+// a worker is free again only after its result is taken, so at most OpenWorkers blocks are in memory
+type blockReader struct {
+	results []chan *blockReadResult
+	next    int
+	tokens  chan struct{}
+	done    chan struct{}
+	wg      *sync.WaitGroup
+}
+
+func (db *DB) newBlockReader(reads []*blockRead) *blockReader {
+	workers := db.options.OpenWorkers
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+
+	reader := &blockReader{
+		results: make([]chan *blockReadResult, len(reads)),
+		tokens:  make(chan struct{}, workers),
+		done:    make(chan struct{}),
+		wg:      new(sync.WaitGroup),
+	}
+	for i := range reader.results {
+		reader.results[i] = make(chan *blockReadResult, 1)
+	}
+
+	reader.wg.Add(1)
+	go func() {
+		defer reader.wg.Done()
+		for i, read := range reads {
+			select {
+			case reader.tokens <- struct{}{}:
+			case <-reader.done:
+				return
+			}
+
+			reader.wg.Add(1)
+			go func(result chan *blockReadResult, read *blockRead) {
+				defer reader.wg.Done()
+				logs, err := db.readBlock(read)
+				result <- &blockReadResult{logs: logs, err: err}
+			}(reader.results[i], read)
+		}
+	}()
+	return reader
+}
+
+// take the result of the next block
+func (reader *blockReader) take() *blockReadResult {
+	result := <-reader.results[reader.next]
+	reader.next++
+	<-reader.tokens
+	return result
+}
+
+// stop starting new reads, and wait for the running ones
+func (reader *blockReader) stop() {
+	close(reader.done)
+	reader.wg.Wait()
+}
+
+// readBlock: the active block is read from offset, a sealed block may be read from its hint
+func (db *DB) readBlock(read *blockRead) ([]*content.TransActionLog, error) {
+	if read.isActive {
+		return db.readBlockLogs(read.block, read.offset, true)
+	}
+
+	blockLogs, err := db.readSealedBlockLogs(read.block)
+	if err != nil {
+		return nil, err
+	}
+	return logsFrom(blockLogs, read.offset), nil
+}
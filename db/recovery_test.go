@@ -0,0 +1,300 @@
+package db
+
+import (
+	"bamboo/content"
+	"bamboo/diskIO"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bamboo/db/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// write 1000 keys into blocks of 64KB, and close the db
+func prepareBlocks(t *testing.T, opts Options) {
+	db, err := CreateDB(opts)
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	assert.Greater(t, len(db.inactiveBlock), 1)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestRecoverTornTail(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-recovery-1")
+	opts.DataDir = dir
+	opts.DataSize = 64 * 1024
+	prepareBlocks(t, opts)
+
+	// append half of a log to the active block
+	db, err := CreateDB(opts)
+	assert.Nil(t, err)
+	activeName := content.GetBlockName(dir, db.activeBlock.FileIndex)
+	validSize := db.activeBlock.WritePos
+	err = db.Close()
+	assert.Nil(t, err)
+
+	encoded, _ := content.Encoder(&content.LogStruct{
+		Key:   encodeLogKeyWithSeqNo(utils.GetTestKey(2000), initialTransactionSeq),
+		Value: utils.RandomValue(128),
+	})
+	fd, err := os.OpenFile(activeName, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = fd.Write(encoded[:len(encoded)/2])
+	assert.Nil(t, err)
+	assert.Nil(t, fd.Close())
+
+	// recovery off: can not open
+	opts.RecoverActiveBlock = false
+	_, err = CreateDB(opts)
+	assert.NotNil(t, err)
+
+	opts.RecoverActiveBlock = true
+	db2, err := CreateDB(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, validSize, db2.activeBlock.WritePos)
+	info, err := os.Stat(activeName)
+	assert.Nil(t, err)
+	assert.Equal(t, validSize+db2.activeBlock.HeaderSize(), info.Size())
+	assert.Equal(t, 1000, len(db2.ListKeys()))
+	_, err = db2.Get(utils.GetTestKey(2000))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// the block is usable after truncating
+	val := utils.RandomValue(128)
+	err = db2.Put(utils.GetTestKey(2001), val)
+	assert.Nil(t, err)
+	err = db2.Close()
+	assert.Nil(t, err)
+
+	db3, err := CreateDB(opts)
+	assert.Nil(t, err)
+	val2, err := db3.Get(utils.GetTestKey(2001))
+	assert.Nil(t, err)
+	assert.Equal(t, val, val2)
+	err = db3.Close()
+	assert.Nil(t, err)
+}
+
+// flip one byte of the value of the first log in block 0
+func corruptFirstBlock(t *testing.T, dir string) {
+	fileName := content.GetBlockName(dir, 0)
+	block, err := content.OpenBlock(dir, 0, diskIO.FileSystemIO)
+	assert.Nil(t, err)
+	headerSize := block.HeaderSize()
+	assert.Nil(t, block.Close())
+
+	data, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	data[headerSize+40] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, data, 0644))
+
+	// without the hint, the block is read on open
+	assert.Nil(t, os.Remove(content.GetBlockHintName(dir, 0)))
+}
+
+func TestCorruptionPolicy(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-recovery-2")
+	opts.DataDir = dir
+	opts.DataSize = 64 * 1024
+	// every open reads the blocks
+	opts.IndexCheckpoint = false
+	prepareBlocks(t, opts)
+	corruptFirstBlock(t, dir)
+
+	// fail
+	opts.CorruptionPolicy = CorruptionFail
+	_, err := CreateDB(opts)
+	assert.Equal(t, content.ErrCRCNotMatch, err)
+
+	// skip: only the broken log is lost
+	opts.CorruptionPolicy = CorruptionSkip
+	db, err := CreateDB(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 999, len(db.ListKeys()))
+	_, err = db.Get(utils.GetTestKey(0))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// quarantine: the whole block is moved aside
+	opts.CorruptionPolicy = CorruptionQuarantine
+	db2, err := CreateDB(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = db2.Get(utils.GetTestKey(999))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	_, err = os.Stat(content.GetBlockName(dir, 0))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(content.GetBlockName(dir, 0) + quarantineSuffix)
+	assert.Nil(t, err)
+}
+
+func TestBlockHint(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-recovery-3")
+	opts.DataDir = dir
+	opts.DataSize = 64 * 1024
+	opts.IndexCheckpoint = false
+	db, err := CreateDB(opts)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 1000; i++ {
+		values[i] = utils.RandomValue(128)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 100; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	wb := db.NewAtomicWrite(DefaultWriteOptions)
+	for i := 1000; i < 1100; i++ {
+		values[i] = utils.RandomValue(128)
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), values[i]))
+	}
+	assert.Nil(t, wb.Commit())
+
+	// every sealed block has a hint
+	sealed := len(db.inactiveBlock)
+	assert.Greater(t, sealed, 1)
+	for fileIndex := range db.inactiveBlock {
+		_, err := os.Stat(content.GetBlockHintName(dir, fileIndex))
+		assert.Nil(t, err)
+	}
+	_, err = os.Stat(content.GetBlockHintName(dir, db.activeBlock.FileIndex))
+	assert.True(t, os.IsNotExist(err))
+	bytesToCollect := db.GetDBStatus().BytesToCollect
+	assert.Nil(t, db.Close())
+
+	check := func(readValues bool) {
+		db, err := CreateDB(opts)
+		assert.Nil(t, err)
+		assert.Equal(t, 1000, len(db.ListKeys()))
+		assert.Equal(t, bytesToCollect, db.GetDBStatus().BytesToCollect)
+		for i := 100; readValues && i < 1100; i++ {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, values[i], val)
+		}
+		assert.Nil(t, db.Close())
+	}
+
+	// a broken block is not read on open, if its hint is good
+	fileName := content.GetBlockName(dir, 1)
+	data, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	good := append([]byte(nil), data...)
+	data[len(data)/2] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, data, 0644))
+	check(false)
+	assert.Nil(t, os.WriteFile(fileName, good, 0644))
+
+	// missing or broken hint: the block is read, and the hint is written again
+	hintName := content.GetBlockHintName(dir, 0)
+	assert.Nil(t, os.Remove(hintName))
+	hintData, err := os.ReadFile(content.GetBlockHintName(dir, 1))
+	assert.Nil(t, err)
+	hintData[len(hintData)-2] ^= 0xff
+	assert.Nil(t, os.WriteFile(content.GetBlockHintName(dir, 1), hintData, 0644))
+	check(true)
+	_, err = os.Stat(hintName)
+	assert.Nil(t, err)
+	block, err := content.OpenBlock(dir, 1, diskIO.FileSystemIO)
+	assert.Nil(t, err)
+	blockSize, err := block.Size()
+	assert.Nil(t, err)
+	assert.Nil(t, block.Close())
+	_, err = content.ReadBlockHint(dir, 1, blockSize, content.BlockOptions{})
+	assert.Nil(t, err)
+	check(true)
+
+	// the hint goes away with its block
+	db, err = CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	err = db.Compact(CompactOptions{MaxBlocks: 1})
+	assert.Nil(t, err)
+	_, err = os.Stat(content.GetBlockHintName(dir, 0))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// blocks read in parallel are applied in file order
+func TestOpenWorkers(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-recovery-4")
+	opts.DataDir = dir
+	opts.DataSize = 4 * 1024
+	opts.IndexCheckpoint = false
+	db, err := CreateDB(opts)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 200; i++ {
+			values[i] = utils.RandomValue(64)
+			err := db.Put(utils.GetTestKey(i), values[i])
+			assert.Nil(t, err)
+		}
+		for i := round * 50; i < round*50+50; i++ {
+			err := db.Delete(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			delete(values, i)
+		}
+
+		// a batch spans blocks
+		wb := db.NewAtomicWrite(DefaultWriteOptions)
+		for i := 150; i < 200; i++ {
+			values[i] = utils.RandomValue(128)
+			assert.Nil(t, wb.Put(utils.GetTestKey(i), values[i]))
+		}
+		assert.Nil(t, wb.Commit())
+	}
+	assert.Greater(t, len(db.inactiveBlock), 20)
+	assert.Nil(t, db.Close())
+
+	var bytesToCollect []int64
+	for _, workers := range []int{1, 8} {
+		opts.OpenWorkers = workers
+		// without hints, the blocks are scanned
+		hints, _ := filepath.Glob(filepath.Join(dir, "*"+content.HintSuffix))
+		for _, hint := range hints {
+			assert.Nil(t, os.Remove(hint))
+		}
+
+		for i := 0; i < 2; i++ {
+			db, err := CreateDB(opts)
+			assert.Nil(t, err)
+			assert.Equal(t, uint64(3), db.atomicSeq)
+			assert.Equal(t, len(values), len(db.ListKeys()))
+			for key, value := range values {
+				val, err := db.Get(utils.GetTestKey(key))
+				assert.Nil(t, err)
+				assert.Equal(t, value, val)
+			}
+			bytesToCollect = append(bytesToCollect, db.GetDBStatus().BytesToCollect)
+			assert.Nil(t, db.Close())
+		}
+	}
+
+	for _, collect := range bytesToCollect {
+		assert.Equal(t, bytesToCollect[0], collect)
+	}
+	_ = os.RemoveAll(dir)
+}
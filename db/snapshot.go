@@ -0,0 +1,199 @@
+package db
+
+import (
+	"bamboo/content"
+	"bamboo/index"
+	"os"
+	"time"
+)
+
+// Snapshot is a read only view of the db at the time it is taken.
+// it keeps a read only view of the memory index, and the files which the copy points to,
+// so writes, compaction and merge after it are not seen
+type Snapshot struct {
+	db       *DB
+	index    index.Indexer
+	readTime int64
+	closed   bool
+
+	activeBlock   *content.BlockFile
+	inactiveBlock map[uint32]*content.BlockFile
+	activeBlob    *content.BlockFile
+	inactiveBlob  map[uint32]*content.BlockFile
+}
+
+// pendingRemoval: a file removed from the db, but still read by snapshots
+type pendingRemoval struct {
+	file *content.BlockFile
+	path string
+}
+
+// Snapshot pins the current state, it must be closed to release the files
+func (db *DB) Snapshot() *Snapshot {
+	db.muLock.Lock()
+	defer db.muLock.Unlock()
+
+	return db.snapshotLocked()
+}
+
+// snapshotLocked: the caller holds db.muLock
+func (db *DB) snapshotLocked() *Snapshot {
+	snap := &Snapshot{
+		db:            db,
+		index:         db.index.Snapshot(),
+		readTime:      time.Now().UnixNano(),
+		activeBlock:   db.activeBlock,
+		inactiveBlock: make(map[uint32]*content.BlockFile, len(db.inactiveBlock)),
+		activeBlob:    db.activeBlob,
+		inactiveBlob:  make(map[uint32]*content.BlockFile, len(db.inactiveBlob)),
+	}
+	for fileIndex, file := range db.inactiveBlock {
+		snap.inactiveBlock[fileIndex] = file
+	}
+	for fileIndex, file := range db.inactiveBlob {
+		snap.inactiveBlob[fileIndex] = file
+	}
+
+	db.snapshots[snap] = struct{}{}
+	return snap
+}
+
+func (s *Snapshot) blockFile(fileIndex uint32) *content.BlockFile {
+	if s.activeBlock != nil && s.activeBlock.FileIndex == fileIndex {
+		return s.activeBlock
+	}
+	return s.inactiveBlock[fileIndex]
+}
+
+func (s *Snapshot) blobFile(fileIndex uint32) *content.BlockFile {
+	if s.activeBlob != nil && s.activeBlob.FileIndex == fileIndex {
+		return s.activeBlob
+	}
+	return s.inactiveBlob[fileIndex]
+}
+
+// holds: if the snapshot reads the file
+func (s *Snapshot) holds(file *content.BlockFile) bool {
+	return s.blockFile(file.FileIndex) == file || s.blobFile(file.FileIndex) == file
+}
+
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if s.closed {
+		return nil, ErrSnapshotClosed
+	}
+
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+
+	logPos := s.index.Get(key)
+	if logPos == nil || logPos.IsExpired(s.readTime) {
+		return nil, ErrKeyNotFound
+	}
+
+	return readValue(s, logPos)
+}
+
+// NewIterator iterates the keys of the snapshot
+func (s *Snapshot) NewIterator(options IteratorOptions) *Iterator {
+	return &Iterator{
+		indexIterator: s.index.Iterator(options.Reverse),
+		db:            s.db,
+		snapshot:      s,
+		options:       options,
+	}
+}
+
+func (s *Snapshot) Fold(fn func(key []byte, value []byte) bool) error {
+	if s.closed {
+		return ErrSnapshotClosed
+	}
+
+	Iterator := s.index.Iterator(false)
+	defer Iterator.Close()
+	for Iterator.Rewind(); Iterator.Valid(); Iterator.Next() {
+		if Iterator.Value().IsExpired(s.readTime) {
+			continue
+		}
+
+		value, err := readValue(s, Iterator.Value())
+		if err != nil {
+			return err
+		}
+
+		if !fn(Iterator.Key(), value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Close releases the snapshot, files removed while it is alive are removed now
+func (s *Snapshot) Close() error {
+	db := s.db
+	db.muLock.Lock()
+	defer db.muLock.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	delete(db.snapshots, s)
+	if err := s.index.Destroy(); err != nil {
+		return err
+	}
+
+	return db.removePending(false)
+}
+
+// removeFile closes and removes a file which is not in the db anymore,
+// if some snapshot still reads it, the removal waits for the snapshot to close
+func (db *DB) removeFile(file *content.BlockFile, path string) error {
+	db.pendingRemovals = append(db.pendingRemovals, &pendingRemoval{file: file, path: path})
+	return db.removePending(false)
+}
+
+// removePending: remove files which no snapshot reads, or all files if force
+func (db *DB) removePending(force bool) error {
+	var kept []*pendingRemoval
+	var firstErr error
+
+	for _, removal := range db.pendingRemovals {
+		if !force && db.isPinned(removal.file) {
+			kept = append(kept, removal)
+			continue
+		}
+
+		if err := removal.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		// empty path: the file on disk has been removed or replaced already
+		if removal.path == "" {
+			continue
+		}
+		if err := db.fs.Remove(removal.path); err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	db.pendingRemovals = kept
+	return firstErr
+}
+
+// forgetPendingPath: a new file is at the path, a pending removal must not remove it
+func (db *DB) forgetPendingPath(path string) {
+	for _, removal := range db.pendingRemovals {
+		if removal.path == path {
+			removal.path = ""
+		}
+	}
+}
+
+func (db *DB) isPinned(file *content.BlockFile) bool {
+	for snap := range db.snapshots {
+		if snap.holds(file) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,130 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"bamboo/db/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	for _, indexType := range []IndexType{BTree, ART} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bamboo-snapshot-1")
+		opts.DataDir = dir
+		opts.IndexType = indexType
+		db, err := CreateDB(opts)
+		assert.Nil(t, err)
+		assert.NotNil(t, db)
+
+		for i := 0; i < 100; i++ {
+			err := db.Put(utils.GetTestKey(i), []byte("old"))
+			assert.Nil(t, err)
+		}
+
+		snap := db.Snapshot()
+		for i := 0; i < 50; i++ {
+			err := db.Delete(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		for i := 50; i < 150; i++ {
+			err := db.Put(utils.GetTestKey(i), []byte("new"))
+			assert.Nil(t, err)
+		}
+
+		// snapshot sees the state when it is taken
+		val, err := snap.Get(utils.GetTestKey(10))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("old"), val)
+		val, err = snap.Get(utils.GetTestKey(60))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("old"), val)
+		_, err = snap.Get(utils.GetTestKey(120))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		count := 0
+		err = snap.Fold(func(key []byte, value []byte) bool {
+			assert.Equal(t, []byte("old"), value)
+			count++
+			return true
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 100, count)
+
+		iter := snap.NewIterator(DefaultIteratorOptions)
+		count = 0
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			val, err := iter.Value()
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("old"), val)
+			count++
+		}
+		iter.Close()
+		assert.Equal(t, 100, count)
+
+		// db sees the latest state
+		val, err = db.Get(utils.GetTestKey(60))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("new"), val)
+		assert.Equal(t, 100, len(db.ListKeys()))
+
+		err = snap.Close()
+		assert.Nil(t, err)
+		_, err = snap.Get(utils.GetTestKey(60))
+		assert.Equal(t, ErrSnapshotClosed, err)
+
+		destroyDB(db)
+	}
+}
+
+// files removed while a snapshot reads them are removed when it closes
+func TestSnapshotPinFiles(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-snapshot-2")
+	opts.DataDir = dir
+	opts.DataSize = 1024 * 1024
+	opts.MergeThreshold = 0
+	opts.BlobThreshold = 1024
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 1000; i++ {
+		values[i] = utils.RandomValue(4096)
+		err := db.Put(utils.GetTestKey(i), values[i])
+		assert.Nil(t, err)
+	}
+
+	snap := db.Snapshot()
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(4096))
+		assert.Nil(t, err)
+	}
+	blobs := len(blobFiles(dir))
+
+	err = db.CompactBlobs()
+	assert.Nil(t, err)
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.Equal(t, blobs, len(blobFiles(dir)))
+
+	for i := 0; i < 1000; i++ {
+		val, err := snap.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, values[i], val)
+	}
+
+	err = snap.Close()
+	assert.Nil(t, err)
+	assert.Less(t, len(blobFiles(dir)), blobs)
+
+	for i := 0; i < 1000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.NotEqual(t, values[i], val)
+	}
+}
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"bamboo/db/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPutWithTTL(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-ttl-1")
+	opts.DataDir = dir
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.PutWithTTL(utils.GetTestKey(1), utils.RandomValue(10), 0)
+	assert.Equal(t, ErrInvalidTTL, err)
+
+	err = db.PutWithTTL(utils.GetTestKey(1), utils.RandomValue(10), 100*time.Millisecond)
+	assert.Nil(t, err)
+	err = db.PutWithTTL(utils.GetTestKey(2), utils.RandomValue(10), time.Hour)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(3), utils.RandomValue(10))
+	assert.Nil(t, err)
+
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	ttl, err := db.TTL(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.True(t, ttl > 59*time.Minute && ttl <= time.Hour)
+	ttl, err = db.TTL(utils.GetTestKey(3))
+	assert.Nil(t, err)
+	assert.Equal(t, NoExpire, ttl)
+
+	time.Sleep(150 * time.Millisecond)
+
+	// expired key is hidden from Get, TTL, ListKeys, iterator and Fold
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.TTL(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 2, len(db.ListKeys()))
+	assert.Equal(t, uint(2), db.GetDBStatus().KeyCount)
+
+	iter := db.NewIterator(DefaultIteratorOptions)
+	var cnt int
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		assert.NotEqual(t, utils.GetTestKey(1), iter.Key())
+		cnt++
+	}
+	iter.Close()
+	assert.Equal(t, 2, cnt)
+
+	cnt = 0
+	err = db.Fold(func(key []byte, value []byte) bool {
+		cnt++
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, cnt)
+
+	// restart check
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := CreateDB(opts)
+	assert.Nil(t, err)
+	_, err = db2.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	ttl, err = db2.TTL(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.True(t, ttl > 59*time.Minute)
+	err = db2.Close()
+	assert.Nil(t, err)
+}
+
+func TestExpire(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-ttl-2")
+	opts.DataDir = dir
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Expire(utils.GetTestKey(1), time.Second)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	val := utils.RandomValue(10)
+	err = db.Put(utils.GetTestKey(1), val)
+	assert.Nil(t, err)
+	err = db.Expire(utils.GetTestKey(1), time.Minute)
+	assert.Nil(t, err)
+
+	ttl, err := db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.True(t, ttl > 0 && ttl <= time.Minute)
+	val2, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, val, val2)
+
+	// remove ttl
+	err = db.Expire(utils.GetTestKey(1), 0)
+	assert.Nil(t, err)
+	ttl, err = db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, NoExpire, ttl)
+
+	err = db.Expire(utils.GetTestKey(1), 50*time.Millisecond)
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestMergeDropExpired(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-ttl-3")
+	opts.DataSize = 4 * 1024 * 1024
+	opts.MergeThreshold = 0
+	opts.DataDir = dir
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 10000; i++ {
+		err := db.PutWithTTL(utils.GetTestKey(i), utils.RandomValue(1024), 100*time.Millisecond)
+		assert.Nil(t, err)
+	}
+	for i := 10000; i < 11000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	sizeBefore, err := utils.GetDirSize(dir)
+	assert.Nil(t, err)
+
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db2, err := CreateDB(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(db2.ListKeys()))
+
+	sizeAfter, err := utils.GetDirSize(dir)
+	assert.Nil(t, err)
+	assert.Less(t, sizeAfter, sizeBefore/2)
+	err = db2.Close()
+	assert.Nil(t, err)
+}
@@ -0,0 +1,174 @@
+package db
+
+import (
+	"bamboo/content"
+	"math"
+	"sync"
+)
+
+// Txn is an optimistic read-write transaction:
+// 1. reads come from its own writes, then from a snapshot taken when it begins
+// 2. writes are stashed until Commit
+// 3. Commit fails with ErrTxnConflict, if a key it read has been written since it began.
+// values moved by compaction or merge are not written, so they are not conflicts
+type Txn struct {
+	db       *DB
+	snapshot *Snapshot
+	muLock   *sync.Mutex
+	options  WriteOptions
+	finished bool
+	// write seq of the db when it begins, the snapshot has all writes up to it
+	readSeq uint64
+
+	dataToWrite map[string]*content.LogStruct
+	readSet     map[string]struct{}
+}
+
+func (db *DB) NewTxn(option WriteOptions) *Txn {
+	db.muLock.Lock()
+	defer db.muLock.Unlock()
+
+	txn := &Txn{
+		db:          db,
+		snapshot:    db.snapshotLocked(),
+		muLock:      new(sync.Mutex),
+		options:     option,
+		readSeq:     db.writeSeq,
+		dataToWrite: make(map[string]*content.LogStruct),
+		readSet:     make(map[string]struct{}),
+	}
+	db.openTxns[txn] = struct{}{}
+	return txn
+}
+
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+
+	txn.muLock.Lock()
+	defer txn.muLock.Unlock()
+
+	if txn.finished {
+		return nil, ErrTxnFinished
+	}
+
+	// read its own writes
+	if log, ok := txn.dataToWrite[string(key)]; ok {
+		if log.Type == content.LogDeleted {
+			return nil, ErrKeyNotFound
+		}
+		return log.Value, nil
+	}
+
+	txn.readSet[string(key)] = struct{}{}
+	return txn.snapshot.Get(key)
+}
+
+func (txn *Txn) Put(key, value []byte) error {
+	return txn.stash(&content.LogStruct{Key: key, Value: value})
+}
+
+func (txn *Txn) Delete(key []byte) error {
+	return txn.stash(&content.LogStruct{Key: key, Type: content.LogDeleted})
+}
+
+func (txn *Txn) stash(log *content.LogStruct) error {
+	if len(log.Key) == 0 {
+		return ErrEmptyKey
+	}
+
+	txn.muLock.Lock()
+	defer txn.muLock.Unlock()
+
+	if txn.finished {
+		return ErrTxnFinished
+	}
+
+	txn.dataToWrite[string(log.Key)] = log
+	return nil
+}
+
+// Commit checks the read set and writes stashed logs as one atomic batch
+func (txn *Txn) Commit() error {
+	txn.muLock.Lock()
+	defer txn.muLock.Unlock()
+
+	if txn.finished {
+		return ErrTxnFinished
+	}
+	defer txn.finish()
+
+	if uint(len(txn.dataToWrite)) > txn.options.MaxWriteCount {
+		return ErrDataExceedAtomicMaxSize
+	}
+
+	// add lock to avoid other write operation
+	txn.db.muLock.Lock()
+	defer txn.db.muLock.Unlock()
+
+	for key := range txn.readSet {
+		if txn.db.keyVersions[key] > txn.readSeq {
+			return ErrTxnConflict
+		}
+	}
+
+	if len(txn.dataToWrite) == 0 {
+		return nil
+	}
+	return txn.db.commitAtomic(txn.dataToWrite, txn.options.SyncCommit)
+}
+
+// Rollback drops stashed writes, and releases the snapshot
+func (txn *Txn) Rollback() {
+	txn.muLock.Lock()
+	defer txn.muLock.Unlock()
+
+	if !txn.finished {
+		txn.finish()
+	}
+}
+
+func (txn *Txn) finish() {
+	txn.finished = true
+	txn.dataToWrite = nil
+	txn.readSet = nil
+	_ = txn.snapshot.Close()
+
+	db := txn.db
+	db.muLock.Lock()
+	defer db.muLock.Unlock()
+
+	delete(db.openTxns, txn)
+	db.pruneKeyVersions()
+}
+
+// noteWrite counts a write of key, its seq is kept while an open txn may have read the key.
+// the caller holds db.muLock
+func (db *DB) noteWrite(key []byte) {
+	db.writeSeq++
+	if len(db.openTxns) > 0 {
+		db.keyVersions[string(key)] = db.writeSeq
+	}
+}
+
+// pruneKeyVersions drops the seq of keys written before every open txn began.
+// the caller holds db.muLock
+func (db *DB) pruneKeyVersions() {
+	if len(db.openTxns) == 0 {
+		db.keyVersions = make(map[string]uint64)
+		return
+	}
+
+	var oldest uint64 = math.MaxUint64
+	for txn := range db.openTxns {
+		if txn.readSeq < oldest {
+			oldest = txn.readSeq
+		}
+	}
+	for key, seq := range db.keyVersions {
+		if seq <= oldest {
+			delete(db.keyVersions, key)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package db
+
+import (
+	"os"
+	"testing"
+
+	"bamboo/db/utils"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxn(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-txn-1")
+	opts.DataDir = dir
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(1), []byte("1"))
+	assert.Nil(t, err)
+
+	txn := db.NewTxn(DefaultWriteOptions)
+	val, err := txn.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), val)
+
+	// read own writes
+	err = txn.Put(utils.GetTestKey(1), []byte("2"))
+	assert.Nil(t, err)
+	err = txn.Put(utils.GetTestKey(2), []byte("2"))
+	assert.Nil(t, err)
+	val, err = txn.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), val)
+	err = txn.Delete(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	_, err = txn.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// not committed yet
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("1"), val)
+
+	err = txn.Commit()
+	assert.Nil(t, err)
+	err = txn.Commit()
+	assert.Equal(t, ErrTxnFinished, err)
+
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), val)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// restart
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = CreateDB(opts)
+	assert.Nil(t, err)
+	val, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), val)
+}
+
+func TestTxnConflict(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-txn-2")
+	opts.DataDir = dir
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(1), []byte("100"))
+	assert.Nil(t, err)
+
+	// changed after read
+	txn1 := db.NewTxn(DefaultWriteOptions)
+	_, err = txn1.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(1), []byte("200"))
+	assert.Nil(t, err)
+	err = txn1.Put(utils.GetTestKey(2), []byte("100"))
+	assert.Nil(t, err)
+	err = txn1.Commit()
+	assert.Equal(t, ErrTxnConflict, err)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// changed after begin, before read: the snapshot value is read, then conflict
+	txn2 := db.NewTxn(DefaultWriteOptions)
+	err = db.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	val, err := txn2.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("200"), val)
+	err = txn2.Commit()
+	assert.Equal(t, ErrTxnConflict, err)
+
+	// a missing key which is created later
+	txn3 := db.NewTxn(DefaultWriteOptions)
+	_, err = txn3.Get(utils.GetTestKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+	err = db.Put(utils.GetTestKey(3), []byte("3"))
+	assert.Nil(t, err)
+	err = txn3.Put(utils.GetTestKey(3), []byte("txn"))
+	assert.Nil(t, err)
+	err = txn3.Commit()
+	assert.Equal(t, ErrTxnConflict, err)
+
+	// keys not read are not checked
+	txn4 := db.NewTxn(DefaultWriteOptions)
+	_, err = txn4.Get(utils.GetTestKey(4))
+	assert.Equal(t, ErrKeyNotFound, err)
+	err = db.Put(utils.GetTestKey(5), []byte("5"))
+	assert.Nil(t, err)
+	err = txn4.Put(utils.GetTestKey(5), []byte("txn"))
+	assert.Nil(t, err)
+	err = txn4.Commit()
+	assert.Nil(t, err)
+	val, err = db.Get(utils.GetTestKey(5))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("txn"), val)
+
+	// rollback
+	txn5 := db.NewTxn(DefaultWriteOptions)
+	err = txn5.Put(utils.GetTestKey(6), []byte("6"))
+	assert.Nil(t, err)
+	txn5.Rollback()
+	assert.Equal(t, ErrTxnFinished, txn5.Commit())
+	_, err = db.Get(utils.GetTestKey(6))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 0, len(db.snapshots))
+}
+
+func TestTxnMovedByCompaction(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bamboo-txn-3")
+	opts.DataDir = dir
+	opts.DataSize = 64 * 1024
+	db, err := CreateDB(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(0), []byte("0"))
+	assert.Nil(t, err)
+	// the first block is garbage, except the key read by txn
+	for i := 1; i < 200; i++ {
+		err = db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+	for i := 1; i < 200; i++ {
+		err = db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+
+	txn := db.NewTxn(DefaultWriteOptions)
+	val, err := txn.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("0"), val)
+
+	before := db.index.Get(utils.GetTestKey(0))
+	err = db.Compact(CompactOptions{MinGarbageRatio: 0.5})
+	assert.Nil(t, err)
+	assert.NotEqual(t, before.FileIndex, db.index.Get(utils.GetTestKey(0)).FileIndex)
+
+	// the value is only moved, so it is not a conflict
+	err = txn.Put(utils.GetTestKey(0), []byte("txn"))
+	assert.Nil(t, err)
+	assert.Nil(t, txn.Commit())
+
+	// a key written back to the value read is still a conflict
+	txn = db.NewTxn(DefaultWriteOptions)
+	_, err = txn.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Put(utils.GetTestKey(0), []byte("other")))
+	assert.Nil(t, db.Put(utils.GetTestKey(0), []byte("txn")))
+	assert.Nil(t, txn.Put(utils.GetTestKey(1), []byte("1")))
+	assert.Equal(t, ErrTxnConflict, txn.Commit())
+
+	// versions are not kept without open txns
+	assert.Equal(t, 0, len(db.openTxns))
+	assert.Equal(t, 0, len(db.keyVersions))
+}
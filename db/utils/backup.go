@@ -1,14 +1,19 @@
 package utils
 
 import (
+	"bamboo/diskIO"
 	"errors"
-	"io/fs"
+	"io"
 	"os"
 	"path/filepath"
-	"strings"
 )
 
 func BackupDir(srcDir string, distDir string, excludeDirs []string) error {
+	return BackupDirFrom(diskIO.OS, srcDir, distDir, excludeDirs)
+}
+
+// BackupDirFrom copies srcDir of fsys to distDir on disk
+func BackupDirFrom(fsys diskIO.FileSystem, srcDir string, distDir string, excludeDirs []string) error {
 	// check if dist dir exists
 	if _, err := os.Stat(distDir); os.IsNotExist(err) {
 		if err := os.MkdirAll(distDir, os.ModePerm); err != nil {
@@ -17,41 +22,60 @@ func BackupDir(srcDir string, distDir string, excludeDirs []string) error {
 	}
 
 	// check if srcDir exists
-	if _, err := os.Stat(srcDir); os.IsNotExist(err) {
+	if _, err := fsys.Stat(srcDir); os.IsNotExist(err) {
 		return errors.New("source dir not exists")
 	}
 
-	return filepath.Walk(srcDir, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	return copyDir(fsys, srcDir, distDir, excludeDirs)
+}
 
-		name := strings.Replace(path, srcDir, "", 1)
-		if name == "" {
-			return nil
-		}
+func copyDir(fsys diskIO.FileSystem, srcDir string, distDir string, excludeDirs []string) error {
+	entries, err := fsys.ReadDir(srcDir)
+	if err != nil {
+		return err
+	}
 
+	for _, entry := range entries {
+		excluded := false
 		for _, excludeDir := range excludeDirs {
-			isMatched, err := filepath.Match(excludeDir, info.Name())
+			isMatched, err := filepath.Match(excludeDir, entry.Name())
 			if err != nil {
 				return err
 			}
-
-			if isMatched {
-				return nil
-			}
+			excluded = excluded || isMatched
+		}
+		if excluded {
+			continue
 		}
 
-		if info.IsDir() {
+		src, dist := filepath.Join(srcDir, entry.Name()), filepath.Join(distDir, entry.Name())
+		if entry.IsDir() {
 			// create dir
-			return os.MkdirAll(filepath.Join(distDir, name), os.ModePerm)
+			if err := os.MkdirAll(dist, os.ModePerm); err != nil {
+				return err
+			}
+			if err := copyDir(fsys, src, dist, excludeDirs); err != nil {
+				return err
+			}
+			continue
 		}
 
-		store, err := os.ReadFile(filepath.Join(srcDir, name))
+		info, err := entry.Info()
 		if err != nil {
 			return err
 		}
-
-		return os.WriteFile(filepath.Join(distDir, name), store, info.Mode())
-	})
+		file, err := fsys.Open(src)
+		if err != nil {
+			return err
+		}
+		store, err := io.ReadAll(file)
+		_ = file.Close()
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(dist, store, info.Mode()); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -1,24 +1,41 @@
 package utils
 
 import (
-	"io/fs"
+	"bamboo/diskIO"
 	"path/filepath"
 	"syscall"
 )
 
 // get the size of the directory
 func GetDirSize(dir string) (int64, error) {
+	return GetDirSizeFrom(diskIO.OS, dir)
+}
+
+// GetDirSizeFrom: the size of dir in fsys, with all its sub dirs
+func GetDirSizeFrom(fsys diskIO.FileSystem, dir string) (int64, error) {
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
 	var size int64
-	err := filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			return err
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirSize, err := GetDirSizeFrom(fsys, filepath.Join(dir, entry.Name()))
+			if err != nil {
+				return 0, err
+			}
+			size += dirSize
+			continue
 		}
-		if !info.IsDir() {
-			size += info.Size()
+
+		info, err := entry.Info()
+		if err != nil {
+			return 0, err
 		}
-		return nil
-	})
-	return size, err
+		size += info.Size()
+	}
+	return size, nil
 }
 
 // get the available disk size
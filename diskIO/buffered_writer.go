@@ -0,0 +1,209 @@
+package diskIO
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// BufferedWriter: appends are collected in a buffer, and written to the file when it is full,
+// on Sync, or by a timer FlushInterval after the first buffered write
+type BufferedWriter struct {
+	mu      sync.RWMutex
+	fd      *os.File
+	buf     []byte
+	flushed int64
+	options IOOptions
+	timer   *time.Timer
+	// err: the last error of background flush, returned by the next Write or Sync
+	err    error
+	closed bool
+}
+
+func NewBufferedWriterIOManager(fileName string, options IOOptions) (*BufferedWriter, error) {
+	fd, err := os.OpenFile(
+		fileName,
+		os.O_RDWR|os.O_CREATE|os.O_APPEND,
+		BlockFileMode,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+
+	if options.BufferSize <= 0 {
+		options.BufferSize = DefaultBufferSize
+	}
+	return &BufferedWriter{
+		fd:      fd,
+		buf:     make([]byte, 0, options.BufferSize),
+		flushed: fi.Size(),
+		options: options,
+	}, nil
+}
+
+// Read sees the buffered bytes, as if they were in the file
+func (b *BufferedWriter) Read(p []byte, offset int64) (int, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return 0, os.ErrClosed
+	}
+	if offset >= b.flushed+int64(len(b.buf)) {
+		return 0, io.EOF
+	}
+
+	n := 0
+	if offset < b.flushed {
+		end := int64(len(p))
+		if end > b.flushed-offset {
+			end = b.flushed - offset
+		}
+		var err error
+		if n, err = b.fd.ReadAt(p[:end], offset); err != nil {
+			return n, err
+		}
+	}
+
+	if n == len(p) {
+		return n, nil
+	}
+
+	// the rest is in the buffer
+	n += copy(p[n:], b.buf[offset+int64(n)-b.flushed:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (b *BufferedWriter) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return 0, os.ErrClosed
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	if len(b.buf)+len(p) > b.options.BufferSize {
+		if err := b.flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	// larger than the buffer, write it through
+	if len(p) >= b.options.BufferSize {
+		n, err := b.fd.Write(p)
+		b.flushed += int64(n)
+		return n, err
+	}
+
+	b.buf = append(b.buf, p...)
+	if b.timer == nil && b.options.FlushInterval > 0 {
+		b.timer = time.AfterFunc(b.options.FlushInterval, b.backgroundFlush)
+	}
+	return len(p), nil
+}
+
+// flush writes the buffer to the file, the lock must be held
+func (b *BufferedWriter) flush() error {
+	if len(b.buf) == 0 {
+		return nil
+	}
+
+	n, err := b.fd.Write(b.buf)
+	b.flushed += int64(n)
+	// keep what is not written
+	b.buf = b.buf[:copy(b.buf, b.buf[n:])]
+	return err
+}
+
+func (b *BufferedWriter) backgroundFlush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.timer = nil
+	if b.closed {
+		return
+	}
+
+	if err := b.flush(); err != nil {
+		b.err = err
+		return
+	}
+	if b.options.SyncOnFlush {
+		if err := b.fd.Sync(); err != nil {
+			b.err = err
+		}
+	}
+}
+
+func (b *BufferedWriter) Sync() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return os.ErrClosed
+	}
+	if b.err != nil {
+		return b.err
+	}
+	if err := b.flush(); err != nil {
+		return err
+	}
+	return b.fd.Sync()
+}
+
+// Close flushes the buffer, without fsync like SystemIO
+func (b *BufferedWriter) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return os.ErrClosed
+	}
+	b.closed = true
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	if err := b.flush(); err != nil {
+		_ = b.fd.Close()
+		return err
+	}
+	return b.fd.Close()
+}
+
+func (b *BufferedWriter) Size() (int64, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.flushed + int64(len(b.buf)), nil
+}
+
+func (b *BufferedWriter) Truncate(size int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return os.ErrClosed
+	}
+	if err := b.flush(); err != nil {
+		return err
+	}
+	if err := b.fd.Truncate(size); err != nil {
+		return err
+	}
+	b.flushed = size
+	return nil
+}
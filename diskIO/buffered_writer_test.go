@@ -0,0 +1,107 @@
+package diskIO
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fileSize(t *testing.T, path string) int64 {
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	return fi.Size()
+}
+
+func TestBufferedWriter(t *testing.T) {
+	path := filepath.Join("/tmp", "buffered-writer.data")
+	defer destroyFile(path)
+
+	bio, err := NewBufferedWriterIOManager(path, IOOptions{BufferSize: 16})
+	assert.Nil(t, err)
+
+	_, err = bio.Write([]byte("fffffggggg"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), fileSize(t, path))
+	size, err := bio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), size)
+
+	// the buffer is full, the first write is flushed
+	_, err = bio.Write([]byte("hhhhhiiiii"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), fileSize(t, path))
+
+	// read from the file and the buffer
+	b := make([]byte, 10)
+	n, err := bio.Read(b, 5)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, []byte("ggggghhhhh"), b)
+	n, err = bio.Read(b[:5], 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("fffff"), b[:n])
+	n, err = bio.Read(b, 15)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []byte("iiiii"), b[:n])
+	_, err = bio.Read(b, 20)
+	assert.Equal(t, io.EOF, err)
+
+	// larger than the buffer, written through
+	_, err = bio.Write([]byte("jjjjjjjjjjjjjjjjjjjj"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(40), fileSize(t, path))
+
+	_, err = bio.Write([]byte("kkkkk"))
+	assert.Nil(t, err)
+	assert.Nil(t, bio.Sync())
+	assert.Equal(t, int64(45), fileSize(t, path))
+
+	assert.Nil(t, bio.Truncate(20))
+	size, err = bio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(20), size)
+
+	_, err = bio.Write([]byte("lllll"))
+	assert.Nil(t, err)
+	assert.Nil(t, bio.Close())
+	assert.Equal(t, int64(25), fileSize(t, path))
+	assert.Equal(t, os.ErrClosed, bio.Close())
+
+	fio, err := NewFileIOManager(path)
+	assert.Nil(t, err)
+	all := make([]byte, 25)
+	_, err = fio.Read(all, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("fffffggggghhhhhiiiiilllll"), all)
+	assert.Nil(t, fio.Close())
+}
+
+func TestBufferedWriterFlushInterval(t *testing.T) {
+	path := filepath.Join("/tmp", "buffered-writer-interval.data")
+	defer destroyFile(path)
+
+	bio, err := NewBufferedWriterIOManager(path, IOOptions{
+		BufferSize:    1024,
+		FlushInterval: 10 * time.Millisecond,
+		SyncOnFlush:   true,
+	})
+	assert.Nil(t, err)
+
+	_, err = bio.Write([]byte("fffff"))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return fileSize(t, path) == 5
+	}, time.Second, time.Millisecond)
+
+	// the timer is armed again by the next write
+	_, err = bio.Write([]byte("ggggg"))
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return fileSize(t, path) == 10
+	}, time.Second, time.Millisecond)
+	assert.Nil(t, bio.Close())
+}
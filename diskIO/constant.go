@@ -2,9 +2,18 @@ package diskIO
 
 const BlockFileMode = 0644
 
+// DefaultBufferSize: buffer of BufferedIO if not set
+const DefaultBufferSize = 64 * 1024
+
 type IOType = byte
 
 const (
 	FileSystemIO IOType = 0
 	MMapIO       IOType = 1
+	// MMapWriteIO: read and write through mmap, the file is preallocated
+	MMapWriteIO IOType = 2
+	// BufferedIO: appends are kept in memory and written in batches
+	BufferedIO IOType = 3
+	// MemoryIO: files are kept in Memory, nothing is written to disk
+	MemoryIO IOType = 4
 )
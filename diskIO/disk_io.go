@@ -42,3 +42,7 @@ func (s *SystemIO) Size() (int64, error) {
 	}
 	return fi.Size(), nil
 }
+
+func (s *SystemIO) Truncate(size int64) error {
+	return s.fd.Truncate(size)
+}
@@ -0,0 +1,443 @@
+package diskIO
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrInjectedFault = errors.New("injected io fault")
+	ErrInjectedCrash = errors.New("injected crash")
+)
+
+// CallKind: the io calls a Fault is scripted on
+type CallKind byte
+
+const (
+	// AnyCall: every counted call
+	AnyCall CallKind = iota
+	WriteCall
+	SyncCall
+	TruncateCall
+	// MetaCall: create, remove, rename, link and mkdir, and sync of a dir
+	MetaCall
+)
+
+type FaultKind byte
+
+const (
+	// FaultError: the call fails and does nothing
+	FaultError FaultKind = iota
+	// FaultShortWrite: half of the bytes are written, and the write fails.
+	// other calls fail as FaultError
+	FaultShortWrite
+	// FaultCorrupt: a byte of the write is flipped, and the write succeeds.
+	// other calls are not changed
+	FaultCorrupt
+	// FaultCrash: the call is not done, and every later mutating call fails,
+	// as if the process had died. DropUnsynced then acts as the power loss
+	FaultCrash
+)
+
+// Fault: Kind happens at the At-th call of Call, counted from 1
+type Fault struct {
+	Call CallKind
+	At   int64
+	Kind FaultKind
+}
+
+// FaultInjector counts the mutating calls of the IOManagers and file systems it wraps,
+// and makes the scripted ones fail. it also tracks the synced size of every file,
+// so the data not synced at a crash can be dropped. reads are never counted or failed,
+// and a metadata call which returned is taken as durable
+type FaultInjector struct {
+	mu      sync.Mutex
+	faults  []Fault
+	calls   [MetaCall + 1]int64
+	crashed bool
+	// name -> file written through the injector
+	files map[string]*trackedFile
+}
+
+type trackedFile struct {
+	synced int64
+	memory bool
+}
+
+func NewFaultInjector(faults ...Fault) *FaultInjector {
+	return &FaultInjector{faults: faults, files: make(map[string]*trackedFile)}
+}
+
+// Calls: the number of counted calls so far
+func (f *FaultInjector) Calls() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[AnyCall]
+}
+
+func (f *FaultInjector) Crashed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.crashed
+}
+
+// inject counts a call of kind, and returns the fault scripted on it.
+// err is set if the call must not be done
+func (f *FaultInjector) inject(kind CallKind) (fault *Fault, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.crashed {
+		return nil, ErrInjectedCrash
+	}
+	f.calls[AnyCall]++
+	f.calls[kind]++
+
+	for i := range f.faults {
+		next := &f.faults[i]
+		if next.At != f.calls[next.Call] || (next.Call != AnyCall && next.Call != kind) {
+			continue
+		}
+		switch next.Kind {
+		case FaultCrash:
+			f.crashed = true
+			return next, ErrInjectedCrash
+		case FaultCorrupt:
+			return next, nil
+		case FaultShortWrite:
+			if kind == WriteCall {
+				return next, nil
+			}
+		}
+		return next, ErrInjectedFault
+	}
+	return nil, nil
+}
+
+// track starts to track name with its current size as synced, if it is not yet
+func (f *FaultInjector) track(name string, size int64, memory bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.files[name]; !ok {
+		f.files[name] = &trackedFile{synced: size, memory: memory}
+	}
+}
+
+func (f *FaultInjector) synced(name string, size int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if file, ok := f.files[name]; ok {
+		file.synced = size
+	}
+}
+
+func (f *FaultInjector) truncated(name string, size int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if file, ok := f.files[name]; ok && file.synced > size {
+		file.synced = size
+	}
+}
+
+// renamed moves name, or all files under the dir name, to newName
+func (f *FaultInjector) renamed(name, newName string, link bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	moved := make(map[string]*trackedFile)
+	for old, file := range f.files {
+		if old != name && !strings.HasPrefix(old, name+string(filepath.Separator)) {
+			continue
+		}
+		moved[newName+strings.TrimPrefix(old, name)] = &trackedFile{synced: file.synced, memory: file.memory}
+		if !link {
+			delete(f.files, old)
+		}
+	}
+	for next, file := range moved {
+		f.files[next] = file
+	}
+}
+
+func (f *FaultInjector) removed(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for old := range f.files {
+		if old == name || strings.HasPrefix(old, name+string(filepath.Separator)) {
+			delete(f.files, old)
+		}
+	}
+}
+
+// DropUnsynced truncates every tracked file to its synced size, what a power loss
+// after the crash would leave. the files must not be written by others meanwhile
+func (f *FaultInjector) DropUnsynced() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for name, file := range f.files {
+		ioType, fs := FileSystemIO, OS
+		if file.memory {
+			ioType, fs = MemoryIO, Memory
+		}
+		stat, err := fs.Stat(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if stat.Size() <= file.synced {
+			continue
+		}
+
+		manager, err := NewIOManager(name, ioType)
+		if err != nil {
+			return err
+		}
+		err = manager.Truncate(file.synced)
+		if closeErr := manager.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IOManager wraps manager of the file name, opened as ioType
+func (f *FaultInjector) IOManager(name string, ioType IOType, manager IOManager) (IOManager, error) {
+	size, err := manager.Size()
+	if err != nil {
+		return nil, err
+	}
+	f.track(name, size, ioType == MemoryIO)
+	return &FaultIO{injector: f, name: name, inner: manager}, nil
+}
+
+// FileSystem wraps fs, its mutating calls are counted
+func (f *FaultInjector) FileSystem(fs FileSystem) FileSystem {
+	return &faultFS{injector: f, inner: fs}
+}
+
+// FaultIO: an IOManager whose calls fail as its FaultInjector scripts
+type FaultIO struct {
+	injector *FaultInjector
+	name     string
+	inner    IOManager
+}
+
+func (m *FaultIO) Read(buf []byte, offset int64) (int, error) {
+	return m.inner.Read(buf, offset)
+}
+
+func (m *FaultIO) Write(buf []byte) (int, error) {
+	fault, err := m.injector.inject(WriteCall)
+	if err != nil {
+		return 0, err
+	}
+	return faultyWrite(fault, buf, m.inner.Write)
+}
+
+// faultyWrite writes buf by write, short or corrupted as fault says
+func faultyWrite(fault *Fault, buf []byte, write func([]byte) (int, error)) (int, error) {
+	if fault == nil {
+		return write(buf)
+	}
+
+	if fault.Kind == FaultShortWrite {
+		n, err := write(buf[:len(buf)/2])
+		if err == nil {
+			err = ErrInjectedFault
+		}
+		return n, err
+	}
+	corrupted := append([]byte(nil), buf...)
+	if len(corrupted) > 0 {
+		corrupted[len(corrupted)/2] ^= 0xff
+	}
+	return write(corrupted)
+}
+
+func (m *FaultIO) Sync() error {
+	if _, err := m.injector.inject(SyncCall); err != nil {
+		return err
+	}
+	if err := m.inner.Sync(); err != nil {
+		return err
+	}
+	size, err := m.inner.Size()
+	if err != nil {
+		return err
+	}
+	m.injector.synced(m.name, size)
+	return nil
+}
+
+func (m *FaultIO) Close() error {
+	return m.inner.Close()
+}
+
+func (m *FaultIO) Size() (int64, error) {
+	return m.inner.Size()
+}
+
+func (m *FaultIO) Truncate(size int64) error {
+	if _, err := m.injector.inject(TruncateCall); err != nil {
+		return err
+	}
+	if err := m.inner.Truncate(size); err != nil {
+		return err
+	}
+	m.injector.truncated(m.name, size)
+	return nil
+}
+
+type faultFS struct {
+	injector *FaultInjector
+	inner    FileSystem
+}
+
+func (fs *faultFS) Stat(name string) (os.FileInfo, error) {
+	return fs.inner.Stat(name)
+}
+
+func (fs *faultFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return fs.inner.ReadDir(name)
+}
+
+func (fs *faultFS) Mkdir(name string) error {
+	if _, err := fs.injector.inject(MetaCall); err != nil {
+		return err
+	}
+	return fs.inner.Mkdir(name)
+}
+
+func (fs *faultFS) MkdirAll(name string) error {
+	if _, err := fs.injector.inject(MetaCall); err != nil {
+		return err
+	}
+	return fs.inner.MkdirAll(name)
+}
+
+func (fs *faultFS) Remove(name string) error {
+	if _, err := fs.injector.inject(MetaCall); err != nil {
+		return err
+	}
+	if err := fs.inner.Remove(name); err != nil {
+		return err
+	}
+	fs.injector.removed(name)
+	return nil
+}
+
+func (fs *faultFS) RemoveAll(name string) error {
+	if _, err := fs.injector.inject(MetaCall); err != nil {
+		return err
+	}
+	if err := fs.inner.RemoveAll(name); err != nil {
+		return err
+	}
+	fs.injector.removed(name)
+	return nil
+}
+
+func (fs *faultFS) Rename(oldName, newName string) error {
+	if _, err := fs.injector.inject(MetaCall); err != nil {
+		return err
+	}
+	if err := fs.inner.Rename(oldName, newName); err != nil {
+		return err
+	}
+	fs.injector.removed(newName)
+	fs.injector.renamed(oldName, newName, false)
+	return nil
+}
+
+func (fs *faultFS) Link(oldName, newName string) error {
+	if _, err := fs.injector.inject(MetaCall); err != nil {
+		return err
+	}
+	if err := fs.inner.Link(oldName, newName); err != nil {
+		return err
+	}
+	fs.injector.renamed(oldName, newName, true)
+	return nil
+}
+
+func (fs *faultFS) Open(name string) (File, error) {
+	return fs.inner.Open(name)
+}
+
+func (fs *faultFS) Create(name string) (File, error) {
+	if _, err := fs.injector.inject(MetaCall); err != nil {
+		return nil, err
+	}
+	file, err := fs.inner.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	fs.injector.track(name, 0, fs.inner == Memory)
+	return &faultFile{injector: fs.injector, name: name, inner: file}, nil
+}
+
+func (fs *faultFS) SyncDir(name string) error {
+	if _, err := fs.injector.inject(MetaCall); err != nil {
+		return err
+	}
+	return fs.inner.SyncDir(name)
+}
+
+func (fs *faultFS) TryLock(name string) (FileLock, bool, error) {
+	return fs.inner.TryLock(name)
+}
+
+// faultFile: a file created by faultFS
+type faultFile struct {
+	injector *FaultInjector
+	name     string
+	inner    File
+	written  int64
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	return f.inner.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, offset int64) (int, error) {
+	return f.inner.ReadAt(p, offset)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	fault, err := f.injector.inject(WriteCall)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := faultyWrite(fault, p, f.inner.Write)
+	f.written += int64(n)
+	return n, err
+}
+
+func (f *faultFile) Close() error {
+	return f.inner.Close()
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	return f.inner.Stat()
+}
+
+func (f *faultFile) Sync() error {
+	if _, err := f.injector.inject(SyncCall); err != nil {
+		return err
+	}
+	if err := f.inner.Sync(); err != nil {
+		return err
+	}
+	// a created file has only the bytes written to it
+	f.injector.synced(f.name, f.written)
+	return nil
+}
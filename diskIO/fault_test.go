@@ -0,0 +1,88 @@
+package diskIO
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFaultIO(t *testing.T) {
+	defer Memory.RemoveAll("/fault")
+	assert.Nil(t, Memory.MkdirAll("/fault"))
+
+	injector := NewFaultInjector(
+		Fault{Call: WriteCall, At: 2, Kind: FaultShortWrite},
+		Fault{Call: WriteCall, At: 3, Kind: FaultCorrupt},
+		Fault{Call: SyncCall, At: 1, Kind: FaultError},
+		Fault{Call: AnyCall, At: 8, Kind: FaultCrash},
+	)
+	manager, err := NewIOManagerWithOptions("/fault/a", MemoryIO, IOOptions{Faults: injector})
+	assert.Nil(t, err)
+
+	n, err := manager.Write([]byte("aaaa"))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	n, err = manager.Write([]byte("bbbb"))
+	assert.Equal(t, ErrInjectedFault, err)
+	assert.Equal(t, 2, n)
+	_, err = manager.Write([]byte("cccc"))
+	assert.Nil(t, err)
+
+	buf := make([]byte, 10)
+	_, err = manager.Read(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("aaaabbcc"), buf[:8])
+	assert.NotEqual(t, byte('c'), buf[8])
+
+	// the failed sync syncs nothing
+	assert.Equal(t, ErrInjectedFault, manager.Sync())
+	assert.Nil(t, manager.Truncate(6))
+	assert.Nil(t, manager.Sync())
+	_, err = manager.Write([]byte("dddd"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(7), injector.Calls())
+
+	// a file created through the file system
+	fs := injector.FileSystem(Memory)
+	_, err = fs.Create("/fault/b")
+	assert.Equal(t, ErrInjectedCrash, err)
+	assert.True(t, injector.Crashed())
+	_, err = manager.Write([]byte("eeee"))
+	assert.Equal(t, ErrInjectedCrash, err)
+	assert.Equal(t, int64(8), injector.Calls())
+
+	// the bytes after the last sync are lost
+	assert.Nil(t, injector.DropUnsynced())
+	size, err := manager.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), size)
+}
+
+func TestFaultFS(t *testing.T) {
+	defer Memory.RemoveAll("/fault-fs")
+	assert.Nil(t, Memory.MkdirAll("/fault-fs"))
+
+	injector := NewFaultInjector(Fault{Call: MetaCall, At: 3, Kind: FaultError})
+	fs := FileSystemWithOptions(MemoryIO, IOOptions{Faults: injector})
+
+	file, err := fs.Create("/fault-fs/a.tmp")
+	assert.Nil(t, err)
+	_, err = file.Write([]byte("synced"))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Sync())
+	_, err = file.Write([]byte("lost"))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+
+	// the synced size moves with the file
+	assert.Nil(t, fs.Rename("/fault-fs/a.tmp", "/fault-fs/a"))
+	assert.Equal(t, ErrInjectedFault, fs.Link("/fault-fs/a", "/fault-fs/b"))
+	_, err = fs.Stat("/fault-fs/b")
+	assert.NotNil(t, err)
+
+	assert.Nil(t, injector.DropUnsynced())
+	info, err := fs.Stat("/fault-fs/a")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), info.Size())
+	assert.False(t, injector.Crashed())
+}
@@ -0,0 +1,118 @@
+package diskIO
+
+import (
+	"io"
+	"os"
+
+	"github.com/gofrs/flock"
+)
+
+// FileSystem: the file operations of the db besides reading and writing blocks,
+// so the whole db can live in memory
+type FileSystem interface {
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.DirEntry, error)
+	Mkdir(name string) error
+	MkdirAll(name string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldName, newName string) error
+	Link(oldName, newName string) error
+	// Open a file to read
+	Open(name string) (File, error)
+	// Create a new file to write, it fails if the file exists
+	Create(name string) (File, error)
+	SyncDir(name string) error
+	// TryLock: ok is false if the lock is held by others
+	TryLock(name string) (lock FileLock, ok bool, err error)
+}
+
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Sync() error
+}
+
+type FileLock interface {
+	Unlock() error
+}
+
+// OS: the file system of the operating system
+var OS FileSystem = osFS{}
+
+// FileSystemOf: the file system where files of ioType are
+func FileSystemOf(ioType IOType) FileSystem {
+	if ioType == MemoryIO {
+		return Memory
+	}
+	return OS
+}
+
+// FileSystemWithOptions: FileSystemOf ioType, wrapped by options.Faults if set
+func FileSystemWithOptions(ioType IOType, options IOOptions) FileSystem {
+	fs := FileSystemOf(ioType)
+	if options.Faults != nil {
+		return options.Faults.FileSystem(fs)
+	}
+	return fs
+}
+
+type osFS struct{}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+func (osFS) Mkdir(name string) error {
+	return os.Mkdir(name, os.ModePerm)
+}
+
+func (osFS) MkdirAll(name string) error {
+	return os.MkdirAll(name, os.ModePerm)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (osFS) Rename(oldName, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (osFS) Link(oldName, newName string) error {
+	return os.Link(oldName, newName)
+}
+
+func (osFS) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+func (osFS) Create(name string) (File, error) {
+	return os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, BlockFileMode)
+}
+
+func (osFS) SyncDir(name string) error {
+	dir, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (osFS) TryLock(name string) (FileLock, bool, error) {
+	lock := flock.New(name)
+	ok, err := lock.TryLock()
+	return lock, ok, err
+}
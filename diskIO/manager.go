@@ -1,5 +1,7 @@
 package diskIO
 
+import "time"
+
 type IOManager interface {
 	Read([]byte, int64) (int, error)
 
@@ -10,10 +12,43 @@ type IOManager interface {
 	Close() error
 
 	Size() (int64, error)
+	Truncate(int64) error
+}
+
+// IOOptions: settings of the io types which need them
+type IOOptions struct {
+	// Prealloc: the size a MMapWriteIO file grows to on the first write
+	Prealloc int64
+	// BufferSize: bytes a BufferedIO keeps in memory before writing them, 0 means DefaultBufferSize
+	BufferSize int
+	// FlushInterval: buffered bytes are flushed in background after it, 0 means only when full or synced
+	FlushInterval time.Duration
+	// SyncOnFlush: fsync after a background flush
+	SyncOnFlush bool
+	// Faults: if set, the file is wrapped by a FaultIO, for tests
+	Faults *FaultInjector
 }
 
 func NewIOManager(fileName string, ioType IOType) (IOManager, error) {
+	return NewIOManagerWithOptions(fileName, ioType, IOOptions{})
+}
+
+func NewIOManagerWithOptions(fileName string, ioType IOType, options IOOptions) (IOManager, error) {
+	manager, err := newIOManager(fileName, ioType, options)
+	if err != nil || options.Faults == nil {
+		return manager, err
+	}
+	return options.Faults.IOManager(fileName, ioType, manager)
+}
+
+func newIOManager(fileName string, ioType IOType, options IOOptions) (IOManager, error) {
 	switch ioType {
+	case MemoryIO:
+		return NewMemIOManager(fileName)
+	case BufferedIO:
+		return NewBufferedWriterIOManager(fileName, options)
+	case MMapWriteIO:
+		return NewMMapWriterIOManager(fileName, options.Prealloc)
 	case MMapIO:
 		return NewMMapIOManager(fileName)
 	case FileSystemIO:
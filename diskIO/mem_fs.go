@@ -0,0 +1,407 @@
+package diskIO
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory: the in memory file system of the process, files live until they are removed
+var Memory = NewMemFS()
+
+// MemFS keeps files and dirs in maps, by cleaned path.
+// an open file keeps its data after it is removed or renamed, like unix
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+	dirs  map[string]time.Time
+	locks map[string]struct{}
+}
+
+type memFile struct {
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memFile),
+		dirs:  make(map[string]time.Time),
+		locks: make(map[string]struct{}),
+	}
+}
+
+func memPathError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// openFile returns the file of name, and creates it if create is true
+func (m *MemFS) openFile(name string, create bool) (*memFile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if file, ok := m.files[name]; ok {
+		return file, nil
+	}
+	if !create {
+		return nil, memPathError("open", name, fs.ErrNotExist)
+	}
+	if _, ok := m.dirs[name]; ok {
+		return nil, memPathError("open", name, fs.ErrExist)
+	}
+
+	file := &memFile{modTime: time.Now()}
+	m.files[name] = file
+	return file, nil
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if file, ok := m.files[name]; ok {
+		return file.info(filepath.Base(name)), nil
+	}
+	if modTime, ok := m.dirs[name]; ok {
+		return &memFileInfo{name: filepath.Base(name), mode: fs.ModeDir | os.ModePerm, modTime: modTime}, nil
+	}
+	return nil, memPathError("stat", name, fs.ErrNotExist)
+}
+
+// ReadDir lists the files and dirs right under name, sorted by name
+func (m *MemFS) ReadDir(name string) ([]os.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := m.dirs[name]; !ok {
+		return nil, memPathError("readdir", name, fs.ErrNotExist)
+	}
+
+	var entries []os.DirEntry
+	for path, file := range m.files {
+		if filepath.Dir(path) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(file.info(filepath.Base(path))))
+		}
+	}
+	for path, modTime := range m.dirs {
+		if path != name && filepath.Dir(path) == name {
+			info := &memFileInfo{name: filepath.Base(path), mode: fs.ModeDir | os.ModePerm, modTime: modTime}
+			entries = append(entries, fs.FileInfoToDirEntry(info))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+func (m *MemFS) Mkdir(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := m.dirs[name]; ok {
+		return memPathError("mkdir", name, fs.ErrExist)
+	}
+	if _, ok := m.files[name]; ok {
+		return memPathError("mkdir", name, fs.ErrExist)
+	}
+	m.dirs[name] = time.Now()
+	return nil
+}
+
+func (m *MemFS) MkdirAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := m.files[name]; ok {
+		return memPathError("mkdir", name, fs.ErrExist)
+	}
+	if _, ok := m.dirs[name]; !ok {
+		m.dirs[name] = time.Now()
+	}
+	return nil
+}
+
+// Remove a file, or an empty dir
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if _, ok := m.dirs[name]; !ok {
+		return memPathError("remove", name, fs.ErrNotExist)
+	}
+	if m.hasChild(name) {
+		return memPathError("remove", name, fs.ErrExist)
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *MemFS) hasChild(dir string) bool {
+	prefix := dir + string(filepath.Separator)
+	for path := range m.files {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	for path := range m.dirs {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MemFS) RemoveAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	prefix := name + string(filepath.Separator)
+	for path := range m.files {
+		if path == name || strings.HasPrefix(path, prefix) {
+			delete(m.files, path)
+		}
+	}
+	for path := range m.dirs {
+		if path == name || strings.HasPrefix(path, prefix) {
+			delete(m.dirs, path)
+		}
+	}
+	return nil
+}
+
+// Rename a file, or a dir with everything under it
+func (m *MemFS) Rename(oldName, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldName, newName = filepath.Clean(oldName), filepath.Clean(newName)
+	if file, ok := m.files[oldName]; ok {
+		if _, ok := m.dirs[newName]; ok {
+			return memPathError("rename", newName, fs.ErrExist)
+		}
+		delete(m.files, oldName)
+		m.files[newName] = file
+		return nil
+	}
+
+	modTime, ok := m.dirs[oldName]
+	if !ok {
+		return memPathError("rename", oldName, fs.ErrNotExist)
+	}
+	if _, ok := m.files[newName]; ok {
+		return memPathError("rename", newName, fs.ErrExist)
+	}
+	if m.hasChild(newName) {
+		return memPathError("rename", newName, fs.ErrExist)
+	}
+
+	oldPrefix := oldName + string(filepath.Separator)
+	newPrefix := newName + string(filepath.Separator)
+	for path, file := range m.files {
+		if strings.HasPrefix(path, oldPrefix) {
+			delete(m.files, path)
+			m.files[newPrefix+strings.TrimPrefix(path, oldPrefix)] = file
+		}
+	}
+	for path, dirTime := range m.dirs {
+		if strings.HasPrefix(path, oldPrefix) {
+			delete(m.dirs, path)
+			m.dirs[newPrefix+strings.TrimPrefix(path, oldPrefix)] = dirTime
+		}
+	}
+	delete(m.dirs, oldName)
+	m.dirs[newName] = modTime
+	return nil
+}
+
+// Link: both names share the data, like a hard link
+func (m *MemFS) Link(oldName, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldName, newName = filepath.Clean(oldName), filepath.Clean(newName)
+	file, ok := m.files[oldName]
+	if !ok {
+		return memPathError("link", oldName, fs.ErrNotExist)
+	}
+	_, fileExists := m.files[newName]
+	_, dirExists := m.dirs[newName]
+	if fileExists || dirExists {
+		return memPathError("link", newName, fs.ErrExist)
+	}
+	m.files[newName] = file
+	return nil
+}
+
+func (m *MemFS) Open(name string) (File, error) {
+	file, err := m.openFile(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return &memHandle{file: file, name: filepath.Base(name)}, nil
+}
+
+func (m *MemFS) Create(name string) (File, error) {
+	m.mu.Lock()
+	_, fileExists := m.files[filepath.Clean(name)]
+	m.mu.Unlock()
+	if fileExists {
+		return nil, memPathError("open", name, fs.ErrExist)
+	}
+
+	file, err := m.openFile(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return &memHandle{file: file, name: filepath.Base(name)}, nil
+}
+
+func (m *MemFS) SyncDir(name string) error {
+	_, err := m.Stat(name)
+	return err
+}
+
+// TryLock creates the lock file, as flock does
+func (m *MemFS) TryLock(name string) (FileLock, bool, error) {
+	if _, err := m.openFile(name, true); err != nil {
+		return nil, false, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := m.locks[name]; ok {
+		return nil, false, nil
+	}
+	m.locks[name] = struct{}{}
+	return &memLock{fs: m, name: name}, true, nil
+}
+
+type memLock struct {
+	fs   *MemFS
+	name string
+}
+
+func (l *memLock) Unlock() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+	delete(l.fs.locks, l.name)
+	return nil
+}
+
+func (f *memFile) info(name string) *memFileInfo {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return &memFileInfo{name: name, size: int64(len(f.data)), mode: BlockFileMode, modTime: f.modTime}
+}
+
+func (f *memFile) readAt(p []byte, offset int64) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if offset >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) write(p []byte) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.data = append(f.data, p...)
+	f.modTime = time.Now()
+	return int64(len(f.data))
+}
+
+func (f *memFile) size() int64 {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return int64(len(f.data))
+}
+
+func (f *memFile) truncate(size int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if size <= int64(len(f.data)) {
+		f.data = f.data[:size:size]
+	} else {
+		f.data = append(f.data, make([]byte, size-int64(len(f.data)))...)
+	}
+	f.modTime = time.Now()
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) Mode() fs.FileMode  { return i.mode }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() any           { return nil }
+
+// memHandle: a File of MemFS, reads from its offset and appends writes
+type memHandle struct {
+	file   *memFile
+	name   string
+	offset int64
+}
+
+func (h *memHandle) Read(p []byte) (int, error) {
+	n, err := h.file.readAt(p, h.offset)
+	h.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (h *memHandle) ReadAt(p []byte, offset int64) (int, error) {
+	return h.file.readAt(p, offset)
+}
+
+func (h *memHandle) Write(p []byte) (int, error) {
+	h.file.write(p)
+	return len(p), nil
+}
+
+func (h *memHandle) Close() error {
+	return nil
+}
+
+func (h *memHandle) Stat() (os.FileInfo, error) {
+	return h.file.info(h.name), nil
+}
+
+func (h *memHandle) Sync() error {
+	return nil
+}
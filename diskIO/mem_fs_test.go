@@ -0,0 +1,93 @@
+package diskIO
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemFS(t *testing.T) {
+	fs := NewMemFS()
+	assert.Nil(t, fs.Mkdir("/mem/a"))
+	assert.True(t, os.IsExist(fs.Mkdir("/mem/a")))
+
+	file, err := fs.Create("/mem/a/f")
+	assert.Nil(t, err)
+	_, err = file.Write([]byte("fffff"))
+	assert.Nil(t, err)
+	assert.Nil(t, file.Close())
+	_, err = fs.Create("/mem/a/f")
+	assert.True(t, os.IsExist(err))
+
+	// a hard link shares the data
+	assert.Nil(t, fs.Link("/mem/a/f", "/mem/a/g"))
+	assert.Nil(t, fs.Remove("/mem/a/f"))
+	_, err = fs.Stat("/mem/a/f")
+	assert.True(t, os.IsNotExist(err))
+	info, err := fs.Stat("/mem/a/g")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), info.Size())
+
+	// a dir is renamed with its files
+	assert.Nil(t, fs.Mkdir("/mem/a/sub"))
+	assert.True(t, os.IsExist(fs.Remove("/mem/a")))
+	assert.Nil(t, fs.Rename("/mem/a", "/mem/b"))
+	entries, err := fs.ReadDir("/mem/b")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, "g", entries[0].Name())
+	assert.True(t, entries[1].IsDir())
+
+	reader, err := fs.Open("/mem/b/g")
+	assert.Nil(t, err)
+	data, err := io.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("fffff"), data)
+
+	lock, ok, err := fs.TryLock("/mem/b/LOCK")
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	_, ok, err = fs.TryLock("/mem/b/LOCK")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+	assert.Nil(t, lock.Unlock())
+	_, ok, _ = fs.TryLock("/mem/b/LOCK")
+	assert.True(t, ok)
+
+	assert.Nil(t, fs.RemoveAll("/mem"))
+	_, err = fs.Stat("/mem/b/g")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMemIO(t *testing.T) {
+	path := "/mem-io/a.data"
+	defer Memory.RemoveAll("/mem-io")
+
+	memIO, err := NewIOManager(path, MemoryIO)
+	assert.Nil(t, err)
+	_, err = memIO.Write([]byte("fffffggggg"))
+	assert.Nil(t, err)
+	assert.Nil(t, memIO.Sync())
+
+	b := make([]byte, 8)
+	n, err := memIO.Read(b, 5)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []byte("ggggg"), b[:n])
+
+	assert.Nil(t, memIO.Truncate(5))
+	size, err := memIO.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), size)
+	assert.Nil(t, memIO.Close())
+
+	// the data stays in Memory after close
+	memIO, err = NewIOManager(path, MemoryIO)
+	assert.Nil(t, err)
+	size, err = memIO.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), size)
+	assert.Nil(t, memIO.Close())
+	assert.Equal(t, os.ErrClosed, memIO.Close())
+}
@@ -0,0 +1,62 @@
+package diskIO
+
+import (
+	"os"
+	"sync/atomic"
+)
+
+// MemIO: a file of Memory, the IOManager of a db in memory
+type MemIO struct {
+	file   *memFile
+	closed atomic.Bool
+}
+
+// NewMemIOManager opens fileName in Memory, and creates it if missing
+func NewMemIOManager(fileName string) (*MemIO, error) {
+	file, err := Memory.openFile(fileName, true)
+	if err != nil {
+		return nil, err
+	}
+	return &MemIO{file: file}, nil
+}
+
+func (m *MemIO) Read(buf []byte, offset int64) (int, error) {
+	if m.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	return m.file.readAt(buf, offset)
+}
+
+func (m *MemIO) Write(buf []byte) (int, error) {
+	if m.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	m.file.write(buf)
+	return len(buf), nil
+}
+
+func (m *MemIO) Sync() error {
+	if m.closed.Load() {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (m *MemIO) Close() error {
+	if !m.closed.CompareAndSwap(false, true) {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (m *MemIO) Size() (int64, error) {
+	return m.file.size(), nil
+}
+
+func (m *MemIO) Truncate(size int64) error {
+	if m.closed.Load() {
+		return os.ErrClosed
+	}
+	m.file.truncate(size)
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 // MMap
 type MMap struct {
 	readerPos *mmap.ReaderAt
+	fileName  string
 }
 
 // NewMMapIOManager 初始化 MMap IO
@@ -22,7 +23,7 @@ func NewMMapIOManager(fileName string) (*MMap, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &MMap{readerPos: readerPos}, nil
+	return &MMap{readerPos: readerPos, fileName: fileName}, nil
 }
 
 func (m *MMap) Read(buf []byte, offset int64) (int, error) {
@@ -44,3 +45,21 @@ func (m *MMap) Sync() error {
 func (m *MMap) Write([]byte) (int, error) {
 	panic("not support write with MMap")
 }
+
+// Truncate the file, and map it again
+func (m *MMap) Truncate(size int64) error {
+	if err := m.readerPos.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Truncate(m.fileName, size); err != nil {
+		return err
+	}
+
+	readerPos, err := mmap.Open(m.fileName)
+	if err != nil {
+		return err
+	}
+	m.readerPos = readerPos
+	return nil
+}
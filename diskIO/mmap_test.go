@@ -41,3 +41,22 @@ func TestMMapRead(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, 2, n2)
 }
+
+func TestMMapTruncate(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-truncate.data")
+	defer destroyFile(path)
+
+	fio, err := NewFileIOManager(path)
+	assert.Nil(t, err)
+	_, err = fio.Write([]byte("fffffggggg"))
+	assert.Nil(t, err)
+
+	mmapIO, err := NewMMapIOManager(path)
+	assert.Nil(t, err)
+	err = mmapIO.Truncate(5)
+	assert.Nil(t, err)
+
+	size, err := mmapIO.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), size)
+}
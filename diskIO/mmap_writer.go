@@ -0,0 +1,203 @@
+//go:build linux
+
+package diskIO
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// MMapWriter: a read/write mmap of the file, writes are copied into the mapping.
+// the file is preallocated, and trimmed to the written size on Close
+type MMapWriter struct {
+	mu   sync.RWMutex
+	fd   *os.File
+	data []byte
+	// size: bytes written, the file is larger while it is preallocated
+	size     int64
+	prealloc int64
+	closed   bool
+}
+
+// NewMMapWriterIOManager maps fileName, the file grows to prealloc on the first write.
+// after a crash the file still has its preallocated zero tail, which is counted in Size,
+// until the owner finds the last write and truncates the file to it
+func NewMMapWriterIOManager(fileName string, prealloc int64) (*MMapWriter, error) {
+	fd, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, BlockFileMode)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := fd.Stat()
+	if err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+
+	m := &MMapWriter{fd: fd, size: fi.Size(), prealloc: prealloc}
+	if err := m.mmap(fi.Size()); err != nil {
+		_ = fd.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// mmap the first length bytes of file, an empty file is not mapped
+func (m *MMapWriter) mmap(length int64) error {
+	if length == 0 {
+		m.data = nil
+		return nil
+	}
+
+	data, err := syscall.Mmap(int(m.fd.Fd()), 0, int(length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	m.data = data
+	return nil
+}
+
+func (m *MMapWriter) munmap() error {
+	if m.data == nil {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	return syscall.Munmap(data)
+}
+
+// grow the file and the mapping to hold at least need bytes
+func (m *MMapWriter) grow(need int64) error {
+	capacity := int64(len(m.data)) * 2
+	if capacity < m.prealloc {
+		capacity = m.prealloc
+	}
+	if capacity < need {
+		capacity = need
+	}
+
+	if err := m.munmap(); err != nil {
+		return err
+	}
+	if err := syscall.Fallocate(int(m.fd.Fd()), 0, 0, capacity); err != nil {
+		// the file system can not preallocate, extend the file with a hole
+		if err != syscall.EOPNOTSUPP {
+			return err
+		}
+		if err := m.fd.Truncate(capacity); err != nil {
+			return err
+		}
+	}
+	return m.mmap(capacity)
+}
+
+func (m *MMapWriter) Read(buf []byte, offset int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return 0, os.ErrClosed
+	}
+	if offset >= m.size {
+		return 0, io.EOF
+	}
+	n := copy(buf, m.data[offset:m.size])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *MMapWriter) Write(buf []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return 0, os.ErrClosed
+	}
+	need := m.size + int64(len(buf))
+	if need > int64(len(m.data)) {
+		if err := m.grow(need); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(m.data[m.size:], buf)
+	m.size += int64(n)
+	return n, nil
+}
+
+// Sync flushes the written pages with msync
+func (m *MMapWriter) Sync() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return os.ErrClosed
+	}
+	if m.size == 0 {
+		return nil
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC,
+		uintptr(unsafe.Pointer(&m.data[0])), uintptr(m.size), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Close trims the preallocated tail, so the file ends with the last write.
+// a file of the right size is not touched, it may be hard linked by a checkpoint
+func (m *MMapWriter) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return os.ErrClosed
+	}
+	m.closed = true
+	if err := m.munmap(); err != nil {
+		return err
+	}
+
+	fi, err := m.fd.Stat()
+	if err == nil && fi.Size() != m.size {
+		err = m.fd.Truncate(m.size)
+	}
+	if err != nil {
+		_ = m.fd.Close()
+		return err
+	}
+	return m.fd.Close()
+}
+
+func (m *MMapWriter) Size() (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.size, nil
+}
+
+// Truncate the file to size, the preallocated tail is dropped too.
+// the new size is synced, so a crash does not bring the tail back
+func (m *MMapWriter) Truncate(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return os.ErrClosed
+	}
+	if err := m.munmap(); err != nil {
+		return err
+	}
+	if err := m.fd.Truncate(size); err != nil {
+		return err
+	}
+	if err := m.fd.Sync(); err != nil {
+		return err
+	}
+	m.size = size
+	return m.mmap(size)
+}
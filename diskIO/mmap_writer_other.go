@@ -0,0 +1,15 @@
+//go:build !linux
+
+package diskIO
+
+import "errors"
+
+var ErrMMapWriterNotSupported = errors.New("mmap writer is only supported on linux")
+
+type MMapWriter struct {
+	IOManager
+}
+
+func NewMMapWriterIOManager(fileName string, prealloc int64) (*MMapWriter, error) {
+	return nil, ErrMMapWriterNotSupported
+}
@@ -0,0 +1,133 @@
+//go:build linux
+
+package diskIO
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMMapWriter(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-writer.data")
+	defer destroyFile(path)
+
+	mmapIO, err := NewMMapWriterIOManager(path, 64)
+	assert.Nil(t, err)
+
+	b1 := make([]byte, 10)
+	n, err := mmapIO.Read(b1, 0)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, io.EOF, err)
+
+	n, err = mmapIO.Write([]byte("fffffggggg"))
+	assert.Nil(t, err)
+	assert.Equal(t, 10, n)
+	assert.Nil(t, mmapIO.Sync())
+
+	// preallocated on the first write
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(64), fi.Size())
+	size, err := mmapIO.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), size)
+
+	n, err = mmapIO.Read(b1, 5)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, []byte("ggggg"), b1[:n])
+
+	// grow beyond prealloc
+	large := make([]byte, 100)
+	for i := range large {
+		large[i] = 'h'
+	}
+	_, err = mmapIO.Write(large)
+	assert.Nil(t, err)
+	fi, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(128), fi.Size())
+
+	b2 := make([]byte, 110)
+	n, err = mmapIO.Read(b2, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 110, n)
+	assert.Equal(t, []byte("fffffggggg"), b2[:10])
+	assert.Equal(t, large, b2[10:])
+
+	// trimmed on close
+	assert.Nil(t, mmapIO.Close())
+	fi, err = os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(110), fi.Size())
+
+	// reopen and append
+	mmapIO, err = NewMMapWriterIOManager(path, 64)
+	assert.Nil(t, err)
+	size, err = mmapIO.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(110), size)
+	_, err = mmapIO.Write([]byte("iiiii"))
+	assert.Nil(t, err)
+	assert.Nil(t, mmapIO.Close())
+
+	fio, err := NewFileIOManager(path)
+	assert.Nil(t, err)
+	b3 := make([]byte, 115)
+	_, err = fio.Read(b3, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("iiiii"), b3[110:])
+	assert.Nil(t, fio.Close())
+}
+
+func TestMMapWriterTruncate(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-writer-truncate.data")
+	defer destroyFile(path)
+
+	mmapIO, err := NewMMapWriterIOManager(path, 1024)
+	assert.Nil(t, err)
+	_, err = mmapIO.Write([]byte("fffffggggg"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, mmapIO.Truncate(5))
+	size, err := mmapIO.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), size)
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), fi.Size())
+
+	_, err = mmapIO.Write([]byte("hhhhh"))
+	assert.Nil(t, err)
+	b := make([]byte, 10)
+	_, err = mmapIO.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("fffffhhhhh"), b)
+	assert.Nil(t, mmapIO.Close())
+}
+
+func TestMMapWriterCloseUnchanged(t *testing.T) {
+	path := filepath.Join("/tmp", "mmap-writer-unchanged.data")
+	defer destroyFile(path)
+	assert.Nil(t, os.WriteFile(path, []byte("fffffggggg"), 0644))
+
+	// a file only read is not truncated on close
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	assert.Nil(t, os.Chtimes(path, old, old))
+	mmapIO, err := NewMMapWriterIOManager(path, 1024)
+	assert.Nil(t, err)
+	b := make([]byte, 10)
+	_, err = mmapIO.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, mmapIO.Close())
+
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, old, fi.ModTime())
+	assert.Equal(t, int64(10), fi.Size())
+}
@@ -13,12 +13,15 @@ import (
 type AdaptiveRadixTree struct {
 	tree     artTree.Tree
 	treeLock *sync.RWMutex
+	// open snapshots, each keeps the old position of keys changed after it
+	snapshots map[*artSnapshot]struct{}
 }
 
 func NewAdaptiveRadixTree() *AdaptiveRadixTree {
 	return &AdaptiveRadixTree{
-		tree:     artTree.New(),
-		treeLock: new(sync.RWMutex),
+		tree:      artTree.New(),
+		treeLock:  new(sync.RWMutex),
+		snapshots: make(map[*artSnapshot]struct{}),
 	}
 }
 
@@ -40,9 +43,11 @@ func (a *AdaptiveRadixTree) Delete(key []byte) (*content.LogStructIndex, bool) {
 	oldIndexer, hasDeleted := a.tree.Delete(key)
 
 	if oldIndexer == nil {
+		a.keepOld(key, nil)
 		return nil, hasDeleted
 	}
 
+	a.keepOld(key, oldIndexer.(*content.LogStructIndex))
 	return oldIndexer.(*content.LogStructIndex), hasDeleted
 }
 
@@ -60,15 +65,173 @@ func (a *AdaptiveRadixTree) Put(key []byte, position *content.LogStructIndex) *c
 
 	oldIndexer, _ := a.tree.Insert(key, position)
 	if oldIndexer != nil {
+		a.keepOld(key, oldIndexer.(*content.LogStructIndex))
 		return oldIndexer.(*content.LogStructIndex)
 	}
+	a.keepOld(key, nil)
 	return nil
 }
 
+// keepOld: the key is changed, snapshots which have not seen a change of it keep the old position.
+// must hold the write lock
+func (a *AdaptiveRadixTree) keepOld(key []byte, old *content.LogStructIndex) {
+	for snap := range a.snapshots {
+		if _, ok := snap.changed[string(key)]; !ok {
+			snap.changed[string(key)] = old
+		}
+	}
+}
+
 func (a *AdaptiveRadixTree) Destroy() error {
 	return nil
 }
 
+// art tree has no copy-on-write, copy every node
+func (a *AdaptiveRadixTree) Clone() Indexer {
+	a.treeLock.RLock()
+	defer a.treeLock.RUnlock()
+
+	tree := artTree.New()
+	a.tree.ForEach(func(node artTree.Node) bool {
+		tree.Insert(node.Key(), node.Value())
+		return true
+	})
+
+	return &AdaptiveRadixTree{
+		tree:      tree,
+		treeLock:  new(sync.RWMutex),
+		snapshots: make(map[*artSnapshot]struct{}),
+	}
+}
+
+// art tree has no copy-on-write, so the snapshot reads the tree itself,
+// and the tree keeps the old position of each key changed after the snapshot
+func (a *AdaptiveRadixTree) Snapshot() Indexer {
+	a.treeLock.Lock()
+	defer a.treeLock.Unlock()
+
+	snap := &artSnapshot{
+		tree:    a,
+		changed: make(map[string]*content.LogStructIndex),
+	}
+	a.snapshots[snap] = struct{}{}
+	return snap
+}
+
+// ######################## snapshot ########################
+
+// artSnapshot: a read only view of an art tree at the time it is taken
+type artSnapshot struct {
+	tree *AdaptiveRadixTree
+	// key -> position when the snapshot is taken, nil if the key did not exist
+	changed map[string]*content.LogStructIndex
+}
+
+func (s *artSnapshot) Get(key []byte) *content.LogStructIndex {
+	s.tree.treeLock.RLock()
+	defer s.tree.treeLock.RUnlock()
+
+	if old, ok := s.changed[string(key)]; ok {
+		return old
+	}
+	if value, ok := s.tree.tree.Search(key); ok {
+		return value.(*content.LogStructIndex)
+	}
+	return nil
+}
+
+func (s *artSnapshot) Put(key []byte, position *content.LogStructIndex) *content.LogStructIndex {
+	panic("snapshot of index is read only")
+}
+
+func (s *artSnapshot) Delete(key []byte) (*content.LogStructIndex, bool) {
+	panic("snapshot of index is read only")
+}
+
+func (s *artSnapshot) Size() int {
+	s.tree.treeLock.RLock()
+	defer s.tree.treeLock.RUnlock()
+
+	size := s.tree.tree.Size()
+	for key, old := range s.changed {
+		if _, ok := s.tree.tree.Search(artTree.Key(key)); ok {
+			size--
+		}
+		if old != nil {
+			size++
+		}
+	}
+	return size
+}
+
+// entries: positions of the snapshot in the order of keys
+func (s *artSnapshot) entries() []*Entry {
+	s.tree.treeLock.RLock()
+	defer s.tree.treeLock.RUnlock()
+
+	entries := make([]*Entry, 0, s.tree.tree.Size())
+	s.tree.tree.ForEach(func(node artTree.Node) bool {
+		if _, ok := s.changed[string(node.Key())]; !ok {
+			entries = append(entries, &Entry{
+				Key:      node.Key(),
+				Position: node.Value().(*content.LogStructIndex),
+			})
+		}
+		return true
+	})
+	for key, old := range s.changed {
+		if old != nil {
+			entries = append(entries, &Entry{Key: []byte(key), Position: old})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].Key, entries[j].Key) < 0
+	})
+	return entries
+}
+
+func (s *artSnapshot) Iterator(reverse bool) Iterator {
+	entries := s.entries()
+	if reverse {
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+	}
+
+	return &artTreeIterator{
+		indexNumber:    0,
+		positionValues: entries,
+		isReverse:      reverse,
+	}
+}
+
+// Destroy releases the snapshot, the tree stops keeping old positions for it
+func (s *artSnapshot) Destroy() error {
+	s.tree.treeLock.Lock()
+	defer s.tree.treeLock.Unlock()
+
+	delete(s.tree.snapshots, s)
+	return nil
+}
+
+func (s *artSnapshot) Clone() Indexer {
+	tree := artTree.New()
+	for _, e := range s.entries() {
+		tree.Insert(e.Key, e.Position)
+	}
+
+	return &AdaptiveRadixTree{
+		tree:      tree,
+		treeLock:  new(sync.RWMutex),
+		snapshots: make(map[*artSnapshot]struct{}),
+	}
+}
+
+func (s *artSnapshot) Snapshot() Indexer {
+	return s.Clone()
+}
+
 // ######################## Iterator ########################
 
 type artTreeIterator struct {
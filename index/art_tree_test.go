@@ -72,3 +72,53 @@ func TestIterator(t *testing.T) {
 		assert.NotNil(t, iter.Value())
 	}
 }
+
+func TestClone(t *testing.T) {
+	art := NewAdaptiveRadixTree()
+	art.Put([]byte("key-a"), &content.LogStructIndex{FileIndex: 1, Offset: 18})
+	art.Put([]byte("key-b"), &content.LogStructIndex{FileIndex: 1, Offset: 36})
+
+	cloned := art.Clone()
+	art.Put([]byte("key-a"), &content.LogStructIndex{FileIndex: 2, Offset: 18})
+	art.Delete([]byte("key-b"))
+
+	assert.Equal(t, uint32(1), cloned.Get([]byte("key-a")).FileIndex)
+	assert.NotNil(t, cloned.Get([]byte("key-b")))
+	assert.Equal(t, 2, cloned.Size())
+	assert.Equal(t, 1, art.Size())
+}
+
+func TestArtSnapshot(t *testing.T) {
+	art := NewAdaptiveRadixTree()
+	art.Put([]byte("key-a"), &content.LogStructIndex{FileIndex: 1, Offset: 18})
+	art.Put([]byte("key-b"), &content.LogStructIndex{FileIndex: 1, Offset: 36})
+
+	snap := art.Snapshot()
+	art.Put([]byte("key-a"), &content.LogStructIndex{FileIndex: 2, Offset: 18})
+	art.Put([]byte("key-a"), &content.LogStructIndex{FileIndex: 3, Offset: 18})
+	art.Delete([]byte("key-b"))
+	art.Put([]byte("key-c"), &content.LogStructIndex{FileIndex: 2, Offset: 36})
+
+	assert.Equal(t, uint32(1), snap.Get([]byte("key-a")).FileIndex)
+	assert.NotNil(t, snap.Get([]byte("key-b")))
+	assert.Nil(t, snap.Get([]byte("key-c")))
+	assert.Equal(t, 2, snap.Size())
+	assert.Equal(t, 2, art.Size())
+
+	var keys []string
+	iter := snap.Iterator(true)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	assert.Equal(t, []string{"key-b", "key-a"}, keys)
+
+	iter = snap.Iterator(false)
+	iter.Seek([]byte("key-aa"))
+	assert.True(t, iter.Valid())
+	assert.Equal(t, []byte("key-b"), iter.Key())
+
+	// a released snapshot is not kept up by the tree
+	assert.Nil(t, snap.Destroy())
+	art.Put([]byte("key-d"), &content.LogStructIndex{FileIndex: 2, Offset: 54})
+	assert.Equal(t, 0, len(art.snapshots))
+}
@@ -35,8 +35,11 @@ func (b *Btree) Put(key []byte, position *content.LogStructIndex) *content.LogSt
 	return oldIndexer.(*Entry).Position
 }
 
-// google btree read is safe, no need to lock
+// google btree read is not safe with a concurrent write, e.g. merge reads index without db lock
 func (b *Btree) Get(key []byte) *content.LogStructIndex {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
 	e := &Entry{Key: key}
 	item := b.tree.Get(e)
 	if item == nil {
@@ -68,6 +71,22 @@ func (b *Btree) Destroy() error {
 	return nil
 }
 
+// google btree clone is lazy copy-on-write, but it changes the original tree
+func (b *Btree) Clone() Indexer {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return &Btree{
+		tree: b.tree.Clone(),
+		lock: new(sync.RWMutex),
+	}
+}
+
+// the lazy clone is cheap enough for a snapshot, nothing to release
+func (b *Btree) Snapshot() Indexer {
+	return b.Clone()
+}
+
 type btreeIterator struct {
 	indexNumber    int
 	isReverse      bool
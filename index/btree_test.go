@@ -97,3 +97,21 @@ func TestBTreeIterator(t *testing.T) {
 		assert.NotNil(t, iter6.Key())
 	}
 }
+
+func TestBTreeClone(t *testing.T) {
+	bt := NewBtree()
+	bt.Put([]byte("a"), &content.LogStructIndex{FileIndex: 1, Offset: 10})
+	bt.Put([]byte("b"), &content.LogStructIndex{FileIndex: 1, Offset: 20})
+
+	cloned := bt.Clone()
+	bt.Put([]byte("a"), &content.LogStructIndex{FileIndex: 2, Offset: 10})
+	bt.Delete([]byte("b"))
+	cloned.Put([]byte("c"), &content.LogStructIndex{FileIndex: 1, Offset: 30})
+
+	assert.Equal(t, uint32(1), cloned.Get([]byte("a")).FileIndex)
+	assert.NotNil(t, cloned.Get([]byte("b")))
+	assert.Equal(t, 3, cloned.Size())
+	assert.Equal(t, uint32(2), bt.Get([]byte("a")).FileIndex)
+	assert.Nil(t, bt.Get([]byte("c")))
+	assert.Equal(t, 1, bt.Size())
+}
@@ -29,6 +29,13 @@ type Indexer interface {
 
 	// Destroy the index
 	Destroy() error
+
+	// Clone returns a copy of the index, later changes of one are not seen by the other
+	Clone() Indexer
+
+	// Snapshot returns a read only view of the index now, later changes of the index are not seen by it.
+	// it is cheap to take, and must be released by Destroy
+	Snapshot() Indexer
 }
 
 type Entry struct {
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bamboo/content"
+	"bamboo/db"
+	"flag"
+	"log"
+)
+
+// migrate rewrites a closed db to another format version:
+//
+//	go run ./migrate -dir /path/to/db -version 1
+func main() {
+	dir := flag.String("dir", "", "data dir of the db")
+	version := flag.Uint("version", uint(content.CurrentFormat), "format version to write, 0 is the legacy format")
+	flag.Parse()
+
+	if *dir == "" {
+		log.Fatal("-dir is required")
+	}
+	if *version > uint(content.CurrentFormat) {
+		log.Fatalf("format version %d is not supported", *version)
+	}
+	if err := db.Migrate(*dir, content.FormatVersion(*version)); err != nil {
+		log.Fatalf("failed to migrate %s: %v", *dir, err)
+	}
+	log.Printf("migrated %s to format version %d", *dir, *version)
+}